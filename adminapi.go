@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// the admin api is only enabled if a key is configured, every request has to
+// send it in the X-Api-Key header
+var adminapikey string
+
+func initAdminApi(key string) {
+	if len(key) == 0 {
+		return
+	}
+
+	adminapikey = key
+	http.HandleFunc("/admin/timers", adminHandler(handleAdminTimers))
+	http.HandleFunc("/admin/bans", adminHandler(handleAdminBans))
+}
+
+func adminHandler(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-Api-Key")
+		if subtle.ConstantTimeCompare([]byte(key), []byte(adminapikey)) != 1 {
+			writeApiError(w, http.StatusForbidden, "nopermission")
+			return
+		}
+
+		f(w, r)
+	}
+}
+
+func writeApiResponse(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if data != nil {
+		json.NewEncoder(w).Encode(data)
+	}
+}
+
+func writeApiError(w http.ResponseWriter, status int, identifier string) {
+	writeApiResponse(w, status, GenericError{identifier})
+}
+
+func handleAdminTimers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeApiResponse(w, http.StatusOK, getTimers())
+	case "POST":
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MAXMESSAGESIZE))
+		if err != nil {
+			writeApiError(w, http.StatusBadRequest, "protocolerror")
+			return
+		}
+
+		in := &TimerIn{}
+		if err := Unmarshal(body, in); err != nil {
+			writeApiError(w, http.StatusBadRequest, "protocolerror")
+			return
+		}
+
+		t, err := addTimer(in, "api")
+		if err != nil {
+			writeApiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeApiResponse(w, http.StatusCreated, t)
+	case "DELETE":
+		id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			writeApiError(w, http.StatusBadRequest, "protocolerror")
+			return
+		}
+
+		if !deleteTimer(id) {
+			writeApiError(w, http.StatusNotFound, "notfound")
+			return
+		}
+		writeApiResponse(w, http.StatusNoContent, nil)
+	default:
+		writeApiError(w, http.StatusMethodNotAllowed, "protocolerror")
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	conf "github.com/msbranco/goconfig"
+)
+
+var (
+	archiveenabled   = false
+	archivedir       = "logs"
+	archivecompress  = true
+	archiveskip      = []string{"JOIN", "QUIT", "CONNECTIONCOUNT"}
+	ARCHIVERETENTION = time.Duration(0) // how long the files are kept, 0 means forever
+)
+
+var (
+	archiveWritten = expvar.NewInt("archiveWritten")
+	archiveDropped = expvar.NewInt("archiveDropped")
+)
+
+const archivedateformat = "2006-01-02"
+
+func readArchiveConfig(c *conf.ConfigFile) {
+	archiveenabled, _ = c.GetBool("archive", "enabled")
+	if v, err := c.GetString("archive", "dir"); err == nil && len(v) != 0 {
+		archivedir = v
+	}
+	if v, err := c.GetBool("archive", "compress"); err == nil {
+		archivecompress = v
+	}
+	if v, err := c.GetString("archive", "skip"); err == nil {
+		archiveskip = splitConfigList(strings.ToUpper(v))
+	}
+	if v, err := c.GetInt64("archive", "retention"); err == nil {
+		ARCHIVERETENTION = time.Duration(v)
+	}
+	searchindexenabled, _ = c.GetBool("archive", "index")
+	if v, err := c.GetInt64("archive", "searchpagesize"); err == nil && v > 0 {
+		LOGSEARCHPAGESIZE = int(v)
+	}
+	if v, err := c.GetInt64("archive", "searchmaxscan"); err == nil && v > 0 {
+		LOGSEARCHMAXSCAN = int(v)
+	}
+}
+
+type ArchiveEntry struct {
+	Event     string          `json:"event"`
+	Timestamp int64           `json:"timestamp"`
+	Data      json.RawMessage `json:"data"`
+}
+
+type Archiver struct {
+	dir      string
+	compress bool
+	skip     map[string]bool
+	queue    chan *message
+	day      string
+	jsonl    *os.File
+	text     *os.File
+}
+
+// archiver is nil when archiving is disabled
+var archiver *Archiver
+
+func newArchiver(dir string, compress bool, skip []string) *Archiver {
+	a := &Archiver{
+		dir:      dir,
+		compress: compress,
+		skip:     make(map[string]bool),
+		queue:    make(chan *message, BROADCASTCHANNELSIZE),
+	}
+	for _, event := range skip {
+		a.skip[event] = true
+	}
+	return a
+}
+
+func initArchiver() {
+	if !archiveenabled {
+		return
+	}
+
+	if err := os.MkdirAll(archivedir, 0755); err != nil {
+		F("Unable to create the archive directory", archivedir, err)
+	}
+
+	archiver = newArchiver(archivedir, archivecompress, archiveskip)
+	go archiver.run()
+}
+
+// enqueue queues the broadcast event for archiving, called from the hub so it
+// must never block, if the archiver cannot keep up the event is dropped
+func (a *Archiver) enqueue(m *message) {
+	if a == nil || a.skip[m.event] {
+		return
+	}
+
+	select {
+	case a.queue <- m:
+	default:
+		archiveDropped.Add(1)
+	}
+}
+
+func (a *Archiver) run() {
+	for m := range a.queue {
+		a.write(time.Now().UTC(), m)
+	}
+}
+
+func (a *Archiver) write(now time.Time, m *message) {
+	data, ok := m.data.([]byte)
+	if !ok {
+		return
+	}
+
+	if day := now.Format(archivedateformat); day != a.day {
+		a.rotate(day)
+	}
+	if a.jsonl == nil || a.text == nil {
+		archiveDropped.Add(1)
+		return
+	}
+
+	line, _ := json.Marshal(&ArchiveEntry{
+		Event:     m.event,
+		Timestamp: now.UnixNano() / int64(time.Millisecond),
+		Data:      json.RawMessage(data),
+	})
+	if _, err := a.jsonl.Write(append(line, '\n')); err != nil {
+		D("Unable to write to the archive", err)
+	}
+
+	out := &EventDataOut{}
+	if err := json.Unmarshal(data, out); err == nil {
+		if text := formatArchiveText(now, m.event, out); len(text) != 0 {
+			if _, err := io.WriteString(a.text, text+"\n"); err != nil {
+				D("Unable to write to the archive", err)
+			}
+		}
+	}
+	archiveWritten.Add(1)
+}
+
+// formatArchiveText formats the event the classic way, returns an empty string
+// for events that have no place in the text log
+func formatArchiveText(now time.Time, event string, out *EventDataOut) string {
+	nick := ""
+	if out.SimplifiedUser != nil {
+		nick = out.Nick
+	}
+
+	ts := now.Format("[2006-01-02 15:04:05 MST] ")
+	switch event {
+	case "MSG":
+		return ts + nick + ": " + out.Data
+	case "BROADCAST":
+		return ts + "*** " + out.Data
+	}
+
+	if len(out.Data) == 0 && len(nick) == 0 {
+		return ""
+	}
+	line := ts + "*** " + event
+	if len(out.Data) != 0 {
+		line += " " + out.Data
+	}
+	if out.Duration != 0 {
+		line += fmt.Sprintf(" for %ds", out.Duration)
+	}
+	if len(nick) != 0 {
+		line += " by " + nick
+	}
+	return line
+}
+
+// rotate closes the files of the previous day and opens the ones of the day,
+// compressing and cleaning up the old files in the background
+func (a *Archiver) rotate(day string) {
+	if a.jsonl != nil {
+		a.jsonl.Close()
+	}
+	if a.text != nil {
+		a.text.Close()
+	}
+	a.day = day
+	a.jsonl = a.open(day + ".jsonl")
+	a.text = a.open(day + ".txt")
+
+	go a.maintain(day, time.Now().UTC())
+}
+
+func (a *Archiver) open(name string) *os.File {
+	f, err := os.OpenFile(filepath.Join(a.dir, name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		D("Unable to open archive file", name, err)
+		return nil
+	}
+	return f
+}
+
+// maintain compresses the files of the days before today and removes the ones
+// past the retention
+func (a *Archiver) maintain(today string, now time.Time) {
+	files, err := ioutil.ReadDir(a.dir)
+	if err != nil {
+		D("Unable to list the archive directory", err)
+		return
+	}
+
+	for _, f := range files {
+		name := f.Name()
+		if len(name) < len(archivedateformat) {
+			continue
+		}
+		day := name[:len(archivedateformat)]
+		t, err := time.Parse(archivedateformat, day)
+		if err != nil || day >= today {
+			continue
+		}
+
+		path := filepath.Join(a.dir, name)
+		if ARCHIVERETENTION > 0 && now.Sub(t) > ARCHIVERETENTION {
+			if err := os.Remove(path); err != nil {
+				D("Unable to remove old archive file", path, err)
+			}
+			continue
+		}
+
+		if a.compress && !strings.HasSuffix(name, ".gz") {
+			if err := compressFile(path); err != nil {
+				D("Unable to compress archive file", path, err)
+			}
+		}
+	}
+}
+
+// compressFile gzips the file next to the original then removes the original
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchiveWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := newArchiver(dir, false, []string{"JOIN"})
+	now := time.Date(2026, 10, 19, 14, 2, 3, 0, time.UTC)
+	a.write(now, &message{event: "MSG", data: []byte(`{"nick":"bob","timestamp":1,"data":"hello"}`)})
+	a.write(now, &message{event: "MUTE", data: []byte(`{"nick":"mod","timestamp":1,"data":"bob","duration":600}`)})
+
+	text, _ := ioutil.ReadFile(filepath.Join(dir, "2026-10-19.txt"))
+	expected := "[2026-10-19 14:02:03 UTC] bob: hello\n[2026-10-19 14:02:03 UTC] *** MUTE bob for 600s by mod\n"
+	if string(text) != expected {
+		t.Errorf("unexpected text log, got %q", text)
+	}
+
+	jsonl, _ := ioutil.ReadFile(filepath.Join(dir, "2026-10-19.jsonl"))
+	if lines := strings.Split(strings.TrimSpace(string(jsonl)), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[0], `{"event":"MSG"`) {
+		t.Error("unexpected jsonl log", string(jsonl))
+	}
+}
+
+func TestArchiveMaintain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"2026-10-01.txt", "2026-10-18.txt", "2026-10-19.txt"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte("log\n"), 0644)
+	}
+
+	oldretention := ARCHIVERETENTION
+	ARCHIVERETENTION = 7 * 24 * time.Hour
+	defer func() { ARCHIVERETENTION = oldretention }()
+
+	a := newArchiver(dir, true, nil)
+	a.maintain("2026-10-19", time.Date(2026, 10, 19, 0, 0, 1, 0, time.UTC))
+
+	files, _ := ioutil.ReadDir(dir)
+	names := make([]string, 0)
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	if strings.Join(names, ",") != "2026-10-18.txt.gz,2026-10-19.txt" {
+		t.Error("expected the old file removed and yesterday compressed, got", names)
+	}
+}
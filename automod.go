@@ -0,0 +1,551 @@
+package main
+
+import (
+	"database/sql"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/tideland/golib/redis"
+)
+
+// the kinds of rules the automod understands
+const (
+	AUTOMODPHRASE = "phrase" // case insensitive literal match
+	AUTOMODREGEX  = "regex"  // regular expression match
+	AUTOMODFUZZY  = "fuzzy"  // match against the normalized message, see automodNormalize
+)
+
+// the actions a rule can take, ordered by severity so the most severe action
+// of all the matching rules wins
+const (
+	AUTOMODCENSOR = "censor"
+	AUTOMODREJECT = "reject"
+	AUTOMODHOLD   = "hold"
+	AUTOMODMUTE   = "mute"
+)
+
+var automodseverity = map[string]int{
+	AUTOMODCENSOR: 1,
+	AUTOMODREJECT: 2,
+	AUTOMODHOLD:   3,
+	AUTOMODMUTE:   4,
+}
+
+var (
+	automodenabled  = true
+	automodprivmsg  = false
+	AUTOMODHOLDTIME = 10 * time.Minute // how long a held message waits for a moderator before being discarded
+	// leetspeak and lookalike characters mapped back to letters for fuzzy matching
+	automodleet = map[rune]rune{
+		'0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't', '8': 'b',
+		'@': 'a', '$': 's', '!': 'i', '|': 'l', '+': 't',
+	}
+)
+
+type automodRule struct {
+	id       int64
+	kind     string
+	pattern  string
+	action   string
+	duration int64
+	re       *regexp.Regexp
+	fuzzy    string
+}
+
+type heldMessage struct {
+	id        int64
+	user      SimplifiedUser
+	u         *User // shared with the connections of the user
+	msg       string
+	rule      *automodRule // nil for messages held for their links
+	timestamp time.Time
+}
+
+type Automod struct {
+	rules  []*automodRule
+	held   map[int64]*heldMessage
+	heldid int64
+	sync.RWMutex
+}
+
+type AutomodRuleIn struct {
+	Kind     string `json:"kind"`
+	Pattern  string `json:"pattern"`
+	Action   string `json:"action"`
+	Duration int64  `json:"duration"`
+}
+
+type AutomodRuleOut struct {
+	Id       int64  `json:"id"`
+	Kind     string `json:"kind"`
+	Pattern  string `json:"pattern"`
+	Action   string `json:"action"`
+	Duration int64  `json:"duration,omitempty"`
+}
+
+type AutomodHitOut struct {
+	Nick      string         `json:"nick"`
+	Data      string         `json:"data"`
+	Action    string         `json:"action"`
+	Privmsg   bool           `json:"privmsg,omitempty"`
+	Heldid    int64          `json:"heldid,omitempty"`
+	Rule      AutomodRuleOut `json:"rule"`
+	Timestamp int64          `json:"timestamp"`
+}
+
+// AutomodReviewOut tells the moderators how a held message was resolved, Nick
+// is the reviewing moderator and Target the author of the message
+type AutomodReviewOut struct {
+	Nick      string `json:"nick"`
+	Target    string `json:"target"`
+	Heldid    int64  `json:"heldid"`
+	Approved  bool   `json:"approved"`
+	Sent      bool   `json:"sent"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+var automod = Automod{
+	rules: make([]*automodRule, 0),
+	held:  make(map[int64]*heldMessage),
+}
+
+func initAutomod(redisdb int64) {
+	go automod.run(redisdb)
+}
+
+func (am *Automod) run(redisdb int64) {
+	am.loadRules()
+
+	go am.runRefresh(redisdb)
+
+	t := time.NewTicker(time.Minute)
+	for {
+		select {
+		case <-t.C:
+			am.clean()
+		}
+	}
+}
+
+func (am *Automod) runRefresh(redisdb int64) {
+	setupRedisSubscription("refreshautomod", redisdb, func(result *redis.PublishedValue) {
+		D("Refreshing automod rules")
+		am.loadRules()
+	})
+}
+
+func (am *Automod) clean() {
+	am.Lock()
+	defer am.Unlock()
+
+	for id, h := range am.held {
+		if time.Since(h.timestamp) > AUTOMODHOLDTIME {
+			delete(am.held, id)
+		}
+	}
+}
+
+func newAutomodRule(id int64, kind, pattern, action string, duration int64) (*automodRule, error) {
+	r := &automodRule{
+		id:       id,
+		kind:     kind,
+		pattern:  pattern,
+		action:   action,
+		duration: duration,
+	}
+
+	if _, ok := automodseverity[action]; !ok {
+		return nil, GenericError{"protocolerror"}
+	}
+
+	var err error
+	switch kind {
+	case AUTOMODPHRASE:
+		r.re, err = regexp.Compile(`(?i)` + regexp.QuoteMeta(pattern))
+	case AUTOMODREGEX:
+		r.re, err = regexp.Compile(pattern)
+	case AUTOMODFUZZY:
+		r.fuzzy = automodNormalize(pattern)
+		if len(r.fuzzy) == 0 {
+			return nil, GenericError{"protocolerror"}
+		}
+	default:
+		return nil, GenericError{"protocolerror"}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if r.action == AUTOMODMUTE && r.duration <= 0 {
+		r.duration = int64(DEFAULTMUTEDURATION)
+	}
+
+	return r, nil
+}
+
+func (am *Automod) loadRules() {
+	rules := make([]*automodRule, 0)
+	db.getAutomodRules(func(id int64, kind, pattern, action string, duration sql.NullInt64) {
+		r, err := newAutomodRule(id, kind, pattern, action, duration.Int64*int64(time.Second))
+		if err != nil {
+			D("Skipping invalid automod rule", id, pattern, err)
+			return
+		}
+		rules = append(rules, r)
+	})
+
+	am.Lock()
+	defer am.Unlock()
+	am.rules = rules
+}
+
+func (am *Automod) addRule(kind, pattern, action string, duration int64) (*automodRule, error) {
+	r, err := newAutomodRule(0, kind, pattern, action, duration)
+	if err != nil {
+		return nil, err
+	}
+
+	r.id, err = db.insertAutomodRule(r.kind, r.pattern, r.action, r.duration)
+	if err != nil {
+		return nil, err
+	}
+
+	am.Lock()
+	defer am.Unlock()
+	am.rules = append(am.rules, r)
+	return r, nil
+}
+
+func (am *Automod) deleteRule(id int64) bool {
+	am.Lock()
+	defer am.Unlock()
+
+	for i, r := range am.rules {
+		if r.id == id {
+			db.deleteAutomodRule(id)
+			am.rules = append(am.rules[:i:i], am.rules[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (am *Automod) getRules() []AutomodRuleOut {
+	am.RLock()
+	defer am.RUnlock()
+
+	out := make([]AutomodRuleOut, 0, len(am.rules))
+	for _, r := range am.rules {
+		out = append(out, r.out())
+	}
+	return out
+}
+
+func (r *automodRule) out() AutomodRuleOut {
+	return AutomodRuleOut{
+		Id:       r.id,
+		Kind:     r.kind,
+		Pattern:  r.pattern,
+		Action:   r.action,
+		Duration: r.duration / int64(time.Second),
+	}
+}
+
+// automodNormalize lowercases the message, maps lookalike characters back to
+// letters, drops everything else that is not a letter and collapses repeated
+// characters, so "B.A.A.A.D   w0rd" becomes "badword"
+func automodNormalize(s string) string {
+	b := make([]rune, 0, len(s))
+	var last rune
+	for _, r := range strings.ToLower(s) {
+		if l, ok := automodleet[r]; ok {
+			r = l
+		}
+		if !unicode.IsLetter(r) || r == last {
+			continue
+		}
+		b = append(b, r)
+		last = r
+	}
+	return string(b)
+}
+
+func (r *automodRule) match(msg, normalized string) bool {
+	if r.kind == AUTOMODFUZZY {
+		return strings.Contains(normalized, r.fuzzy)
+	}
+	return r.re.MatchString(msg)
+}
+
+func censorString(s string) string {
+	return strings.Repeat("*", utf8.RuneCountInString(s))
+}
+
+func (r *automodRule) censor(msg string) string {
+	if r.kind != AUTOMODFUZZY {
+		return r.re.ReplaceAllStringFunc(msg, censorString)
+	}
+
+	// fuzzy matches have no exact position in the original message, so censor
+	// every word containing the phrase, or everything if it spans words
+	censored := false
+	words := strings.Fields(msg)
+	for i, w := range words {
+		if strings.Contains(automodNormalize(w), r.fuzzy) {
+			words[i] = censorString(w)
+			censored = true
+		}
+	}
+	if !censored {
+		return censorString(msg)
+	}
+	return strings.Join(words, " ")
+}
+
+// check runs the message through every rule, the returned message is the one
+// to use (it may have been censored), if the bool is false the message must
+// not be sent and the user has already been notified
+func (am *Automod) check(c *Connection, msg string, privmsg bool) (string, bool) {
+	if !automodenabled || c.user == nil || c.user.isProtected() {
+		return msg, true
+	}
+	if privmsg && !automodprivmsg {
+		return msg, true
+	}
+
+	am.RLock()
+	var hit *automodRule
+	normalized := automodNormalize(msg)
+	original := msg
+	for _, r := range am.rules {
+		if !r.match(original, normalized) {
+			continue
+		}
+		if r.action == AUTOMODCENSOR {
+			msg = r.censor(msg)
+		}
+		if hit == nil || automodseverity[r.action] > automodseverity[hit.action] {
+			hit = r
+		}
+	}
+	am.RUnlock()
+
+	if hit == nil {
+		return msg, true
+	}
+
+	var heldid int64
+	action := hit.action
+	if action == AUTOMODHOLD {
+		if privmsg {
+			// there is nothing to hold a whisper for, treat it as rejected
+			action = AUTOMODREJECT
+		} else {
+			heldid = am.hold(c, original, hit)
+		}
+	}
+
+	am.report(c, original, hit, action, privmsg, heldid)
+
+	switch action {
+	case AUTOMODCENSOR:
+		return msg, true
+	case AUTOMODHOLD:
+		c.SendError("held")
+	case AUTOMODMUTE:
+		c.autoMute(hit.duration)
+	default:
+		c.SendError("automod")
+	}
+
+	return msg, false
+}
+
+func (am *Automod) hold(c *Connection, msg string, rule *automodRule) int64 {
+	c.rlockUserIfExists()
+	su := *c.user.simplified
+	c.runlockUserIfExists()
+
+	am.Lock()
+	defer am.Unlock()
+	am.heldid++
+	am.held[am.heldid] = &heldMessage{
+		id:        am.heldid,
+		user:      su,
+		u:         c.user,
+		msg:       msg,
+		rule:      rule,
+		timestamp: time.Now(),
+	}
+	return am.heldid
+}
+
+func (am *Automod) report(c *Connection, msg string, rule *automodRule, action string, privmsg bool, heldid int64) {
+	P("Automod", action, "rule", rule.id, "matched for", c.user.nick, c.user.id, "message:", msg)
+
+	hub.broadcastModerators("AUTOMOD", &AutomodHitOut{
+		Nick:      c.user.nick,
+		Data:      msg,
+		Action:    action,
+		Privmsg:   privmsg,
+		Heldid:    heldid,
+		Rule:      rule.out(),
+		Timestamp: unixMilliTime(),
+	})
+}
+
+// release removes the held message, returning it if it was still held
+func (am *Automod) release(id int64) *heldMessage {
+	am.Lock()
+	defer am.Unlock()
+
+	h, ok := am.held[id]
+	if !ok {
+		return nil
+	}
+	delete(am.held, id)
+	return h
+}
+
+func init() {
+	registerCommand(&command{
+		name:       "AUTOMODADD",
+		help:       "adds an automod rule",
+		permission: PERMADMIN,
+		payload: func() interface{} {
+			return &AutomodRuleIn{}
+		},
+		handler: func(c *Connection, p interface{}) {
+			c.OnAutomodAdd(p.(*AutomodRuleIn))
+		},
+	})
+	registerCommand(&command{
+		name:       "AUTOMODDELETE",
+		help:       "deletes an automod rule",
+		permission: PERMADMIN,
+		payload:    newEventDataIn,
+		handler: func(c *Connection, p interface{}) {
+			c.OnAutomodDelete(p.(*EventDataIn))
+		},
+	})
+	registerCommand(&command{
+		name:       "AUTOMODLIST",
+		help:       "lists the automod rules",
+		permission: PERMMODERATOR,
+		limit:      querylimit,
+		handler: func(c *Connection, _ interface{}) {
+			c.OnAutomodList()
+		},
+	})
+	registerCommand(&command{
+		name:       "AUTOMODAPPROVE",
+		help:       "approves a message held by automod",
+		permission: PERMMODERATOR,
+		payload:    newEventDataIn,
+		handler: func(c *Connection, p interface{}) {
+			c.OnAutomodReview(p.(*EventDataIn), true)
+		},
+	})
+	registerCommand(&command{
+		name:       "AUTOMODDENY",
+		help:       "denies a message held by automod",
+		permission: PERMMODERATOR,
+		payload:    newEventDataIn,
+		handler: func(c *Connection, p interface{}) {
+			c.OnAutomodReview(p.(*EventDataIn), false)
+		},
+	})
+}
+
+func (c *Connection) OnAutomodAdd(r *AutomodRuleIn) {
+	rule, err := automod.addRule(strings.ToLower(r.Kind), r.Pattern, strings.ToLower(r.Action), r.Duration)
+	if err != nil {
+		D("Unable to add automod rule", r, err)
+		c.SendError("protocolerror")
+		return
+	}
+
+	c.EmitBlock("AUTOMODRULES", []AutomodRuleOut{rule.out()})
+}
+
+// OnAutomodDelete expects Data to be the rule id
+func (c *Connection) OnAutomodDelete(m *EventDataIn) {
+	id, err := strconv.ParseInt(m.Data, 10, 64)
+	if err != nil {
+		c.SendError("protocolerror")
+		return
+	}
+
+	if !automod.deleteRule(id) {
+		c.SendError("notfound")
+		return
+	}
+
+	c.EmitBlock("AUTOMODRULES", automod.getRules())
+}
+
+func (c *Connection) OnAutomodList() {
+	c.EmitBlock("AUTOMODRULES", automod.getRules())
+}
+
+// OnAutomodReview handles both approving (broadcasting) and denying held
+// messages, expects Data to be the held message id, the moderator gets the
+// resolution back and it is broadcast to the other moderators so that they
+// can drop the message from their queue
+func (c *Connection) OnAutomodReview(m *EventDataIn, approve bool) {
+	id, err := strconv.ParseInt(m.Data, 10, 64)
+	if err != nil {
+		c.SendError("protocolerror")
+		return
+	}
+
+	h := automod.release(id)
+	if h == nil {
+		c.SendError("notfound")
+		return
+	}
+
+	D("Held message", id, "from", h.user.Nick, "reviewed by", c.user.nick, "approved:", approve)
+	out := &AutomodReviewOut{
+		Nick:     c.user.nick,
+		Target:   h.user.Nick,
+		Heldid:   id,
+		Approved: approve,
+	}
+	if approve {
+		out.Sent = h.approve()
+	}
+	out.Timestamp = unixMilliTime()
+
+	c.EmitBlock("AUTOMODREVIEW", out)
+	hub.broadcastModerators("AUTOMODREVIEW", out)
+}
+
+// approve sends the held message on from the stage that held it, as if it was
+// sent now, through a connection of its own since the user could be gone
+// already, returns whether it was broadcast
+func (h *heldMessage) approve() bool {
+	after := "automod"
+	if h.rule == nil {
+		after = "links"
+	}
+	uc := newBotConnection(h.u, "")
+	pm, ok, err := msgpipeline.resume(uc, h.msg, after)
+	if err != nil {
+		D("Unable to resume approved message", h.id, err)
+		return false
+	}
+	if !ok {
+		D("Approved message", h.id, "from", h.user.Nick, "stopped after", after)
+		return false
+	}
+	uc.sendMsg(pm.msg)
+	return true
+}
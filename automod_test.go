@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAutomodNormalize(t *testing.T) {
+	cases := map[string]string{
+		"B.A.A.A.D   w0rd": "badword",
+		"h3ll0 th3r3":      "helothere",
+		"$p4m":             "spam",
+		"":                 "",
+	}
+
+	for in, expected := range cases {
+		if r := automodNormalize(in); r != expected {
+			t.Errorf("automodNormalize(%q) was %q (expected: %q)", in, r, expected)
+		}
+	}
+}
+
+func TestAutomodRules(t *testing.T) {
+	phrase, err := newAutomodRule(1, AUTOMODPHRASE, "bad word", AUTOMODCENSOR, 0)
+	if err != nil {
+		t.Fatal("phrase rule should be valid", err)
+	}
+	msg := "this is a BAD WORD here"
+	if !phrase.match(msg, automodNormalize(msg)) {
+		t.Error("phrase rule should match case insensitively")
+	}
+	if r := phrase.censor(msg); r != "this is a ******** here" {
+		t.Error("phrase rule censored incorrectly:", r)
+	}
+
+	fuzzy, err := newAutomodRule(2, AUTOMODFUZZY, "spam", AUTOMODREJECT, 0)
+	if err != nil {
+		t.Fatal("fuzzy rule should be valid", err)
+	}
+	msg = "buy $$p4aam now"
+	if !fuzzy.match(msg, automodNormalize(msg)) {
+		t.Error("fuzzy rule should match the obfuscated message")
+	}
+	if r := fuzzy.censor(msg); r != "buy ******* now" {
+		t.Error("fuzzy rule censored incorrectly:", r)
+	}
+
+	mute, err := newAutomodRule(3, AUTOMODREGEX, `^a+$`, AUTOMODMUTE, 0)
+	if err != nil {
+		t.Fatal("regex rule should be valid", err)
+	}
+	if mute.duration <= 0 {
+		t.Error("mute rule without a duration should get the default mute duration")
+	}
+
+	if _, err := newAutomodRule(4, AUTOMODREGEX, `(`, AUTOMODREJECT, 0); err == nil {
+		t.Error("invalid regex should not be accepted")
+	}
+	if _, err := newAutomodRule(5, AUTOMODPHRASE, "x", "explode", 0); err == nil {
+		t.Error("unknown action should not be accepted")
+	}
+}
@@ -12,15 +12,23 @@ import (
 
 type Bans struct {
 	users    map[Userid]time.Time
+	shadow   map[Userid]time.Time // protected by userlock too
 	userlock sync.RWMutex
 	ips      map[string]time.Time
 	userips  map[Userid][]string
 	iplock   sync.RWMutex // protects both ips/userips
 }
 
+// the types of bans in the type column of the bans table
+const (
+	BANTYPEBAN    = "ban"
+	BANTYPESHADOW = "shadow"
+)
+
 var (
 	ipv6mask = net.CIDRMask(64, 128)
 	bans     = Bans{
+		make(map[Userid]time.Time),
 		make(map[Userid]time.Time),
 		sync.RWMutex{},
 		make(map[string]time.Time),
@@ -92,6 +100,12 @@ func (b *Bans) clean() {
 		}
 	}
 
+	for uid, unbantime := range b.shadow {
+		if isExpiredUTC(unbantime) {
+			delete(b.shadow, uid)
+		}
+	}
+
 	for ip, unbantime := range b.ips {
 		if isExpiredUTC(unbantime) {
 			delete(b.ips, ip)
@@ -99,19 +113,20 @@ func (b *Bans) clean() {
 	}
 }
 
-func (b *Bans) banUser(uid Userid, targetuid Userid, ban *BanIn) {
-	var expiretime time.Time
-
+func getBanExpireTime(ban *BanIn) time.Time {
 	if ban.Ispermanent {
-		expiretime = getFuturetimeUTC()
-	} else {
-		expiretime = addDurationUTC(time.Duration(ban.Duration))
+		return getFuturetimeUTC()
 	}
+	return addDurationUTC(time.Duration(ban.Duration))
+}
+
+func (b *Bans) banUser(uid Userid, targetuid Userid, ban *BanIn) {
+	expiretime := getBanExpireTime(ban)
 
 	b.userlock.Lock()
 	b.users[targetuid] = expiretime
 	b.userlock.Unlock()
-	b.log(uid, targetuid, ban, "")
+	b.log(uid, targetuid, ban, "", BANTYPEBAN)
 
 	if ban.BanIP {
 		ips := getIPCacheForUser(targetuid)
@@ -128,7 +143,7 @@ func (b *Bans) banUser(uid Userid, targetuid Userid, ban *BanIn) {
 		for _, ip := range ips {
 			b.banIP(targetuid, ip, expiretime, true)
 			hub.ipbans <- ip
-			b.log(uid, targetuid, ban, ip)
+			b.log(uid, targetuid, ban, ip, BANTYPEBAN)
 			D("IPBanned user", ban.Nick, targetuid, "with ip:", ip)
 		}
 
@@ -138,6 +153,16 @@ func (b *Bans) banUser(uid Userid, targetuid Userid, ban *BanIn) {
 	D("Banned user", ban.Nick, targetuid)
 }
 
+// shadowbanUser lets the user keep chatting, but nobody besides the user and
+// the moderators sees the messages
+func (b *Bans) shadowbanUser(uid Userid, targetuid Userid, ban *BanIn) {
+	b.userlock.Lock()
+	b.shadow[targetuid] = getBanExpireTime(ban)
+	b.userlock.Unlock()
+	b.log(uid, targetuid, ban, "", BANTYPESHADOW)
+	D("Shadowbanned user", ban.Nick, targetuid)
+}
+
 func (b *Bans) banIP(uid Userid, ip string, t time.Time, skiplock bool) {
 	if !skiplock { // because the caller holds the locks
 		b.iplock.Lock()
@@ -159,6 +184,7 @@ func (b *Bans) unbanUserid(uid Userid) {
 	defer b.iplock.Unlock()
 
 	delete(b.users, uid)
+	delete(b.shadow, uid)
 	for _, ip := range b.userips[uid] {
 		delete(b.ips, ip)
 		D("Unbanned IP: ", ip, "for uid:", uid)
@@ -184,6 +210,16 @@ func (b *Bans) isUseridBanned(uid Userid) bool {
 	return isStillBanned(t, ok)
 }
 
+func (b *Bans) isUseridShadowbanned(uid Userid) bool {
+	if uid == 0 {
+		return false
+	}
+	b.userlock.RLock()
+	defer b.userlock.RUnlock()
+	t, ok := b.shadow[uid]
+	return isStillBanned(t, ok)
+}
+
 func (b *Bans) isIPBanned(ip string) bool {
 	b.iplock.RLock()
 	defer b.iplock.RUnlock()
@@ -199,15 +235,18 @@ func (b *Bans) loadActive() {
 
 	// purge all the bans
 	b.users = make(map[Userid]time.Time)
+	b.shadow = make(map[Userid]time.Time)
 	b.ips = make(map[string]time.Time)
 	b.userips = make(map[Userid][]string)
 
-	db.getBans(func(uid Userid, ipaddress sql.NullString, endtimestamp mysql.NullTime) {
+	db.getBans(func(uid Userid, ipaddress sql.NullString, endtimestamp mysql.NullTime, bantype string) {
 		if !endtimestamp.Valid {
 			endtimestamp.Time = getFuturetimeUTC()
 		}
 
-		if ipaddress.Valid {
+		if bantype == BANTYPESHADOW {
+			b.shadow[uid] = endtimestamp.Time
+		} else if ipaddress.Valid {
 			b.ips[ipaddress.String] = endtimestamp.Time
 			if _, ok := b.userips[uid]; !ok {
 				b.userips[uid] = make([]string, 0, 1)
@@ -220,8 +259,8 @@ func (b *Bans) loadActive() {
 	})
 }
 
-func (b *Bans) log(uid Userid, targetuid Userid, ban *BanIn, ip string) {
-	db.insertBan(uid, targetuid, ban, ip)
+func (b *Bans) log(uid Userid, targetuid Userid, ban *BanIn, ip string, bantype string) {
+	db.insertBan(uid, targetuid, ban, ip, bantype)
 }
 
 func (b *Bans) logUnban(targetuid Userid) {
@@ -3,6 +3,8 @@ package main
 import (
 	"testing"
 	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
 )
 
 func TestBanTimes(t *testing.T) {
@@ -37,3 +39,36 @@ func TestBanTimes(t *testing.T) {
 		t.Error("bans.clean did not clean the ips")
 	}
 }
+
+func TestShadowban(t *testing.T) {
+	uid := Userid(2)
+	bans.shadow[uid] = time.Now().UTC().Add(time.Hour)
+	if !bans.isUseridShadowbanned(uid) || bans.isUseridBanned(uid) {
+		t.Error("user should be shadowbanned but not banned")
+	}
+
+	bans.shadow[uid] = time.Now().UTC().Add(-time.Hour)
+	bans.clean()
+	if len(bans.shadow) > 0 {
+		t.Error("bans.clean did not clean the shadowbans")
+	}
+}
+
+func TestLoadActiveLegacyBans(t *testing.T) {
+	mock := setupTestDatabase(t)
+
+	// the rows from before the type column have no type, they are bans
+	mock.ExpectQuery("FROM bans").
+		WillReturnRows(sqlmock.NewRows([]string{"targetuserid", "ipaddress", "endtimestamp", "type"}).
+			AddRow(Userid(3), nil, nil, nil).
+			AddRow(Userid(4), nil, nil, BANTYPESHADOW))
+
+	b := &Bans{}
+	b.loadActive()
+	if _, ok := b.users[Userid(3)]; !ok {
+		t.Error("expected the ban without a type to be loaded as a ban")
+	}
+	if _, ok := b.shadow[Userid(4)]; !ok || len(b.users) != 1 {
+		t.Error("expected the shadowban to be loaded as one")
+	}
+}
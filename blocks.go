@@ -0,0 +1,175 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	blocksilent     = true  // pretend the whisper was sent instead of returning an error
+	blockexemptmods = false // moderators can whisper users who blocked them
+)
+
+// the maximum number of users a user can block
+const MAXBLOCKS = 1000
+
+type blockList map[Userid]struct{}
+
+// loadBlocks loads the block list of the user from the database, unless it
+// already has been, the user is shared between all of its connections
+func (u *User) loadBlocks() {
+	u.RLock()
+	loaded := u.blocks != nil
+	u.RUnlock()
+	if loaded {
+		return
+	}
+
+	blocks := make(blockList)
+	db.getBlocks(u.id, func(uid Userid, nick string) {
+		blocks[uid] = struct{}{}
+	})
+
+	u.Lock()
+	if u.blocks == nil {
+		u.blocks = blocks
+	}
+	u.Unlock()
+}
+
+func (u *User) hasBlocked(uid Userid) bool {
+	u.RLock()
+	defer u.RUnlock()
+	_, ok := u.blocks[uid]
+	return ok
+}
+
+// isBlocking checks whether the user blocked the other user, the block list
+// of online users is already loaded, for everybody else ask the database
+func isBlocking(uid Userid, blockeduid Userid) bool {
+	if u := namescache.get(uid); u != nil {
+		u.RLock()
+		loaded := u.blocks != nil
+		u.RUnlock()
+		if loaded {
+			return u.hasBlocked(blockeduid)
+		}
+	}
+
+	return db.isBlocked(uid, blockeduid)
+}
+
+// canWhisper checks if the user of the connection is allowed to whisper the target
+func (c *Connection) canWhisper(targetuid Userid) bool {
+	if blockexemptmods && c.user.isModerator() {
+		return true
+	}
+
+	if !isBlocking(targetuid, c.user.id) {
+		return true
+	}
+
+	D("Whisper from", c.user.nick, "to", targetuid, "rejected, blocked")
+	if blocksilent {
+		c.EmitBlock("PRIVMSGSENT", "")
+	} else {
+		c.SendError("privmsgfailed")
+	}
+	return false
+}
+
+func init() {
+	registerCommand(&command{
+		name:       "BLOCK",
+		help:       "blocks the whispers and mentions of a user",
+		permission: PERMUSER,
+		payload:    newEventDataIn,
+		limit:      querylimit,
+		handler: func(c *Connection, p interface{}) {
+			c.OnBlock(p.(*EventDataIn))
+		},
+	})
+	registerCommand(&command{
+		name:       "UNBLOCK",
+		help:       "unblocks a user",
+		permission: PERMUSER,
+		payload:    newEventDataIn,
+		limit:      querylimit,
+		handler: func(c *Connection, p interface{}) {
+			c.OnUnblock(p.(*EventDataIn))
+		},
+	})
+	registerCommand(&command{
+		name:       "BLOCKLIST",
+		help:       "lists the blocked users",
+		permission: PERMUSER,
+		limit:      querylimit,
+		handler: func(c *Connection, _ interface{}) {
+			c.OnBlocklist()
+		},
+	})
+}
+
+// OnBlock expects Data to be the nick
+func (c *Connection) OnBlock(m *EventDataIn) {
+	uid, _ := usertools.getUseridForNick(strings.TrimSpace(m.Data))
+	if uid == 0 || uid == c.user.id {
+		c.SendError("notfound")
+		return
+	}
+
+	c.user.loadBlocks()
+	c.user.Lock()
+	if len(c.user.blocks) >= MAXBLOCKS {
+		c.user.Unlock()
+		c.SendError("toomanyblocks")
+		return
+	}
+	_, exists := c.user.blocks[uid]
+	c.user.blocks[uid] = struct{}{}
+	c.user.Unlock()
+
+	if !exists {
+		db.insertBlock(c.user.id, uid, time.Now().UTC())
+	}
+
+	c.sendBlockList()
+}
+
+// OnUnblock expects Data to be the nick
+func (c *Connection) OnUnblock(m *EventDataIn) {
+	uid, _ := usertools.getUseridForNick(strings.TrimSpace(m.Data))
+	if uid == 0 {
+		c.SendError("notfound")
+		return
+	}
+
+	c.user.loadBlocks()
+	c.user.Lock()
+	_, exists := c.user.blocks[uid]
+	delete(c.user.blocks, uid)
+	c.user.Unlock()
+
+	if !exists {
+		c.SendError("notfound")
+		return
+	}
+
+	db.deleteBlock(c.user.id, uid)
+	c.sendBlockList()
+}
+
+func (c *Connection) OnBlocklist() {
+	c.sendBlockList()
+}
+
+func (c *Connection) sendBlockList() {
+	nicks := make([]string, 0)
+	db.getBlocks(c.user.id, func(uid Userid, nick string) {
+		nicks = append(nicks, nick)
+	})
+	sort.Strings(nicks)
+
+	c.EmitBlock("BLOCKLIST", nicks)
+}
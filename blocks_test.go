@@ -0,0 +1,164 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// setupTestDatabase replaces the database connection with a mock for the
+// duration of the test, every expectation has to be met by the end of it
+func setupTestDatabase(t *testing.T) sqlmock.Sqlmock {
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal("unable to create the database mock", err)
+	}
+
+	old := db.db
+	db.db = conn
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.db = old
+		conn.Close()
+	})
+	return mock
+}
+
+func expectBlocks(mock sqlmock.Sqlmock, uid Userid, blocked map[Userid]string) {
+	rows := sqlmock.NewRows([]string{"targetuserid", "username"})
+	for buid, nick := range blocked {
+		rows.AddRow(buid, nick)
+	}
+	mock.ExpectQuery("FROM chatblocks").WithArgs(uid).WillReturnRows(rows)
+}
+
+func TestBlockUnblock(t *testing.T) {
+	mock := setupTestDatabase(t)
+
+	user := &User{id: Userid(50), nick: "blocker"}
+	usertools.addUser(user, true)
+	usertools.addUser(&User{id: Userid(51), nick: "blockee"}, true)
+	c := newBotConnection(user, "127.0.0.1")
+
+	expectBlocks(mock, user.id, nil)
+	mock.ExpectPrepare("INSERT IGNORE INTO chatblocks").
+		ExpectExec().WithArgs(user.id, Userid(51), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectBlocks(mock, user.id, map[Userid]string{51: "blockee"})
+
+	c.OnBlock(&EventDataIn{Data: " blockee "})
+	if m := <-c.blocksend; m.event != "BLOCKLIST" || strings.Join(m.data.([]string), ",") != "blockee" {
+		t.Error("expected the block list to be sent, got", m.event, m.data)
+	}
+	if !user.hasBlocked(Userid(51)) {
+		t.Error("expected the user to be blocked")
+	}
+
+	// blocking again does not insert it again
+	expectBlocks(mock, user.id, map[Userid]string{51: "blockee"})
+	c.OnBlock(&EventDataIn{Data: "blockee"})
+	<-c.blocksend
+
+	c.OnBlock(&EventDataIn{Data: "blocker"})
+	if m := <-c.blocksend; m.event != "ERR" || m.data.(GenericError).Error() != "notfound" {
+		t.Error("expected blocking yourself to fail, got", m.event, m.data)
+	}
+
+	mock.ExpectPrepare("DELETE FROM chatblocks").
+		ExpectExec().WithArgs(user.id, Userid(51)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectBlocks(mock, user.id, nil)
+
+	c.OnUnblock(&EventDataIn{Data: "blockee"})
+	if m := <-c.blocksend; m.event != "BLOCKLIST" || len(m.data.([]string)) != 0 {
+		t.Error("expected an empty block list, got", m.event, m.data)
+	}
+	if user.hasBlocked(Userid(51)) {
+		t.Error("expected the user to be unblocked")
+	}
+
+	c.OnUnblock(&EventDataIn{Data: "blockee"})
+	if m := <-c.blocksend; m.event != "ERR" || m.data.(GenericError).Error() != "notfound" {
+		t.Error("expected unblocking a user that was not blocked to fail, got", m.event, m.data)
+	}
+}
+
+func TestCanWhisperBlocked(t *testing.T) {
+	sender := &User{id: Userid(52), nick: "whisperer"}
+	sender.setFeatures([]string{"moderator"})
+	c := newBotConnection(sender, "127.0.0.1")
+
+	target := &User{id: Userid(53), nick: "whispertarget", blocks: blockList{sender.id: {}}}
+	target.assembleSimplifiedUser()
+	namescache.attach(target)
+
+	defer func(silent, exempt bool) {
+		blocksilent, blockexemptmods = silent, exempt
+	}(blocksilent, blockexemptmods)
+
+	blocksilent, blockexemptmods = true, false
+	if c.canWhisper(target.id) {
+		t.Error("expected the whisper to be rejected")
+	}
+	if m := <-c.blocksend; m.event != "PRIVMSGSENT" {
+		t.Error("expected the rejection to be silent, got", m.event, m.data)
+	}
+
+	blocksilent = false
+	if c.canWhisper(target.id) {
+		t.Error("expected the whisper to be rejected")
+	}
+	if m := <-c.blocksend; m.event != "ERR" || m.data.(GenericError).Error() != "privmsgfailed" {
+		t.Error("expected a privmsgfailed error, got", m.event, m.data)
+	}
+
+	blockexemptmods = true
+	if !c.canWhisper(target.id) {
+		t.Error("expected moderators to be exempt")
+	}
+}
+
+func TestIsBlockingOffline(t *testing.T) {
+	mock := setupTestDatabase(t)
+
+	mock.ExpectPrepare("FROM chatblocks").ExpectQuery().
+		WithArgs(Userid(54), Userid(55)).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	if !isBlocking(Userid(54), Userid(55)) {
+		t.Error("expected the block of an offline user to be looked up")
+	}
+}
+
+func TestMentionsSkipBlocked(t *testing.T) {
+	setupTestRedis(t)
+
+	blocking := &User{id: Userid(57), nick: "mentionblocker", blocks: blockList{Userid(56): {}}}
+	blocking.assembleSimplifiedUser()
+	namescache.attach(blocking)
+	other := &User{id: Userid(58), nick: "mentionother", blocks: blockList{}}
+	other.assembleSimplifiedUser()
+	namescache.attach(other)
+
+	defer func() {
+		for len(hub.usermessage) > 0 {
+			<-hub.usermessage
+		}
+	}()
+
+	mentions.deliver(&mention{Userid(56), []Userid{blocking.id, other.id}, []byte(`{"data":"hi"}`)})
+	if m := mentions.get(blocking.id); len(m) != 0 {
+		t.Error("expected no mention from a blocked user, got", m)
+	}
+	if m := mentions.get(other.id); len(m) != 1 {
+		t.Error("expected the mention to be stored, got", m)
+	}
+	if len(hub.usermessage) != 1 {
+		t.Fatal("expected only one mention to be sent, got", len(hub.usermessage))
+	}
+	if um := <-hub.usermessage; um.targetuid != other.id {
+		t.Error("expected the mention to be sent to the user not blocking, got", um.targetuid)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the bot api lets bots run the commands marked as such without holding a
+// websocket open, every request is authenticated with the key of the bot
+// account in the X-Api-Key header, the website stores the session of the bot
+// under CHAT:botkey-<key> the same way it does for regular sessions
+var (
+	botapienabled  = false
+	BOTSESSIONIDLE = 10 * time.Minute // how long the session of an idle bot is kept
+)
+
+type BotReply struct {
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+// botSession is the detached connection of a bot, kept around so that the
+// rate limits of the commands apply across requests, requests of the same
+// bot are handled one at a time
+type botSession struct {
+	c        *Connection
+	lastused time.Time // guarded by the lock of the BotApi
+	sync.Mutex
+}
+
+type BotApi struct {
+	sessions map[Userid]*botSession
+	sync.Mutex
+}
+
+var botapi = BotApi{
+	sessions: make(map[Userid]*botSession),
+}
+
+func initBotApi() {
+	if !botapienabled {
+		return
+	}
+
+	http.HandleFunc("/bot/", handleBotCommand)
+	go botapi.run()
+}
+
+func (ba *BotApi) run() {
+	t := time.NewTicker(time.Minute)
+	for {
+		select {
+		case <-t.C:
+			ba.clean(time.Now())
+		}
+	}
+}
+
+// clean forgets the sessions of the bots idle for longer than BOTSESSIONIDLE
+func (ba *BotApi) clean(now time.Time) {
+	ba.Lock()
+	defer ba.Unlock()
+
+	for uid, s := range ba.sessions {
+		if now.Sub(s.lastused) > BOTSESSIONIDLE {
+			delete(ba.sessions, uid)
+		}
+	}
+}
+
+func newBotConnection(user *User, ip string) *Connection {
+	return &Connection{
+		ip:             ip,
+		send:           make(chan *message, SENDCHANNELSIZE),
+		sendmarshalled: make(chan *message, SENDCHANNELSIZE),
+		blocksend:      make(chan *message, SENDCHANNELSIZE),
+		banned:         make(chan bool, 8),
+		stop:           make(chan bool, 1),
+		user:           user,
+		cmdthrottle:    make(map[string]*tokenBucket),
+	}
+}
+
+func (ba *BotApi) getSession(user *User, ip string) *botSession {
+	ba.Lock()
+	defer ba.Unlock()
+
+	s, ok := ba.sessions[user.id]
+	if !ok {
+		s = &botSession{c: newBotConnection(user, ip)}
+		ba.sessions[user.id] = s
+	}
+	s.lastused = time.Now()
+	return s
+}
+
+func getUserFromBotKey(key string) *User {
+	if !cookievalid.MatchString(key) {
+		return nil
+	}
+
+	authdata, err := redisGetBytes(fmt.Sprintf("CHAT:botkey-%v", key))
+	if err != nil || len(authdata) == 0 {
+		return nil
+	}
+
+	user := userfromSession(authdata)
+	if user == nil || !user.hasPermission(PERMBOT) {
+		return nil
+	}
+	return namescache.attach(user)
+}
+
+// run dispatches the command and collects everything the handler sent back
+// to the connection
+func (s *botSession) run(user *User, name string, data []byte) []*message {
+	s.Lock()
+	defer s.Unlock()
+
+	s.c.user = user
+	s.c.dispatch(name, data)
+
+	replies := make([]*message, 0)
+	for {
+		select {
+		case m := <-s.c.blocksend:
+			replies = append(replies, m)
+		case m := <-s.c.send:
+			replies = append(replies, m)
+		case m := <-s.c.sendmarshalled:
+			replies = append(replies, m)
+		default:
+			return replies
+		}
+	}
+}
+
+func getBotErrorStatus(description string) int {
+	switch description {
+	case "nopermission", "needlogin", "banned",
+		MODLIMITDURATION, MODLIMITPERMANENT, MODLIMITIPBAN, MODLIMITTARGET:
+		return http.StatusForbidden
+	case "notfound":
+		return http.StatusNotFound
+	case "throttled", MODLIMITRATE:
+		return http.StatusTooManyRequests
+	}
+	return http.StatusBadRequest
+}
+
+// handleBotCommand handles POST /bot/<COMMAND>, the body is the same json
+// the command takes over the websocket, errors are returned with the same
+// payload as the ERR event
+func handleBotCommand(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeApiError(w, http.StatusMethodNotAllowed, "protocolerror")
+		return
+	}
+
+	user := getUserFromBotKey(r.Header.Get("X-Api-Key"))
+	if user == nil {
+		writeApiError(w, http.StatusForbidden, "nopermission")
+		return
+	}
+	if bans.isUseridBanned(user.id) {
+		writeApiError(w, http.StatusForbidden, "banned")
+		return
+	}
+
+	name := strings.ToUpper(strings.TrimPrefix(r.URL.Path, "/bot/"))
+	cmd, ok := commands[name]
+	if !ok || !cmd.bot {
+		writeApiError(w, http.StatusNotFound, "notfound")
+		return
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MAXMESSAGESIZE))
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, "protocolerror")
+		return
+	}
+
+	s := botapi.getSession(user, getIPFromWebRequest(r))
+	out := make([]BotReply, 0)
+	for _, m := range s.run(user, name, data) {
+		if m.event == "ERR" {
+			status := http.StatusBadRequest
+			if e, ok := m.data.(error); ok {
+				status = getBotErrorStatus(e.Error())
+			}
+			writeApiResponse(w, status, m.data)
+			return
+		}
+
+		reply := BotReply{Event: m.event}
+		if b, ok := m.data.([]byte); ok {
+			reply.Data = json.RawMessage(b)
+		} else if b, err := Marshal(m.data); err == nil {
+			reply.Data = json.RawMessage(b)
+		}
+		out = append(out, reply)
+	}
+
+	writeApiResponse(w, http.StatusOK, out)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBotSessionErrors(t *testing.T) {
+	user := &User{id: Userid(20), nick: "somebot"}
+	user.setFeatures([]string{"bot"})
+	s := &botSession{c: newBotConnection(user, "127.0.0.1")}
+
+	replies := s.run(user, "MSG", []byte("{invalid"))
+	if len(replies) != 1 || replies[0].event != "ERR" || replies[0].data.(error).Error() != "protocolerror" {
+		t.Error("expected a protocolerror for invalid json, got", replies)
+	}
+
+	other := &User{id: Userid(21), nick: "notamod"}
+	replies = s.run(other, "BROADCAST", []byte(`{"data":"hi"}`))
+	if len(replies) != 1 || replies[0].data.(error).Error() != "nopermission" {
+		t.Error("expected nopermission for a non admin, got", replies)
+	}
+	if status := getBotErrorStatus("nopermission"); status != http.StatusForbidden {
+		t.Error("expected nopermission to be a 403, got", status)
+	}
+}
+
+func TestBotApiMsg(t *testing.T) {
+	s := setupTestRedis(t)
+	drainBroadcasts()
+
+	s.Set("CHAT:botkey-validbotkey", `{"username":"apibot","userId":"22","features":["bot"]}`)
+	s.Set("CHAT:botkey-notabotkey", `{"username":"apiuser","userId":"23","features":["subscriber"]}`)
+
+	r := httptest.NewRequest("POST", "/bot/MSG", strings.NewReader(`{"data":"hello from the api"}`))
+	r.Header.Set("X-Api-Key", "notabotkey")
+	w := httptest.NewRecorder()
+	handleBotCommand(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Error("expected a user without the bot permission to be rejected, got", w.Code)
+	}
+
+	r = httptest.NewRequest("POST", "/bot/MSG", strings.NewReader(`{"data":"hello from the api"}`))
+	r.Header.Set("X-Api-Key", "validbotkey")
+	w = httptest.NewRecorder()
+	handleBotCommand(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatal("expected the message to be accepted, got", w.Code, w.Body.String())
+	}
+
+	m := getBroadcast(t)
+	data := string(m.data.([]byte))
+	if m.event != "MSG" || !strings.Contains(data, `"nick":"apibot"`) || !strings.Contains(data, `"data":"hello from the api"`) {
+		t.Errorf("expected the message of the bot to be broadcast, got %s %s", m.event, data)
+	}
+}
+
+func TestBotApiClean(t *testing.T) {
+	ba := &BotApi{sessions: make(map[Userid]*botSession)}
+	user := &User{id: Userid(24), nick: "idlebot"}
+
+	s := ba.getSession(user, "127.0.0.1")
+	if ba.getSession(user, "127.0.0.1") != s {
+		t.Error("expected the session to be reused")
+	}
+
+	ba.clean(time.Now())
+	if len(ba.sessions) != 1 {
+		t.Error("expected the recently used session to be kept")
+	}
+	ba.clean(time.Now().Add(BOTSESSIONIDLE + time.Second))
+	if len(ba.sessions) != 0 {
+		t.Error("expected the idle session to be forgotten")
+	}
+}
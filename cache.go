@@ -12,6 +12,8 @@ var (
 	rdsCircularBuffer string
 	rdsGetIPCache     string
 	rdsSetIPCache     string
+	rdsPurgeChatlog   string
+	rdsMarkRead       string
 )
 
 // how many log lines to buffer for the scrollback
@@ -125,6 +127,41 @@ func initRedis(addr string, db int64, pw string) {
 	if err != nil {
 		F("Set IP Cache script loading error", err)
 	}
+
+	rdsPurgeChatlog, err = conn.DoString("SCRIPT", "LOAD", `
+		local key, nick = KEYS[1], string.lower(ARGV[1])
+
+		local removed = 0
+		for _, line in ipairs(redis.call("LRANGE", key, 0, -1)) do
+			local event, data = string.match(line, "^(%S+) (.*)$")
+			if event == "MSG" then
+				local ok, m = pcall(cjson.decode, data)
+				if ok and type(m) == "table" and type(m.nick) == "string" and string.lower(m.nick) == nick then
+					-- the lines are identical, so removing the first one is the same
+					removed = removed + redis.call("LREM", key, 1, line)
+				end
+			end
+		end
+
+		return removed
+	`)
+	if err != nil {
+		F("Purge chatlog script loading error", err)
+	}
+
+	rdsMarkRead, err = conn.DoString("SCRIPT", "LOAD", `
+		local key, id = KEYS[1], tonumber(ARGV[1])
+
+		-- the marker only ever moves forward
+		local current = tonumber(redis.call("GET", key) or "0")
+		if id > current then
+			redis.call("SET", key, id)
+		end
+		return 1
+	`)
+	if err != nil {
+		F("Mark read script loading error", err)
+	}
 }
 
 func cacheIPForUser(userid Userid, ip string) {
@@ -208,6 +245,24 @@ func redisGetBytes(key string) ([]byte, error) {
 	return value.Bytes(), err
 }
 
+// purgeChatlog removes every message of the user from the scrollback
+func purgeChatlog(nick string) int64 {
+	conn := redisGetConn()
+	defer conn.Return()
+
+	result, err := conn.Do("EVALSHA", rdsPurgeChatlog, 1, "CHAT:chatlog", nick)
+	if err != nil {
+		D("purgeChatlog redis error", err)
+		return 0
+	}
+
+	removed, err := result.IntAt(0)
+	if err != nil {
+		return 0
+	}
+	return int64(removed)
+}
+
 func cacheChatEvent(msg *message) {
 	conn := redisGetConn()
 	defer conn.Return()
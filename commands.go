@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// the rate limit of the commands that only query something, the chat
+// messages themselves are throttled separately by role
+var querylimit = &bucketConfig{5, 0.5}
+
+type command struct {
+	name       string
+	help       string
+	permission string
+	// payload returns what the data of the command is unmarshalled into and
+	// then passed to the handler, if nil the handler gets the raw data
+	payload func() interface{}
+	// limit is the rate limit of the command per connection, nil if none
+	limit *bucketConfig
+	// bot is whether the command can also be used through the bot api
+	bot     bool
+	handler func(c *Connection, payload interface{})
+}
+
+type CommandOut struct {
+	Name string `json:"name"`
+	Help string `json:"help"`
+}
+
+var commands = make(map[string]*command)
+
+// registerCommand makes the command available to the clients, meant to be
+// called from init, panics on invalid or duplicate commands
+func registerCommand(cmd *command) {
+	if _, ok := commands[cmd.name]; ok {
+		panic("duplicate command: " + cmd.name)
+	}
+	if cmd.permission != PERMANYONE && cmd.permission != PERMUSER && !knownpermissions[cmd.permission] {
+		panic("unknown permission for command " + cmd.name + ": " + cmd.permission)
+	}
+	commands[cmd.name] = cmd
+}
+
+func newEventDataIn() interface{} {
+	return &EventDataIn{}
+}
+
+func init() {
+	registerCommand(&command{
+		name:       "HELP",
+		help:       "lists the commands available",
+		permission: PERMANYONE,
+		limit:      querylimit,
+		handler: func(c *Connection, _ interface{}) {
+			c.OnHelp()
+		},
+	})
+}
+
+func getCommandsFor(u *User) []CommandOut {
+	out := make([]CommandOut, 0, len(commands))
+	for _, cmd := range commands {
+		// commands without help are not listed
+		if len(cmd.help) != 0 && hasPermission(u, cmd.permission) {
+			out = append(out, CommandOut{cmd.name, cmd.help})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// dispatch runs the command, unknown commands are ignored
+func (c *Connection) dispatch(name string, data []byte) {
+	cmd, ok := commands[name]
+	if !ok {
+		return
+	}
+
+	var payload interface{} = data
+	if cmd.payload != nil {
+		payload = cmd.payload()
+		if err := Unmarshal(data, payload); err != nil {
+			c.SendError("protocolerror")
+			return
+		}
+	}
+
+	if !hasPermission(c.user, cmd.permission) {
+		if c.user == nil && cmd.permission == PERMUSER {
+			c.SendError("needlogin")
+		} else {
+			c.SendError("nopermission")
+		}
+		return
+	}
+
+	if cmd.limit != nil {
+		// only ever accessed from the read pump, no need for locking
+		tb, ok := c.cmdthrottle[name]
+		if !ok {
+			tb = &tokenBucket{}
+			c.cmdthrottle[name] = tb
+		}
+		if wait := tb.take(cmd.limit, time.Now()); wait > 0 {
+			c.EmitBlock("ERR", NewThrottledError(wait))
+			return
+		}
+	}
+
+	cmd.handler(c, payload)
+}
+
+func (c *Connection) OnHelp() {
+	c.EmitBlock("COMMANDS", getCommandsFor(c.user))
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+)
+
+func hasCommand(cmds []CommandOut, name string) bool {
+	for _, cmd := range cmds {
+		if cmd.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCommandsForRole(t *testing.T) {
+	anon := getCommandsFor(nil)
+	if !hasCommand(anon, "HELP") || hasCommand(anon, "MSG") || hasCommand(anon, "PONG") {
+		t.Error("anonymous users should only see the commands they can use", anon)
+	}
+
+	user := &User{}
+	if cmds := getCommandsFor(user); !hasCommand(cmds, "MSG") || hasCommand(cmds, "MUTE") {
+		t.Error("users should not see moderator commands", cmds)
+	}
+
+	user.setFeatures([]string{"moderator"})
+	if cmds := getCommandsFor(user); !hasCommand(cmds, "MUTE") || hasCommand(cmds, "BROADCAST") {
+		t.Error("moderators should not see admin commands", cmds)
+	}
+
+	user.setFeatures([]string{"admin"})
+	if cmds := getCommandsFor(user); !hasCommand(cmds, "BROADCAST") {
+		t.Error("admins should see every command", cmds)
+	}
+}
@@ -1,8 +1,6 @@
 package main
 
 import (
-	"bytes"
-	"crypto/md5"
 	"regexp"
 	"strings"
 	"sync"
@@ -25,6 +23,12 @@ import (
 // http://www.fileformat.info/info/unicode/char/00a0/index.htm
 var invalidmessage = regexp.MustCompile(`\p{M}{5,}|[\p{Zl}\p{Zp}\x{202f}\x{00a0}]`)
 
+// isValidMessage checks the length and the content of the message
+func isValidMessage(msg string) bool {
+	msglen := utf8.RuneCountInString(msg)
+	return utf8.ValidString(msg) && msglen != 0 && msglen <= 512 && !invalidmessage.MatchString(msg)
+}
+
 type Connection struct {
 	socket         *websocket.Conn
 	ip             string
@@ -35,6 +39,7 @@ type Connection struct {
 	stop           chan bool
 	user           *User
 	ping           chan time.Time
+	cmdthrottle    map[string]*tokenBucket
 	sync.RWMutex
 }
 
@@ -47,6 +52,7 @@ type EventDataIn struct {
 	Data      string `json:"data"`
 	Extradata string `json:"extradata"`
 	Duration  int64  `json:"duration"`
+	Purge     bool   `json:"purge"` // for MUTE, also purge the recent messages
 }
 
 type EventDataOut struct {
@@ -64,6 +70,7 @@ type BanIn struct {
 	Duration    int64  `json:"duration"`
 	Ispermanent bool   `json:"ispermanent"`
 	Reason      string `json:"reason"`
+	Purge       bool   `json:"purge"`
 }
 
 type PingOut struct {
@@ -84,10 +91,18 @@ type PrivmsgIn struct {
 type PrivmsgOut struct {
 	message
 	targetuid Userid
-	Messageid int64  `json:"messageid"`
-	Timestamp int64  `json:"timestamp"`
-	Nick      string `json:"nick,omitempty"`
-	Data      string `json:"data,omitempty"`
+	result    chan privmsgResult // told how the delivery went, if not nil
+	Messageid int64              `json:"messageid"`
+	Timestamp int64              `json:"timestamp"`
+	Nick      string             `json:"nick,omitempty"`
+	Data      string             `json:"data,omitempty"`
+}
+
+// privmsgResult counts the connections of the target a message was queued on
+// and the ones skipped because their queue was full
+type privmsgResult struct {
+	delivered int
+	full      int
 }
 
 // Create a new connection using the specified socket and router.
@@ -102,6 +117,7 @@ func newConnection(s *websocket.Conn, user *User, ip string) {
 		stop:           make(chan bool),
 		user:           user,
 		ping:           make(chan time.Time, 2),
+		cmdthrottle:    make(map[string]*tokenBucket),
 		RWMutex:        sync.RWMutex{},
 	}
 
@@ -147,6 +163,7 @@ func (c *Connection) readPumpText() {
 
 	hub.register <- c
 	c.Names()
+	c.Pinned()
 	c.Join() // broadcast to the chat that a user has connected
 
 	// Check mute status.
@@ -155,6 +172,9 @@ func (c *Connection) readPumpText() {
 		c.EmitBlock("ERR", NewMutedError(muteTimeLeft))
 	}
 
+	c.SendInbox()
+	c.SendMentions()
+
 	for {
 		msgtype, message, err := c.socket.ReadMessage()
 		if err != nil || msgtype == websocket.BinaryMessage {
@@ -168,29 +188,7 @@ func (c *Connection) readPumpText() {
 			return
 		}
 
-		// dispatch
-		switch name {
-		case "MSG":
-			c.OnMsg(data)
-		case "MUTE":
-			c.OnMute(data)
-		case "UNMUTE":
-			c.OnUnmute(data)
-		case "BAN":
-			c.OnBan(data)
-		case "UNBAN":
-			c.OnUnban(data)
-		case "SUBONLY":
-			c.OnSubonly(data)
-		case "PING":
-			c.OnPing(data)
-		case "PONG":
-			c.OnPong(data)
-		case "BROADCAST":
-			c.OnBroadcast(data)
-		case "PRIVMSG":
-			c.OnPrivmsg(data)
-		}
+		c.dispatch(name, data)
 	}
 }
 
@@ -352,26 +350,9 @@ func (c *Connection) Quit() {
 	}
 }
 
-func (c *Connection) OnBroadcast(data []byte) {
-	m := &EventDataIn{}
-	if err := Unmarshal(data, m); err != nil {
-		c.SendError("protocolerror")
-		return
-	}
-
-	if c.user == nil {
-		c.SendError("needlogin")
-		return
-	}
-
-	if !c.user.featureGet(ISADMIN) {
-		c.SendError("nopermission")
-		return
-	}
-
+func (c *Connection) OnBroadcast(m *EventDataIn) {
 	msg := strings.TrimSpace(m.Data)
-	msglen := utf8.RuneCountInString(msg)
-	if !utf8.ValidString(msg) || msglen == 0 || msglen > 512 || invalidmessage.MatchString(msg) {
+	if !isValidMessage(msg) {
 		c.SendError("invalidmsg")
 		return
 	}
@@ -382,121 +363,53 @@ func (c *Connection) OnBroadcast(data []byte) {
 
 }
 
-func (c *Connection) canMsg(msg string, ignoresilence bool) bool {
-
-	msglen := utf8.RuneCountInString(msg)
-	if !utf8.ValidString(msg) || msglen == 0 || msglen > 512 || invalidmessage.MatchString(msg) {
-		c.SendError("invalidmsg")
-		return false
-	}
-
-	if !ignoresilence {
-		muteTimeLeft := mutes.muteTimeLeft(c)
-		if muteTimeLeft > time.Duration(0) {
-			c.EmitBlock("ERR", NewMutedError(muteTimeLeft))
-			return false
-		}
-
-		if !hub.canUserSpeak(c) {
-			c.SendError("submode")
-			return false
-		}
-	}
-
-	if c.user != nil && !c.user.isBot() {
-
-		// very simple heuristics of "punishing" the flooding user
-		// if the user keeps spamming, the delay between messages increases
-		// this delay resets after a fixed amount of time
-		now := time.Now()
-		difference := now.Sub(c.user.lastmessagetime)
-		switch {
-		case difference <= DELAY:
-			c.user.delayscale *= 2
-		case difference > MAXTHROTTLETIME:
-			c.user.delayscale = 1
-		}
-		sendtime := c.user.lastmessagetime.Add(time.Duration(c.user.delayscale) * DELAY)
-		if sendtime.After(now) {
-			c.SendError("throttled")
-			return false
-		}
-		c.user.lastmessagetime = now
-
-	}
-
-	return true
-}
-
-func (c *Connection) OnMsg(data []byte) {
-	m := &EventDataIn{}
-	if err := Unmarshal(data, m); err != nil {
-		c.SendError("protocolerror")
+// OnMsg passes the message through the pipeline, which decides if and in
+// what form it gets broadcast
+func (c *Connection) OnMsg(m *EventDataIn) {
+	pm, ok := msgpipeline.run(c, strings.TrimSpace(m.Data), 0)
+	if !ok {
 		return
 	}
 
-	if c.user == nil {
-		c.SendError("needlogin")
-		return
-	}
-
-	msg := strings.TrimSpace(m.Data)
-	if !c.canMsg(msg, false) {
-		return
-	}
-
-	// strip off /me for anti-spam purposes
-	var bmsg []byte
-	if len(msg) > 4 && msg[:4] == "/me " {
-		bmsg = []byte(strings.TrimSpace(msg[4:]))
-	} else {
-		bmsg = []byte(msg)
-	}
-
-	tsum := md5.Sum(bmsg)
-	sum := tsum[:]
-	if !c.user.isBot() && bytes.Equal(sum, c.user.lastmessage) {
-		c.user.delayscale++
-		c.SendError("duplicate")
-		return
-	}
-	c.user.lastmessage = sum
+	c.sendMsg(pm.msg)
+}
 
+// sendMsg broadcasts the message that made it through the pipeline
+func (c *Connection) sendMsg(msg string) {
 	out := c.getEventDataOut()
 	out.Data = msg
 	c.Broadcast("MSG", out)
+	raids.track(c.user, msg)
+	nukes.track(c.user, msg, time.Now())
+	mentions.track(c, msg, out)
 }
 
-func (c *Connection) OnPrivmsg(data []byte) {
-	p := &PrivmsgIn{}
-	if err := Unmarshal(data, p); err != nil {
-		c.SendError("protocolerror")
+func (c *Connection) OnPrivmsg(p *PrivmsgIn) {
+	uid, _ := usertools.getUseridForNick(p.Nick)
+	if uid == 0 || uid == c.user.id {
+		c.SendError("notfound")
 		return
 	}
 
-	if c.user == nil {
-		c.SendError("needlogin")
+	pm, ok := msgpipeline.run(c, strings.TrimSpace(p.Data), uid)
+	if !ok {
 		return
 	}
 
-	msg := strings.TrimSpace(p.Data)
-	if !c.canMsg(msg, true) {
+	if !c.canWhisper(uid) {
 		return
 	}
 
-	uid, _ := usertools.getUseridForNick(p.Nick)
-	if uid == 0 || uid == c.user.id {
-		c.SendError("notfound")
+	if wait := c.user.dmthrottle.take(privmsgthrottle, time.Now()); wait > 0 {
+		c.EmitBlock("ERR", NewThrottledError(wait))
 		return
 	}
 
-	if err := api.sendPrivmsg(c.user.id, uid, msg); err != nil {
-		D("send error from", c.user.nick, err)
-		c.SendError(err.Error())
-	} else {
-		c.EmitBlock("PRIVMSGSENT", "")
+	if !dms.send(c.user, uid, pm.msg) {
+		c.SendError("privmsgfailed")
+		return
 	}
-
+	c.EmitBlock("PRIVMSGSENT", "")
 }
 
 func (c *Connection) Names() {
@@ -506,50 +419,73 @@ func (c *Connection) Names() {
 	}
 }
 
-func (c *Connection) OnMute(data []byte) {
-	mute := &EventDataIn{} // Data is the nick
-	if err := Unmarshal(data, mute); err != nil {
-		c.SendError("protocolerror")
-		return
-	}
-
-	if c.user == nil || !c.user.isModerator() {
-		c.SendError("nopermission")
-		return
-	}
-
+// OnMute expects Data to be the nick
+func (c *Connection) OnMute(mute *EventDataIn) {
 	ok, uid := c.canModerateUser(mute.Data)
 	if !ok || uid == 0 {
 		c.SendError("nopermission")
 		return
 	}
 
+	// without a duration the mute escalates with the recent offences
+	prior := offences.count(uid, time.Now().UTC())
 	if mute.Duration == 0 {
-		mute.Duration = int64(DEFAULTMUTEDURATION)
+		d := getEscalatedMuteDuration(prior)
+		if limit := getModLimit(c.user).getMaxMute(); d > limit {
+			d = limit
+		}
+		mute.Duration = int64(d)
 	}
 
-	if time.Duration(mute.Duration) > 7*24*time.Hour {
-		c.SendError("protocolerror") // too long mute
+	if mute.Duration < 0 {
+		c.SendError("protocolerror")
+		return
+	}
+	if !c.checkModLimits(&modAction{
+		action:    "MUTE",
+		targetuid: uid,
+		duration:  time.Duration(mute.Duration),
+	}) {
 		return
 	}
 
 	mutes.muteUserid(uid, mute.Duration)
+	offences.record(uid, OFFENCEMUTE)
 	out := c.getEventDataOut()
 	out.Data = mute.Data
 	out.Duration = mute.Duration / int64(time.Second)
 	out.Targetuserid = uid
+	extradata, _ := Marshal(&MuteExtradata{out.Duration, prior})
+	out.Extradata = string(extradata)
 	c.Broadcast("MUTE", out)
+
+	if mute.Purge {
+		c.purgeUser(mute.Data, uid)
+	}
 }
 
-func (c *Connection) OnUnmute(data []byte) {
-	user := &EventDataIn{} // Data is the nick
-	if err := Unmarshal(data, user); err != nil || utf8.RuneCountInString(user.Data) == 0 {
-		c.SendError("protocolerror")
-		return
+// autoMute mutes the user of the connection on behalf of the server itself
+func (c *Connection) autoMute(duration int64) {
+	mutes.muteUserid(c.user.id, duration)
+	c.announceAutoMute(duration)
+}
+
+// announceAutoMute tells everybody about the mute the server made
+func (c *Connection) announceAutoMute(duration int64) {
+	out := &EventDataOut{
+		Timestamp:    unixMilliTime(),
+		Targetuserid: c.user.id,
+		Data:         c.user.nick,
+		Duration:     duration / int64(time.Second),
 	}
+	hub.broadcastEvent("MUTE", out)
+	c.EmitBlock("ERR", NewMutedError(time.Duration(duration)))
+}
 
-	if c.user == nil || !c.user.isModerator() {
-		c.SendError("nopermission")
+// OnUnmute expects Data to be the nick
+func (c *Connection) OnUnmute(user *EventDataIn) {
+	if utf8.RuneCountInString(user.Data) == 0 {
+		c.SendError("protocolerror")
 		return
 	}
 
@@ -569,23 +505,7 @@ func (c *Connection) OnUnmute(data []byte) {
 func (c *Connection) Muted() {
 }
 
-func (c *Connection) OnBan(data []byte) {
-	ban := &BanIn{}
-	if err := Unmarshal(data, ban); err != nil {
-		c.SendError("protocolerror")
-		return
-	}
-
-	if c.user == nil {
-		c.SendError("nopermission")
-		return
-	}
-
-	if !c.user.isModerator() {
-		c.SendError("nopermission")
-		return
-	}
-
+func (c *Connection) OnBan(ban *BanIn) {
 	ok, uid := c.canModerateUser(ban.Nick)
 	if uid == 0 {
 		c.SendError("notfound")
@@ -604,38 +524,42 @@ func (c *Connection) OnBan(data []byte) {
 	if ban.Duration == 0 {
 		ban.Duration = int64(DEFAULTBANDURATION)
 	}
+	if !c.checkBanLimits("BAN", uid, ban) {
+		return
+	}
 
 	bans.banUser(c.user.id, uid, ban)
+	offences.record(uid, OFFENCEBAN)
 
 	out := c.getEventDataOut()
 	out.Data = ban.Nick
 	out.Targetuserid = uid
 	c.Broadcast("BAN", out)
-}
-
-func (c *Connection) OnUnban(data []byte) {
-	user := &EventDataIn{}
-	if err := Unmarshal(data, user); err != nil {
-		c.SendError("protocolerror")
-		return
-	}
 
-	if c.user == nil || !c.user.isModerator() {
-		c.SendError("nopermission")
-		return
+	if ban.Purge {
+		c.purgeUser(ban.Nick, uid)
 	}
+}
 
+// OnUnban expects Data to be the nick
+func (c *Connection) OnUnban(user *EventDataIn) {
 	uid, _ := usertools.getUseridForNick(user.Data)
 	if uid == 0 {
 		c.SendError("notfound")
 		return
 	}
 
+	// lifting only a shadowban is not announced to everybody either
+	shadowonly := bans.isUseridShadowbanned(uid) && !bans.isUseridBanned(uid)
 	bans.unbanUserid(uid)
 	mutes.unmuteUserid(uid)
 	out := c.getEventDataOut()
 	out.Data = user.Data
 	out.Targetuserid = uid
+	if shadowonly {
+		hub.broadcastModerators("UNBAN", out)
+		return
+	}
 	c.Broadcast("UNBAN", out)
 }
 
@@ -643,18 +567,8 @@ func (c *Connection) Banned() {
 	c.banned <- true
 }
 
-func (c *Connection) OnSubonly(data []byte) {
-	m := &EventDataIn{} // Data is on/off
-	if err := Unmarshal(data, m); err != nil {
-		c.SendError("protocolerror")
-		return
-	}
-
-	if c.user == nil || !c.user.isModerator() {
-		c.SendError("nopermission")
-		return
-	}
-
+// OnSubonly expects Data to be on/off
+func (c *Connection) OnSubonly(m *EventDataIn) {
 	switch {
 	case m.Data == "on":
 		hub.toggleSubmode(true)
@@ -685,6 +599,108 @@ func (c *Connection) OnPing(data []byte) {
 func (c *Connection) OnPong(data []byte) {
 }
 
+func init() {
+	registerCommand(&command{
+		name:       "MSG",
+		help:       "sends a message to the chat",
+		permission: PERMUSER,
+		bot:        true,
+		payload:    newEventDataIn,
+		handler: func(c *Connection, p interface{}) {
+			c.OnMsg(p.(*EventDataIn))
+		},
+	})
+	registerCommand(&command{
+		name:       "PRIVMSG",
+		help:       "sends a private message to a user",
+		permission: PERMUSER,
+		bot:        true,
+		payload: func() interface{} {
+			return &PrivmsgIn{}
+		},
+		handler: func(c *Connection, p interface{}) {
+			c.OnPrivmsg(p.(*PrivmsgIn))
+		},
+	})
+	registerCommand(&command{
+		name:       "MUTE",
+		help:       "mutes a user",
+		permission: PERMMUTE,
+		bot:        true,
+		payload:    newEventDataIn,
+		handler: func(c *Connection, p interface{}) {
+			c.OnMute(p.(*EventDataIn))
+		},
+	})
+	registerCommand(&command{
+		name:       "UNMUTE",
+		help:       "unmutes a user",
+		permission: PERMMUTE,
+		bot:        true,
+		payload:    newEventDataIn,
+		handler: func(c *Connection, p interface{}) {
+			c.OnUnmute(p.(*EventDataIn))
+		},
+	})
+	registerCommand(&command{
+		name:       "BAN",
+		help:       "bans a user",
+		permission: PERMBAN,
+		bot:        true,
+		payload: func() interface{} {
+			return &BanIn{}
+		},
+		handler: func(c *Connection, p interface{}) {
+			c.OnBan(p.(*BanIn))
+		},
+	})
+	registerCommand(&command{
+		name:       "UNBAN",
+		help:       "unbans a user",
+		permission: PERMBAN,
+		bot:        true,
+		payload:    newEventDataIn,
+		handler: func(c *Connection, p interface{}) {
+			c.OnUnban(p.(*EventDataIn))
+		},
+	})
+	registerCommand(&command{
+		name:       "SUBONLY",
+		help:       "turns submode on or off",
+		permission: PERMSUBONLY,
+		bot:        true,
+		payload:    newEventDataIn,
+		handler: func(c *Connection, p interface{}) {
+			c.OnSubonly(p.(*EventDataIn))
+		},
+	})
+	registerCommand(&command{
+		name:       "BROADCAST",
+		help:       "broadcasts a message to the chat",
+		permission: PERMBROADCAST,
+		bot:        true,
+		payload:    newEventDataIn,
+		handler: func(c *Connection, p interface{}) {
+			c.OnBroadcast(p.(*EventDataIn))
+		},
+	})
+	registerCommand(&command{
+		name:       "PING",
+		help:       "answers with a PONG",
+		permission: PERMANYONE,
+		handler: func(c *Connection, p interface{}) {
+			c.OnPing(p.([]byte))
+		},
+	})
+	registerCommand(&command{
+		name:       "PONG",
+		permission: PERMANYONE,
+		handler: func(c *Connection, p interface{}) {
+			c.OnPong(p.([]byte))
+		},
+	})
+}
+
 func (c *Connection) SendError(identifier string) {
 	c.EmitBlock("ERR", GenericError{identifier})
 }
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	conf "github.com/msbranco/goconfig"
+)
+
+// limits on the number of concurrent connections and on how many new
+// connections per CONNLIMITRATEWINDOW a single ip or a subnet is allowed, 0
+// means unlimited
+var (
+	CONNLIMITPERIP         = 0
+	CONNLIMITPERSUBNET     = 0
+	CONNLIMITRATEPERIP     = 0
+	CONNLIMITRATEPERSUBNET = 0
+	CONNLIMITRATEWINDOW    = time.Minute
+	ipv4subnetmask         = net.CIDRMask(24, 32)
+	ipv6subnetmask         = net.CIDRMask(48, 128)
+)
+
+var (
+	connlimitRejected = expvar.NewInt("connlimitRejected")
+	connlimitCurrent  = expvar.NewInt("connlimitConnections")
+)
+
+type connRate struct {
+	count int
+	start time.Time
+}
+
+type ConnLimiter struct {
+	ips         map[string]int
+	subnets     map[string]int
+	iprates     map[string]*connRate
+	subnetrates map[string]*connRate
+	exempt      []*net.IPNet
+	sync.Mutex
+}
+
+var connlimiter = ConnLimiter{
+	ips:         make(map[string]int),
+	subnets:     make(map[string]int),
+	iprates:     make(map[string]*connRate),
+	subnetrates: make(map[string]*connRate),
+}
+
+func readConnLimitConfig(c *conf.ConfigFile) {
+	if v, err := c.GetInt64("connlimit", "perip"); err == nil {
+		CONNLIMITPERIP = int(v)
+	}
+	if v, err := c.GetInt64("connlimit", "persubnet"); err == nil {
+		CONNLIMITPERSUBNET = int(v)
+	}
+	if v, err := c.GetInt64("connlimit", "rateperip"); err == nil {
+		CONNLIMITRATEPERIP = int(v)
+	}
+	if v, err := c.GetInt64("connlimit", "ratepersubnet"); err == nil {
+		CONNLIMITRATEPERSUBNET = int(v)
+	}
+	if v, err := c.GetInt64("connlimit", "ratewindow"); err == nil && v > 0 {
+		CONNLIMITRATEWINDOW = time.Duration(v)
+	}
+	if v, err := c.GetInt64("connlimit", "subnetmask4"); err == nil {
+		ipv4subnetmask = net.CIDRMask(int(v), 32)
+	}
+	if v, err := c.GetInt64("connlimit", "subnetmask6"); err == nil {
+		ipv6subnetmask = net.CIDRMask(int(v), 128)
+	}
+
+	exempt, _ := c.GetString("connlimit", "exempt")
+	connlimiter.setExempt(exempt)
+}
+
+func initConnLimiter() {
+	go connlimiter.run()
+}
+
+// setExempt parses the comma separated list of ips or cidr ranges
+func (cl *ConnLimiter) setExempt(exempt string) {
+	cl.Lock()
+	defer cl.Unlock()
+
+	cl.exempt = make([]*net.IPNet, 0)
+	for _, s := range strings.Split(exempt, ",") {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			D("Unable to parse exempt ip", s, err)
+			continue
+		}
+		cl.exempt = append(cl.exempt, n)
+	}
+}
+
+func (cl *ConnLimiter) run() {
+	t := time.NewTicker(CONNLIMITRATEWINDOW)
+	for {
+		select {
+		case <-t.C:
+			cl.clean()
+		}
+	}
+}
+
+func (cl *ConnLimiter) clean() {
+	cl.Lock()
+	defer cl.Unlock()
+
+	for k, r := range cl.iprates {
+		if time.Since(r.start) > CONNLIMITRATEWINDOW {
+			delete(cl.iprates, k)
+		}
+	}
+	for k, r := range cl.subnetrates {
+		if time.Since(r.start) > CONNLIMITRATEWINDOW {
+			delete(cl.subnetrates, k)
+		}
+	}
+}
+
+func getSubnet(s string) string {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return s
+	}
+	if ip.To4() == nil {
+		return ip.Mask(ipv6subnetmask).String()
+	}
+	return ip.Mask(ipv4subnetmask).String()
+}
+
+func (cl *ConnLimiter) isExempt(s string) bool {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return false
+	}
+	for _, n := range cl.exempt {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// rateExceeded reports whether the limit of the key was already reached in
+// the window, expects the lock to be held
+func rateExceeded(rates map[string]*connRate, key string, limit int, now time.Time) bool {
+	if limit <= 0 {
+		return false
+	}
+
+	r, ok := rates[key]
+	return ok && now.Sub(r.start) <= CONNLIMITRATEWINDOW && r.count >= limit
+}
+
+// rateCount counts the connection towards the rate of the key, expects the
+// lock to be held
+func rateCount(rates map[string]*connRate, key string, limit int, now time.Time) {
+	if limit <= 0 {
+		return
+	}
+
+	r, ok := rates[key]
+	if !ok || now.Sub(r.start) > CONNLIMITRATEWINDOW {
+		r = &connRate{0, now}
+		rates[key] = r
+	}
+	r.count++
+}
+
+// acquire returns true if the ip is allowed to connect, in which case release
+// has to be called once the connection is over
+func (cl *ConnLimiter) acquire(ip string) bool {
+	cl.Lock()
+	defer cl.Unlock()
+
+	if cl.isExempt(ip) {
+		return true
+	}
+
+	subnet := getSubnet(ip)
+	now := time.Now()
+	if (CONNLIMITPERIP > 0 && cl.ips[ip] >= CONNLIMITPERIP) ||
+		(CONNLIMITPERSUBNET > 0 && cl.subnets[subnet] >= CONNLIMITPERSUBNET) ||
+		rateExceeded(cl.iprates, ip, CONNLIMITRATEPERIP, now) ||
+		rateExceeded(cl.subnetrates, subnet, CONNLIMITRATEPERSUBNET, now) {
+		connlimitRejected.Add(1)
+		D("Connection limit reached for ip", ip, "subnet", subnet)
+		return false
+	}
+
+	// only counted once every limit was checked, so that rejected attempts
+	// do not use up the budget
+	rateCount(cl.iprates, ip, CONNLIMITRATEPERIP, now)
+	rateCount(cl.subnetrates, subnet, CONNLIMITRATEPERSUBNET, now)
+	cl.ips[ip]++
+	cl.subnets[subnet]++
+	connlimitCurrent.Add(1)
+	return true
+}
+
+// handler rejects the request with 429 if the ip went over the limits,
+// otherwise holds on to the connection slot until the handler returns
+func (cl *ConnLimiter) handler(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := getIPFromWebRequest(r)
+		if !cl.acquire(ip) {
+			http.Error(w, "Too many connections", http.StatusTooManyRequests)
+			return
+		}
+		defer cl.release(ip)
+
+		f(w, r)
+	}
+}
+
+func (cl *ConnLimiter) release(ip string) {
+	cl.Lock()
+	defer cl.Unlock()
+
+	if cl.isExempt(ip) {
+		return
+	}
+
+	subnet := getSubnet(ip)
+	if cl.ips[ip]--; cl.ips[ip] <= 0 {
+		delete(cl.ips, ip)
+	}
+	if cl.subnets[subnet]--; cl.subnets[subnet] <= 0 {
+		delete(cl.subnets, subnet)
+	}
+	connlimitCurrent.Add(-1)
+}
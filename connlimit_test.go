@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConnLimiter(t *testing.T) {
+	CONNLIMITPERIP = 2
+	CONNLIMITPERSUBNET = 3
+	defer func() {
+		CONNLIMITPERIP = 0
+		CONNLIMITPERSUBNET = 0
+	}()
+
+	cl := &ConnLimiter{
+		ips:         make(map[string]int),
+		subnets:     make(map[string]int),
+		iprates:     make(map[string]*connRate),
+		subnetrates: make(map[string]*connRate),
+	}
+	cl.setExempt("10.0.0.1, 192.168.0.0/16")
+
+	if !cl.acquire("1.2.3.4") || !cl.acquire("1.2.3.4") {
+		t.Fatal("the first two connections from the ip should be allowed")
+	}
+	if cl.acquire("1.2.3.4") {
+		t.Error("the third connection from the ip should not be allowed")
+	}
+	if !cl.acquire("1.2.3.5") {
+		t.Error("another ip in the same subnet should be allowed")
+	}
+	if cl.acquire("1.2.3.6") {
+		t.Error("the subnet limit should have been reached")
+	}
+
+	cl.release("1.2.3.4")
+	if !cl.acquire("1.2.3.6") {
+		t.Error("releasing a connection should make room in the subnet")
+	}
+
+	for i := 0; i < 5; i++ {
+		if !cl.acquire("10.0.0.1") || !cl.acquire("192.168.1.1") {
+			t.Fatal("exempt ips should never be limited")
+		}
+	}
+}
+
+func TestConnLimiterRate(t *testing.T) {
+	CONNLIMITRATEPERIP = 2
+	CONNLIMITPERSUBNET = 1
+	defer func() {
+		CONNLIMITRATEPERIP = 0
+		CONNLIMITPERSUBNET = 0
+	}()
+
+	cl := &ConnLimiter{
+		ips:         make(map[string]int),
+		subnets:     make(map[string]int),
+		iprates:     make(map[string]*connRate),
+		subnetrates: make(map[string]*connRate),
+	}
+
+	if !cl.acquire("1.2.3.4") {
+		t.Fatal("the first connection should be allowed")
+	}
+	// rejected by the subnet limit, must not use up the rate of the ip
+	for i := 0; i < 5; i++ {
+		if cl.acquire("1.2.3.4") {
+			t.Fatal("the subnet limit should have been reached")
+		}
+	}
+	cl.release("1.2.3.4")
+
+	if !cl.acquire("1.2.3.4") {
+		t.Error("rejected attempts should not count towards the rate")
+	}
+	cl.release("1.2.3.4")
+	if cl.acquire("1.2.3.4") {
+		t.Error("the rate limit of the ip should have been reached")
+	}
+}
+
+func TestConnLimiterHandler(t *testing.T) {
+	CONNLIMITPERIP = 1
+	defer func() {
+		CONNLIMITPERIP = 0
+	}()
+
+	cl := &ConnLimiter{
+		ips:         make(map[string]int),
+		subnets:     make(map[string]int),
+		iprates:     make(map[string]*connRate),
+		subnetrates: make(map[string]*connRate),
+	}
+
+	inside := make(chan bool)
+	done := make(chan bool)
+	h := cl.handler(func(w http.ResponseWriter, r *http.Request) {
+		inside <- true
+		<-done
+	})
+
+	request := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		r.Header.Set("X-Real-Ip", "1.2.3.4")
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+
+	go request()
+	<-inside
+
+	rejected := connlimitRejected.Value()
+	if w := request(); w.Code != http.StatusTooManyRequests {
+		t.Error("expected the second connection to be rejected with 429, got", w.Code)
+	}
+	if connlimitRejected.Value() != rejected+1 {
+		t.Error("expected the rejection to be counted")
+	}
+
+	done <- true
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"strings"
 	"sync"
 	"time"
 
@@ -9,9 +10,11 @@ import (
 )
 
 type database struct {
-	db        *sql.DB
-	insertban chan *dbInsertBan
-	deleteban chan *dbDeleteBan
+	db            *sql.DB
+	insertban     chan *dbInsertBan
+	deleteban     chan *dbDeleteBan
+	insertchatlog chan *dbChatlogLine
+	audits        *auditQueue
 	sync.Mutex
 }
 
@@ -22,6 +25,7 @@ type dbInsertBan struct {
 	reason    string
 	starttime time.Time
 	endtime   *mysql.NullTime
+	bantype   string
 	retries   uint8
 }
 
@@ -29,9 +33,51 @@ type dbDeleteBan struct {
 	uid Userid
 }
 
+type dbChatlogLine struct {
+	uid       Userid
+	nick      string
+	message   string
+	timestamp time.Time
+}
+
+// dbModAudit is a moderation action refused for going over the limits of the
+// role of the moderator
+type dbModAudit struct {
+	uid       Userid
+	targetuid Userid
+	action    string
+	violation string
+	detail    string
+	timestamp time.Time
+}
+
+// auditQueue holds the audit entries not yet inserted, it grows as needed so
+// that queueing never blocks and no entry is ever dropped
+type auditQueue struct {
+	pending []*dbModAudit
+	wake    chan struct{}
+	sync.Mutex
+}
+
+// how many chatlog lines are inserted at once at most
+const CHATLOGBATCHSIZE = 100
+
+// how long to wait before trying to insert an audit entry again, doubled
+// with every failure up to the max
+var (
+	AUDITRETRYMIN = time.Second
+	AUDITRETRYMAX = time.Minute
+)
+
 var db = &database{
-	insertban: make(chan *dbInsertBan, 10),
-	deleteban: make(chan *dbDeleteBan, 10),
+	insertban:     make(chan *dbInsertBan, 10),
+	deleteban:     make(chan *dbDeleteBan, 10),
+	insertchatlog: make(chan *dbChatlogLine, 10*CHATLOGBATCHSIZE),
+	audits:        newAuditQueue(),
+}
+
+func newAuditQueue() *auditQueue {
+	return &auditQueue{wake: make(chan struct{}, 1)}
 }
 
 func initDatabase(dbtype string, dbdsn string) {
@@ -54,6 +100,8 @@ func initDatabase(dbtype string, dbdsn string) {
 	db.db = conn
 	go db.runInsertBan()
 	go db.runDeleteBan()
+	go db.runInsertChatlog()
+	go db.runInsertAudit()
 }
 
 func (db *database) getStatement(name string, sql string) *sql.Stmt {
@@ -77,7 +125,8 @@ func (db *database) getInsertBanStatement() *sql.Stmt {
 			ipaddress      = ?,
 			reason         = ?,
 			starttimestamp = ?,
-			endtimestamp   = ?
+			endtimestamp   = ?,
+			type           = ?
 	`)
 }
 
@@ -111,7 +160,7 @@ func (db *database) runInsertBan() {
 				continue
 			}
 			db.Lock()
-			_, err := stmt.Exec(data.uid, data.targetuid, data.ipaddress, data.reason, data.starttime, data.endtime)
+			_, err := stmt.Exec(data.uid, data.targetuid, data.ipaddress, data.reason, data.starttime, data.endtime, data.bantype)
 			db.Unlock()
 			if err != nil {
 				data.retries++
@@ -150,7 +199,7 @@ func (db *database) runDeleteBan() {
 	}
 }
 
-func (db *database) insertBan(uid Userid, targetuid Userid, ban *BanIn, ip string) {
+func (db *database) insertBan(uid Userid, targetuid Userid, ban *BanIn, ip string, bantype string) {
 
 	ipaddress := &sql.NullString{}
 	if ban.BanIP && len(ip) != 0 {
@@ -165,14 +214,14 @@ func (db *database) insertBan(uid Userid, targetuid Userid, ban *BanIn, ip strin
 		endtimestamp.Valid = true
 	}
 
-	db.insertban <- &dbInsertBan{uid, targetuid, ipaddress, ban.Reason, starttimestamp, endtimestamp, 0}
+	db.insertban <- &dbInsertBan{uid, targetuid, ipaddress, ban.Reason, starttimestamp, endtimestamp, bantype, 0}
 }
 
 func (db *database) deleteBan(targetuid Userid) {
 	db.deleteban <- &dbDeleteBan{targetuid}
 }
 
-func (db *database) getBans(f func(Userid, sql.NullString, mysql.NullTime)) {
+func (db *database) getBans(f func(Userid, sql.NullString, mysql.NullTime, string)) {
 	db.Lock()
 	defer db.Unlock()
 
@@ -180,12 +229,13 @@ func (db *database) getBans(f func(Userid, sql.NullString, mysql.NullTime)) {
 		SELECT
 			targetuserid,
 			ipaddress,
-			endtimestamp
+			endtimestamp,
+			type
 		FROM bans
 		WHERE
 			endtimestamp IS NULL OR
 			endtimestamp > NOW()
-		GROUP BY targetuserid, ipaddress
+		GROUP BY targetuserid, ipaddress, type
 	`)
 
 	if err != nil {
@@ -198,28 +248,338 @@ func (db *database) getBans(f func(Userid, sql.NullString, mysql.NullTime)) {
 		var uid Userid
 		var ipaddress sql.NullString
 		var endtimestamp mysql.NullTime
-		err = rows.Scan(&uid, &ipaddress, &endtimestamp)
+		var bantype sql.NullString
+		err = rows.Scan(&uid, &ipaddress, &endtimestamp, &bantype)
 
 		if err != nil {
 			D("Unable to scan bans row: ", err)
 			continue
 		}
 
-		f(uid, ipaddress, endtimestamp)
+		f(uid, ipaddress, endtimestamp, getBanType(bantype))
+	}
+}
+
+// getBanType defaults to an ordinary ban for the rows from before the type
+// column, see schema/bans_type.sql
+func getBanType(bantype sql.NullString) string {
+	if !bantype.Valid || len(bantype.String) == 0 {
+		return BANTYPEBAN
 	}
+	return bantype.String
+}
+
+func (db *database) getAutomodRules(f func(int64, string, string, string, sql.NullInt64)) {
+	db.Lock()
+	defer db.Unlock()
+
+	rows, err := db.db.Query(`
+		SELECT
+			id,
+			kind,
+			pattern,
+			action,
+			duration
+		FROM chatautomod
+		ORDER BY id
+	`)
+
+	if err != nil {
+		D("Unable to get automod rules: ", err)
+		return
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var kind, pattern, action string
+		var duration sql.NullInt64
+		err = rows.Scan(&id, &kind, &pattern, &action, &duration)
+
+		if err != nil {
+			D("Unable to scan automod row: ", err)
+			continue
+		}
+
+		f(id, kind, pattern, action, duration)
+	}
+}
+
+// insertAutomodRule expects the duration in nanoseconds, but stores seconds
+func (db *database) insertAutomodRule(kind, pattern, action string, duration int64) (int64, error) {
+	stmt := db.getStatement("insertAutomodRule", `
+		INSERT INTO chatautomod
+		SET
+			kind     = ?,
+			pattern  = ?,
+			action   = ?,
+			duration = ?
+	`)
+	db.Lock()
+	defer stmt.Close()
+	defer db.Unlock()
+
+	d := sql.NullInt64{}
+	if duration > 0 {
+		d.Int64 = duration / int64(time.Second)
+		d.Valid = true
+	}
+
+	res, err := stmt.Exec(kind, pattern, action, d)
+	if err != nil {
+		D("Unable to insert automod rule", err)
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (db *database) deleteAutomodRule(id int64) {
+	stmt := db.getStatement("deleteAutomodRule", `
+		DELETE FROM chatautomod
+		WHERE id = ?
+	`)
+	db.Lock()
+	defer stmt.Close()
+	defer db.Unlock()
+
+	if _, err := stmt.Exec(id); err != nil {
+		D("Unable to delete automod rule", id, err)
+	}
+}
+
+func (db *database) insertPrivmsg(uid Userid, targetuid Userid, message string, timestamp time.Time) (int64, error) {
+	stmt := db.getStatement("insertPrivmsg", `
+		INSERT INTO chatprivatemessages
+		SET
+			userid       = ?,
+			targetuserid = ?,
+			message      = ?,
+			timestamp    = ?,
+			isread       = 0
+	`)
+	db.Lock()
+	defer stmt.Close()
+	defer db.Unlock()
+
+	res, err := stmt.Exec(uid, targetuid, message, timestamp)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// getUndeliveredPrivmsgs returns the messages neither read nor delivered live
+func (db *database) getUndeliveredPrivmsgs(targetuid Userid, limit int, f func(int64, Userid, string, string, time.Time)) error {
+	db.Lock()
+	defer db.Unlock()
+
+	rows, err := db.db.Query(`
+		SELECT
+			pm.id,
+			pm.userid,
+			u.username,
+			pm.message,
+			pm.timestamp
+		FROM chatprivatemessages AS pm
+		INNER JOIN dfl_users AS u ON u.userId = pm.userid
+		WHERE
+			pm.targetuserid = ? AND
+			pm.isread = 0 AND
+			pm.isdelivered = 0
+		ORDER BY pm.id
+		LIMIT ?
+	`, targetuid, limit)
+
+	if err != nil {
+		D("Unable to get undelivered private messages: ", err)
+		return err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var uid Userid
+		var nick, message string
+		var timestamp time.Time
+		err = rows.Scan(&id, &uid, &nick, &message, &timestamp)
+
+		if err != nil {
+			D("Unable to scan private message row: ", err)
+			continue
+		}
+
+		f(id, uid, nick, message, timestamp)
+	}
+	return nil
+}
+
+func (db *database) markPrivmsgsRead(targetuid Userid, id int64) error {
+	stmt := db.getStatement("markPrivmsgsRead", `
+		UPDATE chatprivatemessages
+		SET isread = 1
+		WHERE
+			targetuserid = ? AND
+			id <= ? AND
+			isread = 0
+	`)
+	db.Lock()
+	defer stmt.Close()
+	defer db.Unlock()
+
+	_, err := stmt.Exec(targetuid, id)
+	return err
+}
+
+// markPrivmsgDelivered expects the isdelivered column, see
+// schema/privmsg_delivered.sql
+func (db *database) markPrivmsgDelivered(id int64) error {
+	stmt := db.getStatement("markPrivmsgDelivered", `
+		UPDATE chatprivatemessages
+		SET isdelivered = 1
+		WHERE id = ?
+	`)
+	db.Lock()
+	defer stmt.Close()
+	defer db.Unlock()
+
+	_, err := stmt.Exec(id)
+	return err
+}
+
+func (db *database) getBlocks(uid Userid, f func(Userid, string)) {
+	db.Lock()
+	defer db.Unlock()
+
+	rows, err := db.db.Query(`
+		SELECT
+			b.targetuserid,
+			u.username
+		FROM chatblocks AS b
+		INNER JOIN dfl_users AS u ON u.userId = b.targetuserid
+		WHERE b.userid = ?
+	`, uid)
+
+	if err != nil {
+		D("Unable to get blocks: ", err)
+		return
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var targetuid Userid
+		var nick string
+		err = rows.Scan(&targetuid, &nick)
+
+		if err != nil {
+			D("Unable to scan blocks row: ", err)
+			continue
+		}
+
+		f(targetuid, nick)
+	}
+}
+
+func (db *database) isBlocked(uid Userid, targetuid Userid) bool {
+	stmt := db.getStatement("isBlocked", `
+		SELECT COUNT(*)
+		FROM chatblocks
+		WHERE
+			userid       = ? AND
+			targetuserid = ?
+	`)
+	db.Lock()
+	defer stmt.Close()
+	defer db.Unlock()
+
+	var count int
+	err := stmt.QueryRow(uid, targetuid).Scan(&count)
+	if err != nil {
+		D("error looking up block", uid, targetuid, err)
+		return false
+	}
+	return count > 0
+}
+
+func (db *database) insertBlock(uid Userid, targetuid Userid, timestamp time.Time) {
+	stmt := db.getStatement("insertBlock", `
+		INSERT IGNORE INTO chatblocks
+		SET
+			userid       = ?,
+			targetuserid = ?,
+			timestamp    = ?
+	`)
+	db.Lock()
+	defer stmt.Close()
+	defer db.Unlock()
+
+	if _, err := stmt.Exec(uid, targetuid, timestamp); err != nil {
+		D("Unable to insert block", uid, targetuid, err)
+	}
+}
+
+func (db *database) deleteBlock(uid Userid, targetuid Userid) {
+	stmt := db.getStatement("deleteBlock", `
+		DELETE FROM chatblocks
+		WHERE
+			userid       = ? AND
+			targetuserid = ?
+	`)
+	db.Lock()
+	defer stmt.Close()
+	defer db.Unlock()
+
+	if _, err := stmt.Exec(uid, targetuid); err != nil {
+		D("Unable to delete block", uid, targetuid, err)
+	}
+}
+
+func (db *database) getUserCreated(uid Userid) time.Time {
+	stmt := db.getStatement("getUserCreated", `
+		SELECT createdDate
+		FROM dfl_users
+		WHERE userId = ?
+	`)
+	db.Lock()
+	defer stmt.Close()
+	defer db.Unlock()
+
+	var created mysql.NullTime
+	err := stmt.QueryRow(uid).Scan(&created)
+	if err != nil {
+		D("error looking up creation date of", uid, err)
+		return time.Time{}
+	}
+	return created.Time
 }
 
 func (db *database) getUser(nick string) (Userid, bool) {
 
+	// the features making a user protected come from the roles
+	features := getProtectedFeatures()
+	args := make([]interface{}, 0, len(features)+1)
+	placeholders := make([]string, 0, len(features))
+	for _, feature := range features {
+		args = append(args, feature)
+		placeholders = append(placeholders, "?")
+	}
+	if len(placeholders) == 0 {
+		args = append(args, "")
+		placeholders = append(placeholders, "?")
+	}
+	args = append(args, nick)
+
 	stmt := db.getStatement("getUser", `
 		SELECT
 			u.userId,
-			IF(IFNULL(f.featureId, 0) >= 1, 1, 0) AS protected
+			EXISTS(
+				SELECT 1
+				FROM dfl_users_features AS f
+				INNER JOIN dfl_features AS df ON df.featureId = f.featureId
+				WHERE
+					f.userId = u.userId AND
+					df.featureName IN(`+strings.Join(placeholders, ", ")+`)
+			) AS protected
 		FROM dfl_users AS u
-		LEFT JOIN dfl_users_features AS f ON (
-			f.userId = u.userId AND
-			featureId = (SELECT featureId FROM dfl_features WHERE featureName IN("protected", "admin") LIMIT 1)
-		)
 		WHERE u.username = ?
 	`)
 	db.Lock()
@@ -228,10 +588,291 @@ func (db *database) getUser(nick string) (Userid, bool) {
 
 	var uid int32
 	var protected bool
-	err := stmt.QueryRow(nick).Scan(&uid, &protected)
+	err := stmt.QueryRow(args...).Scan(&uid, &protected)
 	if err != nil {
 		D("error looking up", nick, err)
 		return 0, false
 	}
 	return Userid(uid), protected
 }
+
+// runInsertChatlog inserts the lines in batches, at least once a second
+func (db *database) runInsertChatlog() {
+	t := time.NewTicker(time.Second)
+	batch := make([]*dbChatlogLine, 0, CHATLOGBATCHSIZE)
+	for {
+		select {
+		case <-t.C:
+			if len(batch) != 0 {
+				db.insertChatlogBatch(batch)
+				batch = batch[:0]
+			}
+		case l := <-db.insertchatlog:
+			batch = append(batch, l)
+			if len(batch) == CHATLOGBATCHSIZE {
+				db.insertChatlogBatch(batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+func (db *database) insertChatlogBatch(batch []*dbChatlogLine) {
+	values := make([]string, 0, len(batch))
+	args := make([]interface{}, 0, len(batch)*4)
+	for _, l := range batch {
+		values = append(values, "(?, ?, ?, ?)")
+		args = append(args, l.uid, l.nick, l.message, l.timestamp)
+	}
+
+	db.Lock()
+	defer db.Unlock()
+
+	_, err := db.db.Exec(`
+		INSERT INTO chatlog (userid, nick, message, timestamp)
+		VALUES `+strings.Join(values, ", "), args...)
+	if err != nil {
+		D("Unable to insert chatlog lines", len(batch), err)
+	}
+}
+
+func (db *database) searchChatlog(f *logSearchFilter, offset, limit int, cb func(string, string, time.Time)) error {
+	where := make([]string, 0)
+	args := make([]interface{}, 0)
+	if len(f.nick) != 0 {
+		where = append(where, "nick = ?")
+		args = append(args, f.nick)
+	}
+	if !f.from.IsZero() {
+		where = append(where, "timestamp >= ?")
+		args = append(args, f.from)
+	}
+	if !f.to.IsZero() {
+		where = append(where, "timestamp <= ?")
+		args = append(args, f.to)
+	}
+	if len(f.text) != 0 {
+		where = append(where, "MATCH (message) AGAINST (? IN BOOLEAN MODE)")
+		args = append(args, getFulltextPhrase(f.text))
+	}
+
+	q := `
+		SELECT
+			nick,
+			message,
+			timestamp
+		FROM chatlog`
+	if len(where) != 0 {
+		q += `
+		WHERE ` + strings.Join(where, " AND ")
+	}
+	q += `
+		ORDER BY timestamp DESC, id DESC
+		LIMIT ? OFFSET ?`
+	args = append(args, limit, offset)
+
+	db.Lock()
+	defer db.Unlock()
+
+	rows, err := db.db.Query(q, args...)
+	if err != nil {
+		D("Unable to search chatlog: ", err)
+		return err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var nick, message string
+		var timestamp time.Time
+		if err := rows.Scan(&nick, &message, &timestamp); err != nil {
+			D("Unable to scan chatlog row: ", err)
+			continue
+		}
+
+		cb(nick, message, timestamp)
+	}
+	return rows.Err()
+}
+
+func (db *database) getChatlogUserStats(nicks []string, cb func(string, int64, time.Time, time.Time)) error {
+	if len(nicks) == 0 {
+		return nil
+	}
+
+	placeholders := make([]string, 0, len(nicks))
+	args := make([]interface{}, 0, len(nicks))
+	for _, nick := range nicks {
+		placeholders = append(placeholders, "?")
+		args = append(args, nick)
+	}
+
+	db.Lock()
+	defer db.Unlock()
+
+	rows, err := db.db.Query(`
+		SELECT
+			nick,
+			COUNT(*),
+			MIN(timestamp),
+			MAX(timestamp)
+		FROM chatlog
+		WHERE nick IN (`+strings.Join(placeholders, ", ")+`)
+		GROUP BY nick
+	`, args...)
+	if err != nil {
+		D("Unable to get chatlog user stats: ", err)
+		return err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var nick string
+		var count int64
+		var first, last time.Time
+		if err := rows.Scan(&nick, &count, &first, &last); err != nil {
+			D("Unable to scan chatlog stats row: ", err)
+			continue
+		}
+
+		cb(nick, count, first, last)
+	}
+	return rows.Err()
+}
+
+// getFulltextPhrase quotes the text so that the boolean mode full text search
+// looks for the phrase instead of reading the operators in it
+func getFulltextPhrase(s string) string {
+	return `"` + strings.Replace(s, `"`, " ", -1) + `"`
+}
+
+func (db *database) getActiveBans(targetuid Userid, f func(string, sql.NullString, string, time.Time, mysql.NullTime, sql.NullString)) error {
+	db.Lock()
+	defer db.Unlock()
+
+	rows, err := db.db.Query(`
+		SELECT
+			b.type,
+			b.ipaddress,
+			b.reason,
+			b.starttimestamp,
+			b.endtimestamp,
+			u.username
+		FROM bans AS b
+		LEFT JOIN dfl_users AS u ON u.userId = b.userid
+		WHERE
+			b.targetuserid = ? AND
+			(
+				b.endtimestamp IS NULL OR
+				b.endtimestamp > NOW()
+			)
+		ORDER BY b.id DESC
+	`, targetuid)
+	if err != nil {
+		D("Unable to get the bans of user: ", targetuid, err)
+		return err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var reason string
+		var bantype, ipaddress, nick sql.NullString
+		var starttimestamp time.Time
+		var endtimestamp mysql.NullTime
+		if err := rows.Scan(&bantype, &ipaddress, &reason, &starttimestamp, &endtimestamp, &nick); err != nil {
+			D("Unable to scan bans row: ", err)
+			continue
+		}
+
+		f(getBanType(bantype), ipaddress, reason, starttimestamp, endtimestamp, nick)
+	}
+	return rows.Err()
+}
+
+// insertModAudit queues the audit entry, never blocks
+func (db *database) insertModAudit(a *dbModAudit) {
+	db.audits.Lock()
+	db.audits.pending = append(db.audits.pending, a)
+	db.audits.Unlock()
+
+	select {
+	case db.audits.wake <- struct{}{}:
+	default:
+	}
+}
+
+// runInsertAudit inserts the queued entries in order, an entry that fails is
+// retried with a backoff until it succeeds
+func (db *database) runInsertAudit() {
+	for range db.audits.wake {
+		for {
+			db.audits.Lock()
+			pending := db.audits.pending
+			db.audits.pending = nil
+			db.audits.Unlock()
+			if len(pending) == 0 {
+				break
+			}
+
+			for _, a := range pending {
+				wait := AUDITRETRYMIN
+				for !db.insertAudit(a) {
+					time.Sleep(wait)
+					if wait *= 2; wait > AUDITRETRYMAX {
+						wait = AUDITRETRYMAX
+					}
+				}
+			}
+		}
+	}
+}
+
+// insertAudit expects a table like:
+// modaudit (id PK AUTO_INCREMENT, userid, targetuserid, action, violation, detail, timestamp)
+func (db *database) insertAudit(a *dbModAudit) bool {
+	db.Lock()
+	_, err := db.db.Exec(`
+		INSERT INTO modaudit
+		SET
+			userid       = ?,
+			targetuserid = ?,
+			action       = ?,
+			violation    = ?,
+			detail       = ?,
+			timestamp    = ?
+	`, a.uid, a.targetuid, a.action, a.violation, a.detail, a.timestamp)
+	db.Unlock()
+	if err != nil {
+		D("Unable to insert moderation audit entry", a.uid, a.action, a.violation, err)
+		return false
+	}
+	return true
+}
+
+// getUserFeatures returns the names of the features of the user
+func (db *database) getUserFeatures(uid Userid) []string {
+	db.Lock()
+	defer db.Unlock()
+
+	features := make([]string, 0)
+	rows, err := db.db.Query(`
+		SELECT df.featureName
+		FROM dfl_users_features AS f
+		INNER JOIN dfl_features AS df ON df.featureId = f.featureId
+		WHERE f.userId = ?
+	`, uid)
+	if err != nil {
+		D("Unable to get the features of", uid, err)
+		return features
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var feature string
+		if err := rows.Scan(&feature); err != nil {
+			D("Unable to scan feature row", err)
+			continue
+		}
+		features = append(features, feature)
+	}
+	return features
+}
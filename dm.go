@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	privmsgstorage   = "database"
+	privmsgmirror    = false // also send every message to the site api
+	PRIVMSGINBOXSIZE = 50    // how many unread messages are kept and delivered on connect
+	privmsgthrottle  = &bucketConfig{3, 0.5}
+)
+
+// how long a mirrored message is remembered, so that the copy the site api
+// publishes back on the privmsg channel is not delivered a second time
+const PRIVMSGMIRRORTTL = time.Minute
+
+var privmsgDropped = expvar.NewInt("privmsgDropped")
+
+// dmStore persists direct messages so that they can be delivered to users
+// who were offline when the message was sent
+type dmStore interface {
+	// save stores the message and returns the id it was assigned
+	save(m *dmMessage) (int64, error)
+	// undelivered returns the oldest messages of the user neither read nor
+	// delivered live, at most limit
+	undelivered(uid Userid, limit int) ([]*dmMessage, error)
+	// markDelivered marks the saved message delivered to a connection
+	markDelivered(m *dmMessage) error
+	// markRead marks every message of the user up to and including the id
+	// read, never moves back
+	markRead(uid Userid, id int64) error
+}
+
+type dmMessage struct {
+	Id        int64  `json:"id"`
+	Fromuid   Userid `json:"fromuid"`
+	Fromnick  string `json:"fromnick"`
+	Targetuid Userid `json:"targetuid"`
+	Message   string `json:"message"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type DirectMessages struct {
+	store    dmStore
+	queue    chan *dmMessage
+	mirrored map[string]time.Time
+	sync.Mutex
+}
+
+var dms = DirectMessages{
+	queue:    make(chan *dmMessage, BROADCASTCHANNELSIZE),
+	mirrored: make(map[string]time.Time),
+}
+
+func initDirectMessages() {
+	switch privmsgstorage {
+	case "redis":
+		dms.store = &dmRedisStore{}
+	default:
+		dms.store = &dmDatabaseStore{}
+	}
+
+	go dms.run()
+}
+
+// run persists and delivers the messages in the order they were sent, without
+// holding up the reading goroutine of the sender
+func (dm *DirectMessages) run() {
+	for m := range dm.queue {
+		id, err := dm.store.save(m)
+		if err != nil {
+			D("Unable to save direct message from", m.Fromnick, err)
+		}
+		m.Id = id
+
+		p := m.out()
+		p.result = make(chan privmsgResult, 1)
+		hub.privmsg <- p
+		dm.delivered(m, <-p.result)
+
+		if privmsgmirror {
+			dm.remember(m.Fromnick, m.Targetuid, m.Message, time.Now())
+			go func(m *dmMessage) {
+				if err := api.sendPrivmsg(m.Fromuid, m.Targetuid, m.Message); err != nil {
+					D("Unable to mirror direct message from", m.Fromnick, err)
+				}
+			}(m)
+		}
+	}
+}
+
+// send queues the message, never blocks the reading goroutine of the sender,
+// returns false if the queue is full and the message was dropped
+func (dm *DirectMessages) send(from *User, targetuid Userid, msg string) bool {
+	select {
+	case dm.queue <- &dmMessage{
+		Fromuid:   from.id,
+		Fromnick:  from.nick,
+		Targetuid: targetuid,
+		Message:   msg,
+		Timestamp: unixMilliTime(),
+	}:
+		return true
+	default:
+		privmsgDropped.Add(1)
+		return false
+	}
+}
+
+// delivered marks the message delivered if a connection of the target got it,
+// tells the sender if the connections of the target were all too busy, the
+// message is then delivered on the next connect
+func (dm *DirectMessages) delivered(m *dmMessage, r privmsgResult) {
+	switch {
+	case r.delivered > 0 && m.Id != 0:
+		if err := dm.store.markDelivered(m); err != nil {
+			D("Unable to mark direct message delivered", m.Id, err)
+		}
+	case r.delivered == 0 && r.full > 0:
+		privmsgDropped.Add(1)
+		data, _ := Marshal(GenericError{"privmsgfailed"})
+		hub.sendToUser(m.Fromuid, &message{
+			event: "ERR",
+			data:  data,
+		})
+	}
+}
+
+func getMirrorKey(fromnick string, targetuid Userid, msg string) string {
+	return fmt.Sprintf("%s\x00%d\x00%s", strings.ToLower(fromnick), targetuid, msg)
+}
+
+// remember keeps track of the mirrored message, forgetting the expired ones
+func (dm *DirectMessages) remember(fromnick string, targetuid Userid, msg string, now time.Time) {
+	dm.Lock()
+	defer dm.Unlock()
+
+	for k, t := range dm.mirrored {
+		if now.Sub(t) > PRIVMSGMIRRORTTL {
+			delete(dm.mirrored, k)
+		}
+	}
+	dm.mirrored[getMirrorKey(fromnick, targetuid, msg)] = now
+}
+
+// isMirrorEcho checks if the message published by the site api is one that
+// was mirrored and so already delivered, every mirrored message is only
+// recognized once
+func (dm *DirectMessages) isMirrorEcho(fromnick string, targetuid Userid, msg string, now time.Time) bool {
+	dm.Lock()
+	defer dm.Unlock()
+
+	key := getMirrorKey(fromnick, targetuid, msg)
+	t, ok := dm.mirrored[key]
+	if !ok {
+		return false
+	}
+	delete(dm.mirrored, key)
+	return now.Sub(t) <= PRIVMSGMIRRORTTL
+}
+
+func (m *dmMessage) out() *PrivmsgOut {
+	p := &PrivmsgOut{
+		message: message{
+			event: "PRIVMSG",
+		},
+		targetuid: m.Targetuid,
+		Messageid: m.Id,
+		Timestamp: m.Timestamp,
+		Nick:      m.Fromnick,
+		Data:      m.Message,
+	}
+	p.message.data, _ = Marshal(p)
+	return p
+}
+
+// SendInbox delivers the messages the user received while offline, they keep
+// being delivered on every connect until the client marks them read, the ones
+// delivered live are not sent again
+func (c *Connection) SendInbox() {
+	if c.user == nil {
+		return
+	}
+
+	msgs, err := dms.store.undelivered(c.user.id, PRIVMSGINBOXSIZE)
+	if err != nil {
+		D("Unable to get the inbox of", c.user.nick, err)
+		return
+	}
+
+	for _, m := range msgs {
+		p := m.out()
+		c.sendmarshalled <- &p.message
+	}
+}
+
+func init() {
+	registerCommand(&command{
+		name:       "PRIVMSGREAD",
+		help:       "marks the private messages read up to the given id",
+		permission: PERMUSER,
+		payload:    newEventDataIn,
+		limit:      querylimit,
+		handler: func(c *Connection, p interface{}) {
+			c.OnPrivmsgRead(p.(*EventDataIn))
+		},
+	})
+}
+
+// OnPrivmsgRead expects Data to be the id of the last read message
+func (c *Connection) OnPrivmsgRead(m *EventDataIn) {
+	id, err := strconv.ParseInt(m.Data, 10, 64)
+	if err != nil || id <= 0 {
+		c.SendError("protocolerror")
+		return
+	}
+
+	if err := dms.store.markRead(c.user.id, id); err != nil {
+		D("Unable to mark direct messages read for", c.user.nick, err)
+	}
+}
+
+// ----------
+type dmDatabaseStore struct{}
+
+func (s *dmDatabaseStore) save(m *dmMessage) (int64, error) {
+	return db.insertPrivmsg(m.Fromuid, m.Targetuid, m.Message, time.Unix(0, m.Timestamp*int64(time.Millisecond)).UTC())
+}
+
+func (s *dmDatabaseStore) undelivered(uid Userid, limit int) ([]*dmMessage, error) {
+	msgs := make([]*dmMessage, 0)
+	err := db.getUndeliveredPrivmsgs(uid, limit, func(id int64, fromuid Userid, fromnick, message string, timestamp time.Time) {
+		msgs = append(msgs, &dmMessage{
+			Id:        id,
+			Fromuid:   fromuid,
+			Fromnick:  fromnick,
+			Targetuid: uid,
+			Message:   message,
+			Timestamp: timestamp.UnixNano() / int64(time.Millisecond),
+		})
+	})
+	return msgs, err
+}
+
+func (s *dmDatabaseStore) markDelivered(m *dmMessage) error {
+	return db.markPrivmsgDelivered(m.Id)
+}
+
+func (s *dmDatabaseStore) markRead(uid Userid, id int64) error {
+	return db.markPrivmsgsRead(uid, id)
+}
+
+// ----------
+// the redis store keeps the last PRIVMSGINBOXSIZE undelivered messages of every
+// user in a list and remembers the id of the last read message separately
+type dmRedisStore struct{}
+
+func (s *dmRedisStore) save(m *dmMessage) (int64, error) {
+	conn := redisGetConn()
+	defer conn.Return()
+
+	id, err := conn.DoInt("INCR", "CHAT:privmsgid")
+	if err != nil {
+		return 0, err
+	}
+	m.Id = int64(id)
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return 0, err
+	}
+
+	key := fmt.Sprintf("CHAT:privmsginbox-%d", m.Targetuid)
+	if _, err := conn.Do("RPUSH", key, data); err != nil {
+		return m.Id, err
+	}
+	_, err = conn.DoOK("LTRIM", key, -PRIVMSGINBOXSIZE, -1)
+	return m.Id, err
+}
+
+func (s *dmRedisStore) undelivered(uid Userid, limit int) ([]*dmMessage, error) {
+	conn := redisGetConn()
+	defer conn.Return()
+
+	var lastread int64
+	v, err := conn.DoValue("GET", fmt.Sprintf("CHAT:privmsgread-%d", uid))
+	if err == nil && !v.IsNil() {
+		lastread, _ = v.Int64()
+	}
+
+	items, err := conn.DoStrings("LRANGE", fmt.Sprintf("CHAT:privmsginbox-%d", uid), 0, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]*dmMessage, 0)
+	for _, item := range items {
+		m := &dmMessage{}
+		if err := json.Unmarshal([]byte(item), m); err != nil {
+			D("Unable to unmarshal direct message", item, err)
+			continue
+		}
+		if m.Id <= lastread {
+			continue
+		}
+		msgs = append(msgs, m)
+		if len(msgs) >= limit {
+			break
+		}
+	}
+	return msgs, nil
+}
+
+// markDelivered removes the message from the inbox, it is marshalled the same
+// way as when it was saved
+func (s *dmRedisStore) markDelivered(m *dmMessage) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	conn := redisGetConn()
+	defer conn.Return()
+
+	_, err = conn.Do("LREM", fmt.Sprintf("CHAT:privmsginbox-%d", m.Targetuid), 1, data)
+	return err
+}
+
+func (s *dmRedisStore) markRead(uid Userid, id int64) error {
+	conn := redisGetConn()
+	defer conn.Return()
+
+	_, err := conn.Do("EVALSHA", rdsMarkRead, 1, fmt.Sprintf("CHAT:privmsgread-%d", uid), id)
+	return err
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// setupTestRedis points the redis pool at an in memory redis for the test
+func setupTestRedis(t *testing.T) *miniredis.Miniredis {
+	s := miniredis.RunT(t)
+	initRedis(s.Addr(), 0, "")
+	return s
+}
+
+func saveTestPrivmsgs(t *testing.T, store dmStore, targetuid Userid, msgs ...string) []int64 {
+	ids := make([]int64, 0, len(msgs))
+	for _, msg := range msgs {
+		id, err := store.save(&dmMessage{
+			Fromuid:   Userid(1),
+			Fromnick:  "sender",
+			Targetuid: targetuid,
+			Message:   msg,
+			Timestamp: unixMilliTime(),
+		})
+		if err != nil {
+			t.Fatal("unable to save the message", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestDmRedisStore(t *testing.T) {
+	setupTestRedis(t)
+	store := &dmRedisStore{}
+
+	ids := saveTestPrivmsgs(t, store, Userid(2), "one", "two", "three")
+	saveTestPrivmsgs(t, store, Userid(3), "other")
+	if ids[0] >= ids[1] || ids[1] >= ids[2] {
+		t.Fatal("expected the ids to be increasing, got", ids)
+	}
+
+	msgs, err := store.undelivered(Userid(2), 10)
+	if err != nil || len(msgs) != 3 || msgs[0].Message != "one" || msgs[2].Message != "three" {
+		t.Fatal("expected the three messages in order, got", msgs, err)
+	}
+	if msgs, _ := store.undelivered(Userid(2), 2); len(msgs) != 2 || msgs[1].Message != "two" {
+		t.Error("expected the limit to return the oldest two, got", msgs)
+	}
+
+	if err := store.markRead(Userid(2), ids[1]); err != nil {
+		t.Fatal("unable to mark the messages read", err)
+	}
+	if msgs, _ := store.undelivered(Userid(2), 10); len(msgs) != 1 || msgs[0].Id != ids[2] {
+		t.Error("expected only the message after the read marker, got", msgs)
+	}
+	if msgs, _ := store.undelivered(Userid(3), 10); len(msgs) != 1 || msgs[0].Message != "other" {
+		t.Error("expected the read marker to only apply to its own user, got", msgs)
+	}
+
+	if err := store.markRead(Userid(2), ids[0]); err != nil {
+		t.Fatal("unable to mark the messages read", err)
+	}
+	if msgs, _ := store.undelivered(Userid(2), 10); len(msgs) != 1 || msgs[0].Id != ids[2] {
+		t.Error("expected the read marker to never move back, got", msgs)
+	}
+}
+
+func TestDmRedisStoreDelivered(t *testing.T) {
+	setupTestRedis(t)
+	store := &dmRedisStore{}
+
+	saveTestPrivmsgs(t, store, Userid(2), "one", "two")
+	msgs, _ := store.undelivered(Userid(2), 10)
+	if len(msgs) != 2 {
+		t.Fatal("expected both messages to be undelivered, got", msgs)
+	}
+
+	if err := store.markDelivered(msgs[0]); err != nil {
+		t.Fatal("unable to mark the message delivered", err)
+	}
+	if msgs, _ := store.undelivered(Userid(2), 10); len(msgs) != 1 || msgs[0].Message != "two" {
+		t.Error("expected the delivered message to not be replayed, got", msgs)
+	}
+}
+
+func TestDirectMessageDelivered(t *testing.T) {
+	setupTestRedis(t)
+	dm := &DirectMessages{store: &dmRedisStore{}}
+	defer func() {
+		for len(hub.usermessage) > 0 {
+			<-hub.usermessage
+		}
+	}()
+
+	ids := saveTestPrivmsgs(t, dm.store, Userid(2), "live", "busy")
+	msgs, _ := dm.store.undelivered(Userid(2), 10)
+
+	dm.delivered(msgs[0], privmsgResult{delivered: 1, full: 1})
+	if len(hub.usermessage) != 0 {
+		t.Error("expected no error when one of the connections got the message")
+	}
+
+	dropped := privmsgDropped.Value()
+	dm.delivered(msgs[1], privmsgResult{full: 2})
+	if privmsgDropped.Value() != dropped+1 {
+		t.Error("expected the undelivered message to be counted")
+	}
+	if len(hub.usermessage) != 1 {
+		t.Fatal("expected the sender to be told, got", len(hub.usermessage))
+	}
+	if um := <-hub.usermessage; um.targetuid != Userid(1) || um.message.event != "ERR" ||
+		!strings.Contains(string(um.message.data.([]byte)), "privmsgfailed") {
+		t.Error("expected a privmsgfailed error for the sender, got", um.targetuid, um.message)
+	}
+
+	if msgs, _ := dm.store.undelivered(Userid(2), 10); len(msgs) != 1 || msgs[0].Id != ids[1] {
+		t.Error("expected only the message that was not delivered to be replayed, got", msgs)
+	}
+}
+
+func TestDmRedisStoreInboxSize(t *testing.T) {
+	setupTestRedis(t)
+	store := &dmRedisStore{}
+
+	defer func(size int) { PRIVMSGINBOXSIZE = size }(PRIVMSGINBOXSIZE)
+	PRIVMSGINBOXSIZE = 2
+
+	saveTestPrivmsgs(t, store, Userid(2), "one", "two", "three")
+	if msgs, _ := store.undelivered(Userid(2), 10); len(msgs) != 2 || msgs[0].Message != "two" {
+		t.Error("expected only the last two messages to be kept, got", msgs)
+	}
+}
+
+func TestSendInboxAndRead(t *testing.T) {
+	setupTestRedis(t)
+	defer func(store dmStore) { dms.store = store }(dms.store)
+	dms.store = &dmRedisStore{}
+
+	user := &User{id: Userid(30), nick: "inboxuser"}
+	c := newBotConnection(user, "127.0.0.1")
+	ids := saveTestPrivmsgs(t, dms.store, user.id, "one", "two")
+
+	c.SendInbox()
+	if len(c.sendmarshalled) != 2 {
+		t.Fatal("expected both unread messages to be delivered, got", len(c.sendmarshalled))
+	}
+	m := <-c.sendmarshalled
+	<-c.sendmarshalled
+	if m.event != "PRIVMSG" || !strings.Contains(string(m.data.([]byte)), `"messageid":`+strconv.FormatInt(ids[0], 10)) {
+		t.Errorf("expected the first message as a PRIVMSG, got %s %s", m.event, m.data)
+	}
+
+	c.OnPrivmsgRead(&EventDataIn{Data: strconv.FormatInt(ids[0], 10)})
+	c.SendInbox()
+	if len(c.sendmarshalled) != 1 {
+		t.Fatal("expected only the unread message to be delivered again, got", len(c.sendmarshalled))
+	}
+	<-c.sendmarshalled
+
+	c.OnPrivmsgRead(&EventDataIn{Data: "nope"})
+	if m := <-c.blocksend; m.event != "ERR" || m.data.(GenericError).Error() != "protocolerror" {
+		t.Error("expected a protocolerror for an invalid id, got", m.event, m.data)
+	}
+}
+
+func TestDirectMessageSendDrops(t *testing.T) {
+	dm := &DirectMessages{
+		queue:    make(chan *dmMessage, 1),
+		mirrored: make(map[string]time.Time),
+	}
+	user := &User{id: Userid(1), nick: "sender"}
+
+	dropped := privmsgDropped.Value()
+	if !dm.send(user, Userid(2), "first") {
+		t.Error("expected the first message to be queued")
+	}
+	if dm.send(user, Userid(2), "second") {
+		t.Error("expected the message to be dropped when the queue is full")
+	}
+	if privmsgDropped.Value() != dropped+1 {
+		t.Error("expected the dropped message to be counted")
+	}
+}
+
+func TestMirrorEcho(t *testing.T) {
+	dm := &DirectMessages{mirrored: make(map[string]time.Time)}
+	now := time.Now()
+
+	dm.remember("Sender", Userid(2), "hello", now)
+	if dm.isMirrorEcho("sender", Userid(3), "hello", now) {
+		t.Error("a message to somebody else is not an echo")
+	}
+	if !dm.isMirrorEcho("sender", Userid(2), "hello", now) {
+		t.Error("expected the mirrored message to be recognized")
+	}
+	if dm.isMirrorEcho("sender", Userid(2), "hello", now) {
+		t.Error("expected the echo to only be dropped once")
+	}
+
+	dm.remember("sender", Userid(2), "hello", now)
+	if dm.isMirrorEcho("sender", Userid(2), "hello", now.Add(PRIVMSGMIRRORTTL+time.Second)) {
+		t.Error("expected an expired message to not be recognized")
+	}
+}
+
+func TestPrivmsgThrottle(t *testing.T) {
+	target := &User{id: Userid(41), nick: "dmtarget", blocks: blockList{}}
+	target.assembleSimplifiedUser()
+	usertools.addUser(target, true)
+	namescache.attach(target)
+
+	user := &User{id: Userid(40), nick: "dmsender"}
+	user.assembleSimplifiedUser()
+	c := newBotConnection(user, "127.0.0.1")
+
+	defer func() {
+		for len(dms.queue) > 0 {
+			<-dms.queue
+		}
+	}()
+
+	for i := 0; i < int(privmsgthrottle.burst); i++ {
+		c.OnPrivmsg(&PrivmsgIn{Nick: "dmtarget", Data: "hello " + strconv.Itoa(i)})
+		if m := <-c.blocksend; m.event != "PRIVMSGSENT" {
+			t.Fatal("expected the message to be sent, got", m.event, m.data)
+		}
+	}
+
+	c.OnPrivmsg(&PrivmsgIn{Nick: "dmtarget", Data: "one too many"})
+	if m := <-c.blocksend; m.event != "ERR" || m.data.(ThrottledError).Error() != "throttled" {
+		t.Error("expected the message over the burst to be throttled, got", m.event, m.data)
+	}
+}
@@ -8,6 +8,10 @@ type GenericError struct {
 	Description string `json:"description"`
 }
 
+func (e GenericError) Error() string {
+	return e.Description
+}
+
 type MutedError struct {
 	GenericError
 	MuteTimeLeft int64 `json:"muteTimeLeft"`
@@ -18,4 +22,16 @@ func NewMutedError(duration time.Duration) MutedError {
 		GenericError{"muted"},
 		int64(duration / time.Second),
 	}
+}
+
+type ThrottledError struct {
+	GenericError
+	ThrottleTimeLeft int64 `json:"throttleTimeLeft"` // in milliseconds
+}
+
+func NewThrottledError(duration time.Duration) ThrottledError {
+	return ThrottledError{
+		GenericError{"throttled"},
+		int64(duration / time.Millisecond),
+	}
 }
\ No newline at end of file
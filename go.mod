@@ -3,6 +3,8 @@ module github.com/destinygg/chat
 go 1.14
 
 require (
+	github.com/DATA-DOG/go-sqlmock v1.5.0
+	github.com/alicebob/miniredis/v2 v2.37.0
 	github.com/go-sql-driver/mysql v1.5.0
 	github.com/gorilla/websocket v1.4.2
 	github.com/msbranco/goconfig v0.0.0-20160629072055-3189001257ce
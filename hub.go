@@ -3,22 +3,30 @@ package main
 import (
 	"encoding/json"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/tideland/golib/redis"
 )
 
 type Hub struct {
-	connections map[*Connection]bool
-	broadcast   chan *message
-	privmsg     chan *PrivmsgOut
-	register    chan *Connection
-	unregister  chan *Connection
-	bans        chan Userid
-	ipbans      chan string
-	getips      chan useridips
-	users       map[Userid]*User
-	refreshuser chan Userid
+	connections  map[*Connection]bool
+	broadcast    chan *message
+	privmsg      chan *PrivmsgOut
+	modbroadcast chan *message
+	usermessage  chan *userMessage
+	register     chan *Connection
+	unregister   chan *Connection
+	bans         chan Userid
+	ipbans       chan string
+	getips       chan useridips
+	users        map[Userid]*User
+	refreshuser  chan Userid
+}
+
+type userMessage struct {
+	targetuid Userid
+	message   *message
 }
 
 type useridips struct {
@@ -27,16 +35,18 @@ type useridips struct {
 }
 
 var hub = Hub{
-	connections: make(map[*Connection]bool),
-	broadcast:   make(chan *message, BROADCASTCHANNELSIZE),
-	privmsg:     make(chan *PrivmsgOut, BROADCASTCHANNELSIZE),
-	register:    make(chan *Connection, 256),
-	unregister:  make(chan *Connection),
-	bans:        make(chan Userid, 4),
-	ipbans:      make(chan string, 4),
-	getips:      make(chan useridips),
-	users:       make(map[Userid]*User),
-	refreshuser: make(chan Userid, 4),
+	connections:  make(map[*Connection]bool),
+	broadcast:    make(chan *message, BROADCASTCHANNELSIZE),
+	privmsg:      make(chan *PrivmsgOut, BROADCASTCHANNELSIZE),
+	modbroadcast: make(chan *message, BROADCASTCHANNELSIZE),
+	usermessage:  make(chan *userMessage, BROADCASTCHANNELSIZE),
+	register:     make(chan *Connection, 256),
+	unregister:   make(chan *Connection),
+	bans:         make(chan Userid, 4),
+	ipbans:       make(chan string, 4),
+	getips:       make(chan useridips),
+	users:        make(map[Userid]*User),
+	refreshuser:  make(chan Userid, 4),
 }
 
 func initHub() {
@@ -80,9 +90,15 @@ func (hub *Hub) run() {
 			}
 			d.c <- ips
 		case message := <-hub.broadcast:
-			if message.event != "JOIN" && message.event != "QUIT" {
+			if isScrollbackEvent(message.event) {
 				cacheChatEvent(message)
 			}
+			if message.event == "MSG" {
+				atomic.AddUint64(&chatlines, 1)
+			}
+			webhooks.enqueue(message)
+			archiver.enqueue(message)
+			indexMessage(message)
 
 			for c := range hub.connections {
 				if len(c.sendmarshalled) < SENDCHANNELSIZE {
@@ -90,10 +106,33 @@ func (hub *Hub) run() {
 				}
 			}
 		case p := <-hub.privmsg:
+			r := privmsgResult{}
 			for c, _ := range hub.connections {
 				if c.user != nil && c.user.id == p.targetuid {
 					if len(c.sendmarshalled) < SENDCHANNELSIZE {
 						c.sendmarshalled <- &p.message
+						r.delivered++
+					} else {
+						r.full++
+					}
+				}
+			}
+			if p.result != nil {
+				p.result <- r
+			}
+		case m := <-hub.usermessage:
+			for c := range hub.connections {
+				if c.user != nil && c.user.id == m.targetuid {
+					if len(c.sendmarshalled) < SENDCHANNELSIZE {
+						c.sendmarshalled <- m.message
+					}
+				}
+			}
+		case message := <-hub.modbroadcast:
+			for c := range hub.connections {
+				if c.user != nil && c.user.isModerator() {
+					if len(c.sendmarshalled) < SENDCHANNELSIZE {
+						c.sendmarshalled <- message
 					}
 				}
 			}
@@ -117,6 +156,40 @@ func (hub *Hub) getIPsForUserid(userid Userid) []string {
 	return <-c
 }
 
+// isScrollbackEvent checks if the event is kept in the scrollback, the
+// purged lines are already gone from it and the pin is sent on connect anyway
+func isScrollbackEvent(event string) bool {
+	switch event {
+	case "JOIN", "QUIT", "CONNECTIONCOUNT", "PURGE", "PIN", "UNPIN":
+		return false
+	}
+	return true
+}
+
+// broadcastEvent is the counterpart of Connection.Broadcast for events the
+// server itself originates
+func (hub *Hub) broadcastEvent(event string, data *EventDataOut) {
+	marshalled, _ := Marshal(data)
+	hub.broadcast <- &message{
+		event: event,
+		data:  marshalled,
+	}
+}
+
+// broadcastModerators sends the event only to the connections of moderators
+func (hub *Hub) broadcastModerators(event string, data interface{}) {
+	marshalled, _ := Marshal(data)
+	hub.modbroadcast <- &message{
+		event: event,
+		data:  marshalled,
+	}
+}
+
+// sendToUser sends the already marshalled message to every connection of the user
+func (hub *Hub) sendToUser(uid Userid, m *message) {
+	hub.usermessage <- &userMessage{uid, m}
+}
+
 func (hub *Hub) canUserSpeak(c *Connection) bool {
 	state.RLock()
 	defer state.RUnlock()
@@ -128,6 +201,13 @@ func (hub *Hub) canUserSpeak(c *Connection) bool {
 	return false
 }
 
+func (hub *Hub) isSubmode() bool {
+	state.RLock()
+	defer state.RUnlock()
+
+	return state.submode
+}
+
 func (hub *Hub) toggleSubmode(enabled bool) {
 	state.Lock()
 	defer state.Unlock()
@@ -188,6 +268,11 @@ func setupPrivmsg(redisdb int64) {
 			return
 		}
 
+		// the native copy of a mirrored message was already delivered
+		if privmsgmirror && dms.isMirrorEcho(d.Username, Userid(uid), d.Message, time.Now()) {
+			return
+		}
+
 		p := &PrivmsgOut{
 			message: message{
 				event: "PRIVMSG",
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	conf "github.com/msbranco/goconfig"
+)
+
+// what happens to a message with a link in it, depending on the role of the
+// user posting it
+const (
+	LINKALLOW = "allow"
+	LINKBLOCK = "block" // the message is refused
+	LINKHOLD  = "hold"  // the message is held until a moderator approves it
+)
+
+var (
+	// anonymous users cannot chat at all, so there is no policy for them
+	linkpolicy = map[string]string{
+		"new":    LINKALLOW,
+		"nonsub": LINKALLOW,
+	}
+	LINKNEWACCOUNTAGE = 24 * time.Hour  // accounts younger than this count as new
+	LINKPERMITTIME    = 5 * time.Minute // how long a PERMIT lasts by default
+	// the top level domains a bare domain without a path is recognized by, the
+	// ones that are also common words or file extensions (it, me, to, md, sh)
+	// are left out on purpose
+	LINKTLDS = []string{
+		"com", "net", "org", "gg", "tv", "io", "co", "ly", "gl", "uk", "de", "ru",
+		"eu", "us", "ca", "fr", "cc", "tk", "info", "biz", "xyz", "app", "dev",
+		"top", "link", "live", "site", "online", "club", "stream",
+	}
+)
+
+// linkregex matches anything with a scheme, starting with www., looking like a
+// domain with a path or being a bare domain of one of the LINKTLDS, findLinks
+// is what everything that has to find links in messages goes through
+var linkregex = getLinkRegex(LINKTLDS)
+
+func getLinkRegex(tlds []string) *regexp.Regexp {
+	quoted := make([]string, 0, len(tlds))
+	for _, tld := range tlds {
+		quoted = append(quoted, regexp.QuoteMeta(tld))
+	}
+
+	return regexp.MustCompile(`(?i)\b(?:[a-z][a-z0-9+.-]*://\S+|www\.\S+|` +
+		`[a-z0-9-]+(?:\.[a-z0-9-]+)*\.(?:[a-z]{2,}/\S*|(?:` + strings.Join(quoted, "|") + `)\b(?::[0-9]+)?(?:[/?#]\S*)?))`)
+}
+
+func readLinkConfig(c *conf.ConfigFile) {
+	for role := range linkpolicy {
+		v, err := c.GetString("links", role)
+		if err != nil {
+			continue
+		}
+		switch v = strings.ToLower(strings.TrimSpace(v)); v {
+		case LINKALLOW, LINKBLOCK, LINKHOLD:
+			linkpolicy[role] = v
+		default:
+			F("Invalid link policy for", role, v)
+		}
+	}
+	if v, err := c.GetInt64("links", "newaccountage"); err == nil {
+		LINKNEWACCOUNTAGE = time.Duration(v)
+	}
+	if v, err := c.GetInt64("links", "permittime"); err == nil && v > 0 {
+		LINKPERMITTIME = time.Duration(v)
+	}
+	if v, err := c.GetString("links", "tlds"); err == nil && len(strings.TrimSpace(v)) != 0 {
+		LINKTLDS = splitConfigList(strings.ToLower(v))
+		linkregex = getLinkRegex(LINKTLDS)
+	}
+}
+
+// findLinks returns the links in the message
+func findLinks(msg string) []string {
+	return linkregex.FindAllString(msg, -1)
+}
+
+// LinkHeldOut tells the moderators about a held message, it is reviewed the
+// same way as the ones held by automod
+type LinkHeldOut struct {
+	Nick      string `json:"nick"`
+	Data      string `json:"data"`
+	Heldid    int64  `json:"heldid"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type Links struct {
+	permits map[Userid]time.Time
+	sync.Mutex
+}
+
+var links = Links{
+	permits: make(map[Userid]time.Time),
+}
+
+func init() {
+	registerCommand(&command{
+		name:       "PERMIT",
+		help:       "lets a user post links for a while",
+		permission: PERMMODERATOR,
+		bot:        true,
+		payload:    newEventDataIn,
+		handler: func(c *Connection, p interface{}) {
+			c.OnPermit(p.(*EventDataIn))
+		},
+	})
+}
+
+// getLinkPolicy returns what to do with the links of the user
+func (l *Links) getLinkPolicy(u *User, now time.Time) string {
+	if u == nil {
+		return LINKBLOCK
+	}
+	if u.isProtected() || u.isBot() || l.isPermitted(u.id, now) {
+		return LINKALLOW
+	}
+
+	if LINKNEWACCOUNTAGE > 0 && linkpolicy["new"] != LINKALLOW {
+		created := usertools.getAccountCreated(u.id)
+		if !created.IsZero() && now.Sub(created) < LINKNEWACCOUNTAGE {
+			return linkpolicy["new"]
+		}
+	}
+	if !u.isSubscriber() {
+		return linkpolicy["nonsub"]
+	}
+	return LINKALLOW
+}
+
+func (l *Links) permit(uid Userid, until time.Time) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.permits[uid] = until
+}
+
+func (l *Links) isPermitted(uid Userid, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	until, ok := l.permits[uid]
+	if ok && now.After(until) {
+		delete(l.permits, uid)
+		return false
+	}
+	return ok
+}
+
+// linkStage enforces the link policy, held messages go into the automod queue
+// and are only broadcast once a moderator approves them
+func linkStage(pm *pipelineMessage) bool {
+	if len(findLinks(pm.msg)) == 0 {
+		return true
+	}
+
+	now := time.Now()
+	switch links.getLinkPolicy(pm.c.user, now) {
+	case LINKBLOCK:
+		pm.c.SendError("linkblocked")
+		return false
+	case LINKHOLD:
+		id := automod.hold(pm.c, pm.msg, nil)
+		P("Link held for", pm.c.user.nick, pm.c.user.id, "message:", pm.msg)
+		hub.broadcastModerators("LINKHELD", &LinkHeldOut{
+			Nick:      pm.c.user.nick,
+			Data:      pm.msg,
+			Heldid:    id,
+			Timestamp: unixMilliTime(),
+		})
+		pm.c.SendError("linkheld")
+		return false
+	}
+	return true
+}
+
+func (c *Connection) OnPermit(m *EventDataIn) {
+	uid, _ := usertools.getUseridForNick(m.Data)
+	if uid == 0 {
+		c.SendError("notfound")
+		return
+	}
+
+	duration := LINKPERMITTIME
+	if m.Duration > 0 {
+		duration = time.Duration(m.Duration)
+	}
+	links.permit(uid, time.Now().Add(duration))
+
+	out := c.getEventDataOut()
+	out.Data = m.Data
+	out.Duration = int64(duration / time.Second)
+	hub.broadcastModerators("PERMIT", out)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFindLinks(t *testing.T) {
+	tests := map[string]int{
+		"hello there":                          0,
+		"see https://example.com/a?b=c":        1,
+		"www.example.com and ftp://host/file":  2,
+		"example.com/watch twice example.org/": 2,
+		"end of sentence.Next one":             0,
+		"3.14 is not a link":                   0,
+		"go to example.com now":                1,
+		"EXAMPLE.COM.":                         1,
+		"twitch.tv and sub.domain.gg:8080":     2,
+		"example.com?x=1 and youtu.be/abc":     2,
+		"edit readme.md and main.go":           0,
+		"the end.It was fine, e.g. this":       0,
+		"not.community":                        0,
+	}
+	for msg, expected := range tests {
+		if got := findLinks(msg); len(got) != expected {
+			t.Error("expected", expected, "links in", msg, "got", got)
+		}
+	}
+}
+
+func TestLinkPolicy(t *testing.T) {
+	old := linkpolicy["nonsub"]
+	defer func() { linkpolicy["nonsub"] = old }()
+	linkpolicy["nonsub"] = LINKHOLD
+
+	l := &Links{
+		permits: make(map[Userid]time.Time),
+	}
+	now := time.Now()
+	sub := &User{id: Userid(40), nick: "sub"}
+	sub.setFeatures([]string{"subscriber"})
+	user := &User{id: Userid(41), nick: "user"}
+
+	if p := l.getLinkPolicy(sub, now); p != LINKALLOW {
+		t.Error("expected subscribers to be allowed links, got", p)
+	}
+	if p := l.getLinkPolicy(user, now); p != LINKHOLD {
+		t.Error("expected links of non-subscribers to be held, got", p)
+	}
+
+	l.permit(user.id, now.Add(time.Minute))
+	if p := l.getLinkPolicy(user, now); p != LINKALLOW {
+		t.Error("expected the permit to exempt the user, got", p)
+	}
+	if p := l.getLinkPolicy(user, now.Add(2*time.Minute)); p != LINKHOLD {
+		t.Error("expected the permit to expire, got", p)
+	}
+
+}
+
+func TestLinkRegexTLDs(t *testing.T) {
+	re := getLinkRegex([]string{"md"})
+	if !re.MatchString("see readme.md") || re.MatchString("see example.com") {
+		t.Error("expected only the configured top level domains to be recognized")
+	}
+	if !re.MatchString("see example.com/path") {
+		t.Error("expected domains with a path to be recognized regardless")
+	}
+}
+
+func TestApproveHeldLink(t *testing.T) {
+	setupTestState(t)
+	drainBroadcasts()
+	defer func() {
+		for len(hub.modbroadcast) > 0 {
+			<-hub.modbroadcast
+		}
+	}()
+
+	old := linkpolicy["nonsub"]
+	defer func() { linkpolicy["nonsub"] = old }()
+	linkpolicy["nonsub"] = LINKHOLD
+
+	rule, _ := newAutomodRule(1, AUTOMODPHRASE, "darn", AUTOMODCENSOR, 0)
+	reject, _ := newAutomodRule(2, AUTOMODPHRASE, "forbidden", AUTOMODREJECT, 0)
+	automod.Lock()
+	oldrules := automod.rules
+	automod.rules = []*automodRule{rule, reject}
+	automod.Unlock()
+	defer func() {
+		automod.Lock()
+		automod.rules = oldrules
+		automod.Unlock()
+	}()
+
+	user := &User{id: Userid(45), nick: "linker"}
+	user.assembleSimplifiedUser()
+	c := newBotConnection(user, "127.0.0.1")
+
+	mod := &User{id: Userid(46), nick: "approver"}
+	mod.setFeatures([]string{"moderator"})
+	mod.assembleSimplifiedUser()
+	mc := newBotConnection(mod, "127.0.0.1")
+
+	hold := func(msg string) string {
+		if linkStage(&pipelineMessage{c: c, msg: msg}) {
+			t.Fatal("expected the link to be held")
+		}
+		<-c.blocksend
+		m := <-hub.modbroadcast
+		held := &LinkHeldOut{}
+		json.Unmarshal(m.data.([]byte), held)
+		return strconv.FormatInt(held.Heldid, 10)
+	}
+
+	reviewed := func(approved, sent bool) {
+		m := <-mc.blocksend
+		if out, ok := m.data.(*AutomodReviewOut); m.event != "AUTOMODREVIEW" || !ok ||
+			out.Nick != "approver" || out.Target != "linker" || out.Approved != approved || out.Sent != sent {
+			t.Errorf("expected the review to be acknowledged, got %s %+v", m.event, m.data)
+		}
+		// the approved message can be reported by automod before
+		for m = <-hub.modbroadcast; m.event == "AUTOMOD"; m = <-hub.modbroadcast {
+		}
+		out := &AutomodReviewOut{}
+		json.Unmarshal(m.data.([]byte), out)
+		if m.event != "AUTOMODREVIEW" || out.Approved != approved || out.Sent != sent {
+			t.Errorf("expected the resolution to be broadcast to the moderators, got %s %s", m.event, m.data)
+		}
+	}
+
+	mc.OnAutomodReview(&EventDataIn{Data: hold("darn, see example.com")}, true)
+	reviewed(true, true)
+	m := getBroadcast(t)
+	if data := string(m.data.([]byte)); m.event != "MSG" || !strings.Contains(data, `"data":"****, see example.com"`) || !strings.Contains(data, `"nick":"linker"`) {
+		t.Errorf("expected the approved message to go through automod, got %s %s", m.event, m.data)
+	}
+	nukes.Lock()
+	tracked := len(nukes.recent) > 0 && nukes.recent[len(nukes.recent)-1].uid == user.id
+	nukes.Unlock()
+	if !tracked {
+		t.Error("expected the approved message to be tracked for nukes")
+	}
+
+	mc.OnAutomodReview(&EventDataIn{Data: hold("forbidden example.com")}, true)
+	if len(hub.broadcast) != 0 {
+		t.Error("expected automod to still reject the approved message")
+	}
+	reviewed(true, false)
+
+	mc.OnAutomodReview(&EventDataIn{Data: hold("denied example.com")}, false)
+	if len(hub.broadcast) != 0 {
+		t.Error("expected the denied message to not be broadcast")
+	}
+	reviewed(false, false)
+}
@@ -14,8 +14,12 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
 	"runtime"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -24,14 +28,19 @@ import (
 )
 
 type State struct {
-	mutes   map[Userid]time.Time
-	submode bool
+	mutes    map[Userid]time.Time
+	submode  bool
+	pin      Pin
+	timers   []Timer
+	timerid  int64
+	offences map[Userid][]Offence
 	sync.RWMutex
 }
 
 var (
 	state = &State{
-		mutes: make(map[Userid]time.Time),
+		mutes:    make(map[Userid]time.Time),
+		offences: make(map[Userid][]Offence),
 	}
 )
 
@@ -45,12 +54,12 @@ const (
 	BROADCASTCHANNELSIZE = 256
 	DEFAULTBANDURATION   = time.Hour
 	DEFAULTMUTEDURATION  = 10 * time.Minute
+	MAXMUTEDURATION      = 7 * 24 * time.Hour // no mute is longer, whatever the limits of the role
 )
 
 var (
 	debuggingenabled = false
-	DELAY            = 300 * time.Millisecond
-	MAXTHROTTLETIME  = 5 * time.Minute
+	statefile        = "state.dc"
 )
 
 func main() {
@@ -61,8 +70,6 @@ func main() {
 		nc.AddOption("default", "debug", "false")
 		nc.AddOption("default", "listenaddress", ":9998")
 		nc.AddOption("default", "maxprocesses", "0")
-		nc.AddOption("default", "chatdelay", fmt.Sprintf("%d", 300*time.Millisecond))
-		nc.AddOption("default", "maxthrottletime", fmt.Sprintf("%d", 5*time.Minute))
 		nc.AddOption("default", "allowedoriginhost", "localhost")
 
 		nc.AddSection("redis")
@@ -74,10 +81,122 @@ func main() {
 		nc.AddOption("database", "type", "mysql")
 		nc.AddOption("database", "dsn", "username:password@tcp(localhost:3306)/destinygg?loc=UTC&parseTime=true&timeout=1s&time_zone=\"+00:00\"")
 
+		nc.AddSection("namescache")
+		nc.AddOption("namescache", "evictafter", fmt.Sprintf("%d", 30*time.Minute))
+		nc.AddOption("namescache", "spamstatettl", fmt.Sprintf("%d", 10*time.Minute))
+
+		addThrottleConfigDefaults(nc)
+		addRoleConfigDefaults(nc)
+
+		nc.AddSection("offences")
+		nc.AddOption("offences", "ladder", getMuteLadderConfig())
+		nc.AddOption("offences", "decay", fmt.Sprintf("%d", OFFENCEDECAY))
+
+		nc.AddSection("modlimits")
+		nc.AddOption("modlimits", "moderatormaxmute", fmt.Sprintf("%d", defaultmodlimit.maxmute))
+		nc.AddOption("modlimits", "moderatormaxban", fmt.Sprintf("%d", 30*24*time.Hour))
+		nc.AddOption("modlimits", "moderatorpermanent", "false")
+		nc.AddOption("modlimits", "moderatoripban", "false")
+		nc.AddOption("modlimits", "moderatorperminute", "10")
+		nc.AddOption("modlimits", "moderatortargets", "subscriber, vip")
+		nc.AddOption("modlimits", "adminmaxmute", fmt.Sprintf("%d", MAXMUTEDURATION))
+
+		nc.AddSection("privmsg")
+		nc.AddOption("privmsg", "storage", "database")
+		nc.AddOption("privmsg", "mirror", "false")
+		nc.AddOption("privmsg", "inboxsize", "50")
+		nc.AddOption("privmsg", "burst", "3")
+		nc.AddOption("privmsg", "rate", "0.5")
+		nc.AddOption("privmsg", "blocksilent", "true")
+		nc.AddOption("privmsg", "blockexemptmods", "false")
+
+		nc.AddSection("mentions")
+		nc.AddOption("mentions", "enabled", "true")
+		nc.AddOption("mentions", "size", "50")
+		nc.AddOption("mentions", "ttl", fmt.Sprintf("%d", 7*24*time.Hour))
+
+		nc.AddSection("automod")
+		nc.AddOption("automod", "enabled", "true")
+		nc.AddOption("automod", "privmsg", "false")
+		nc.AddOption("automod", "holdtime", fmt.Sprintf("%d", 10*time.Minute))
+
+		nc.AddSection("spam")
+		nc.AddOption("spam", "enabled", "true")
+		nc.AddOption("spam", "history", "5")
+		nc.AddOption("spam", "historytime", fmt.Sprintf("%d", 5*time.Minute))
+		nc.AddOption("spam", "similarity", "0.8")
+		nc.AddOption("spam", "capsratio", "0.7")
+		nc.AddOption("spam", "repetition", "10")
+		nc.AddOption("spam", "burstlength", "1200")
+		nc.AddOption("spam", "burstwindow", fmt.Sprintf("%d", 10*time.Second))
+		nc.AddOption("spam", "mentions", "4")
+		nc.AddOption("spam", "throttlescore", "1")
+		nc.AddOption("spam", "mutescore", "3")
+		nc.AddOption("spam", "muteduration", fmt.Sprintf("%d", DEFAULTMUTEDURATION))
+
+		nc.AddSection("raid")
+		nc.AddOption("raid", "enabled", "true")
+		nc.AddOption("raid", "window", fmt.Sprintf("%d", 30*time.Second))
+		nc.AddOption("raid", "users", "10")
+		nc.AddOption("raid", "minlength", "20")
+		nc.AddOption("raid", "similarity", "0.7")
+		nc.AddOption("raid", "submode", "false")
+		nc.AddOption("raid", "muteaccountage", "0")
+		nc.AddOption("raid", "muteduration", fmt.Sprintf("%d", DEFAULTMUTEDURATION))
+
+		nc.AddSection("nuke")
+		nc.AddOption("nuke", "window", fmt.Sprintf("%d", NUKEWINDOW))
+		nc.AddOption("nuke", "maxmessages", "2000")
+		nc.AddOption("nuke", "active", fmt.Sprintf("%d", NUKEACTIVE))
+
+		nc.AddSection("links")
+		nc.AddOption("links", "new", LINKALLOW)
+		nc.AddOption("links", "nonsub", LINKALLOW)
+		nc.AddOption("links", "newaccountage", fmt.Sprintf("%d", LINKNEWACCOUNTAGE))
+		nc.AddOption("links", "permittime", fmt.Sprintf("%d", LINKPERMITTIME))
+		nc.AddOption("links", "tlds", strings.Join(LINKTLDS, ", "))
+
+		nc.AddSection("connlimit")
+		nc.AddOption("connlimit", "perip", "0")
+		nc.AddOption("connlimit", "persubnet", "0")
+		nc.AddOption("connlimit", "rateperip", "0")
+		nc.AddOption("connlimit", "ratepersubnet", "0")
+		nc.AddOption("connlimit", "ratewindow", fmt.Sprintf("%d", time.Minute))
+		nc.AddOption("connlimit", "subnetmask4", "24")
+		nc.AddOption("connlimit", "subnetmask6", "48")
+		nc.AddOption("connlimit", "exempt", "127.0.0.1")
+
+		nc.AddSection("webhooks")
+		nc.AddOption("webhooks", "urls", "")
+		nc.AddOption("webhooks", "secret", "")
+		nc.AddOption("webhooks", "events", "BAN,MUTE,UNBAN,SUBONLY,BROADCAST")
+		nc.AddOption("webhooks", "failurelog", webhookfailurelog)
+		nc.AddOption("webhooks", "workers", "2")
+		nc.AddOption("webhooks", "retries", "5")
+		nc.AddOption("webhooks", "timeout", fmt.Sprintf("%d", WEBHOOKTIMEOUT))
+		nc.AddOption("webhooks", "backoff", fmt.Sprintf("%d", WEBHOOKBACKOFF))
+
+		nc.AddSection("archive")
+		nc.AddOption("archive", "enabled", "false")
+		nc.AddOption("archive", "dir", archivedir)
+		nc.AddOption("archive", "compress", "true")
+		nc.AddOption("archive", "skip", "JOIN,QUIT,CONNECTIONCOUNT")
+		nc.AddOption("archive", "retention", "0")
+		nc.AddOption("archive", "index", "false")
+		nc.AddOption("archive", "searchpagesize", "50")
+		nc.AddOption("archive", "searchmaxscan", "10000")
+
 		nc.AddSection("api")
 		nc.AddOption("api", "url", "http://www.destiny.gg/api")
 		nc.AddOption("api", "key", "changeme")
 
+		nc.AddSection("admin")
+		nc.AddOption("admin", "key", "")
+
+		nc.AddSection("botapi")
+		nc.AddOption("botapi", "enabled", "false")
+		nc.AddOption("botapi", "idletimeout", fmt.Sprintf("%d", 10*time.Minute))
+
 		if err := nc.WriteConfigFile("settings.cfg", 0644, "DestinyChatBackend"); err != nil {
 			log.Fatal("Unable to create settings.cfg: ", err)
 		}
@@ -89,13 +208,14 @@ func main() {
 	debuggingenabled, _ = c.GetBool("default", "debug")
 	addr, _ := c.GetString("default", "listenaddress")
 	processes, _ := c.GetInt64("default", "maxprocesses")
-	delay, _ := c.GetInt64("default", "chatdelay")
-	maxthrottletime, _ := c.GetInt64("default", "maxthrottletime")
 	allowedoriginhost, _ := c.GetString("default", "allowedoriginhost")
 	apiurl, _ := c.GetString("api", "url")
 	apikey, _ := c.GetString("api", "key")
-	DELAY = time.Duration(delay)
-	MAXTHROTTLETIME = time.Duration(maxthrottletime)
+	adminapikey, _ := c.GetString("admin", "key")
+	botapienabled, _ = c.GetBool("botapi", "enabled")
+	if v, err := c.GetInt64("botapi", "idletimeout"); err == nil {
+		BOTSESSIONIDLE = time.Duration(v)
+	}
 
 	redisaddr, _ := c.GetString("redis", "address")
 	redisdb, _ := c.GetInt64("redis", "database")
@@ -104,6 +224,57 @@ func main() {
 	dbtype, _ := c.GetString("database", "type")
 	dbdsn, _ := c.GetString("database", "dsn")
 
+	if v, err := c.GetString("privmsg", "storage"); err == nil {
+		privmsgstorage = v
+	}
+	privmsgmirror, _ = c.GetBool("privmsg", "mirror")
+	if v, err := c.GetInt64("privmsg", "inboxsize"); err == nil {
+		PRIVMSGINBOXSIZE = int(v)
+	}
+	if v, err := c.GetFloat("privmsg", "burst"); err == nil {
+		privmsgthrottle.burst = v
+	}
+	if v, err := c.GetFloat("privmsg", "rate"); err == nil {
+		privmsgthrottle.rate = v
+	}
+
+	if v, err := c.GetBool("privmsg", "blocksilent"); err == nil {
+		blocksilent = v
+	}
+	blockexemptmods, _ = c.GetBool("privmsg", "blockexemptmods")
+
+	mentionsenabled, _ = c.GetBool("mentions", "enabled")
+	if v, err := c.GetInt64("mentions", "size"); err == nil {
+		MENTIONSSIZE = int(v)
+	}
+	if v, err := c.GetInt64("mentions", "ttl"); err == nil {
+		MENTIONSTTL = time.Duration(v)
+	}
+
+	automodenabled, _ = c.GetBool("automod", "enabled")
+	automodprivmsg, _ = c.GetBool("automod", "privmsg")
+	if v, err := c.GetInt64("automod", "holdtime"); err == nil {
+		AUTOMODHOLDTIME = time.Duration(v)
+	}
+	if v, err := c.GetInt64("namescache", "evictafter"); err == nil {
+		NAMESEVICTAFTER = time.Duration(v)
+	}
+	if v, err := c.GetInt64("namescache", "spamstatettl"); err == nil {
+		SPAMSTATETTL = time.Duration(v)
+	}
+
+	readRoleConfig(c)
+	readModLimitConfig(c)
+	readOffenceConfig(c)
+	readThrottleConfig(c)
+	readSpamConfig(c)
+	readRaidConfig(c)
+	readConnLimitConfig(c)
+	readWebhookConfig(c)
+	readArchiveConfig(c)
+	readNukeConfig(c)
+	readLinkConfig(c)
+
 	if processes <= 0 {
 		processes = int64(runtime.NumCPU())
 	}
@@ -111,6 +282,7 @@ func main() {
 
 	state.load()
 
+	initConnLimiter()
 	initApi(apiurl, apikey)
 	initRedis(redisaddr, redisdb, redispw)
 
@@ -121,6 +293,27 @@ func main() {
 	initBroadcast(redisdb)
 	initBans(redisdb)
 	initUsers(redisdb)
+	initAutomod(redisdb)
+	initRaidDetector()
+	initDirectMessages()
+	initPin()
+	initTimers()
+	initOffences()
+	initAdminApi(adminapikey)
+	initSearch()
+	initMentions()
+	initWebhooks()
+	initArchiver()
+	initBotApi()
+
+	// the roles and the moderation limits can be changed without a restart
+	go func() {
+		sighup := make(chan os.Signal, 1)
+		signal.Notify(sighup, syscall.SIGHUP)
+		for range sighup {
+			reloadRoleConfig("settings.cfg")
+		}
+	}()
 
 	upgrader := websocket.Upgrader{
 		ReadBufferSize: 1024,
@@ -140,7 +333,7 @@ func main() {
 		},
 	}
 
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/ws", connlimiter.handler(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
 			http.Error(w, "Method not allowed", 405)
 			return
@@ -160,7 +353,7 @@ func main() {
 		}
 
 		newConnection(ws, user, ip)
-	})
+	}))
 
 	fmt.Printf("Using %v threads, and listening on: %v\n", processes, addr)
 	if err := http.ListenAndServe(addr, nil); err != nil {
@@ -189,7 +382,7 @@ func (s *State) load() {
 	s.Lock()
 	defer s.Unlock()
 
-	b, err := ioutil.ReadFile("state.dc")
+	b, err := ioutil.ReadFile(statefile)
 	if err != nil {
 		D("Error while reading from states file", err)
 		return
@@ -204,6 +397,26 @@ func (s *State) load() {
 	if err != nil {
 		D("Error decoding submode from states file", err)
 	}
+	err = dec.Decode(&s.pin)
+	if err != nil {
+		D("Error decoding pin from states file", err)
+	}
+	err = dec.Decode(&s.timers)
+	if err != nil {
+		D("Error decoding timers from states file", err)
+	}
+	for _, t := range s.timers {
+		if t.Id > s.timerid {
+			s.timerid = t.Id
+		}
+	}
+	err = dec.Decode(&s.offences)
+	if err != nil {
+		D("Error decoding offences from states file", err)
+	}
+	if s.offences == nil {
+		s.offences = make(map[Userid][]Offence)
+	}
 }
 
 // expects to be called with locks held
@@ -218,8 +431,20 @@ func (s *State) save() {
 	if err != nil {
 		D("Error encoding submode:", err)
 	}
+	err = enc.Encode(&s.pin)
+	if err != nil {
+		D("Error encoding pin:", err)
+	}
+	err = enc.Encode(&s.timers)
+	if err != nil {
+		D("Error encoding timers:", err)
+	}
+	err = enc.Encode(&s.offences)
+	if err != nil {
+		D("Error encoding offences:", err)
+	}
 
-	err = ioutil.WriteFile("state.dc", mb.Bytes(), 0600)
+	err = ioutil.WriteFile(statefile, mb.Bytes(), 0600)
 	if err != nil {
 		D("Error with writing out state file:", err)
 	}
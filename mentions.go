@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var (
+	mentionsenabled = true
+	MENTIONSSIZE    = 50                 // how many mentions are kept per user
+	MENTIONSTTL     = 7 * 24 * time.Hour // how long the mentions of a user are kept after the last one
+)
+
+type mention struct {
+	fromuid Userid
+	targets []Userid
+	data    []byte
+}
+
+type Mentions struct {
+	queue chan *mention
+}
+
+var mentions = Mentions{
+	queue: make(chan *mention, BROADCASTCHANNELSIZE),
+}
+
+func initMentions() {
+	go mentions.run()
+}
+
+func (m *Mentions) run() {
+	for mt := range m.queue {
+		m.deliver(mt)
+	}
+}
+
+// deliver stores and sends the mention to every target that did not block
+// the sender
+func (m *Mentions) deliver(mt *mention) {
+	for _, uid := range mt.targets {
+		if isBlocking(uid, mt.fromuid) {
+			continue
+		}
+
+		m.store(uid, mt.data)
+		hub.sendToUser(uid, &message{
+			event: "MENTION",
+			data:  mt.data,
+		})
+	}
+}
+
+// getMentionedUserids returns the users mentioned in the message, either with
+// @nick or just the bare nick, only nicks already known are considered
+func getMentionedUserids(msg string, exclude Userid) []Userid {
+	seen := make(map[Userid]struct{})
+	ret := make([]Userid, 0)
+	for _, word := range strings.Fields(msg) {
+		word = strings.TrimFunc(word, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+		})
+		if len(word) == 0 {
+			continue
+		}
+
+		uid := usertools.getUseridForCachedNick(word)
+		if uid == 0 || uid == exclude {
+			continue
+		}
+		if _, ok := seen[uid]; ok {
+			continue
+		}
+		seen[uid] = struct{}{}
+		ret = append(ret, uid)
+	}
+	return ret
+}
+
+// track notifies everybody mentioned in the message, the actual delivery
+// happens asynchronously, expects the message to already be broadcast
+func (m *Mentions) track(c *Connection, msg string, out *EventDataOut) {
+	if !mentionsenabled || c.user == nil {
+		return
+	}
+
+	targets := getMentionedUserids(msg, c.user.id)
+	if len(targets) == 0 {
+		return
+	}
+
+	c.rlockUserIfExists()
+	data, _ := Marshal(out)
+	c.runlockUserIfExists()
+
+	select {
+	case m.queue <- &mention{c.user.id, targets, data}:
+	default:
+		D("Mentions queue is full, dropping mentions from", c.user.nick)
+	}
+}
+
+func (m *Mentions) store(uid Userid, data []byte) {
+	conn := redisGetConn()
+	defer conn.Return()
+
+	key := fmt.Sprintf("CHAT:mentions-%d", uid)
+	if _, err := conn.Do("RPUSH", key, data); err != nil {
+		D("Unable to store mention", err)
+		return
+	}
+	conn.DoOK("LTRIM", key, -MENTIONSSIZE, -1)
+	conn.Do("EXPIRE", key, int64(MENTIONSTTL/time.Second))
+}
+
+func (m *Mentions) get(uid Userid) []json.RawMessage {
+	conn := redisGetConn()
+	defer conn.Return()
+
+	items, err := conn.DoStrings("LRANGE", fmt.Sprintf("CHAT:mentions-%d", uid), 0, -1)
+	if err != nil {
+		D("Unable to get mentions", err)
+	}
+
+	ret := make([]json.RawMessage, 0, len(items))
+	for _, item := range items {
+		ret = append(ret, json.RawMessage(item))
+	}
+	return ret
+}
+
+// unread returns the mentions newer than the read marker of the user
+func (m *Mentions) unread(uid Userid) []json.RawMessage {
+	conn := redisGetConn()
+	var lastread int64
+	v, err := conn.DoValue("GET", fmt.Sprintf("CHAT:mentionsread-%d", uid))
+	if err == nil && !v.IsNil() {
+		lastread, _ = v.Int64()
+	}
+	conn.Return()
+
+	ret := make([]json.RawMessage, 0)
+	for _, item := range m.get(uid) {
+		var out struct {
+			Timestamp int64 `json:"timestamp"`
+		}
+		if err := json.Unmarshal(item, &out); err != nil || out.Timestamp > lastread {
+			ret = append(ret, item)
+		}
+	}
+	return ret
+}
+
+// markRead marks every mention of the user up to and including the timestamp
+// read, the marker never moves back and expires together with the mentions
+func (m *Mentions) markRead(uid Userid, timestamp int64) error {
+	conn := redisGetConn()
+	defer conn.Return()
+
+	key := fmt.Sprintf("CHAT:mentionsread-%d", uid)
+	if _, err := conn.Do("EVALSHA", rdsMarkRead, 1, key, timestamp); err != nil {
+		return err
+	}
+	_, err := conn.Do("EXPIRE", key, int64(MENTIONSTTL/time.Second))
+	return err
+}
+
+func init() {
+	registerCommand(&command{
+		name:       "MENTIONS",
+		help:       "lists the recent mentions",
+		permission: PERMUSER,
+		limit:      querylimit,
+		handler: func(c *Connection, _ interface{}) {
+			c.OnMentions()
+		},
+	})
+	registerCommand(&command{
+		name:       "MENTIONSREAD",
+		help:       "marks the mentions read up to the given timestamp",
+		permission: PERMUSER,
+		payload:    newEventDataIn,
+		limit:      querylimit,
+		handler: func(c *Connection, p interface{}) {
+			c.OnMentionsRead(p.(*EventDataIn))
+		},
+	})
+}
+
+func (c *Connection) OnMentions() {
+	c.EmitBlock("MENTIONS", mentions.get(c.user.id))
+}
+
+func (c *Connection) OnMentionsRead(m *EventDataIn) {
+	timestamp, err := strconv.ParseInt(m.Data, 10, 64)
+	if err != nil || timestamp <= 0 {
+		c.SendError("protocolerror")
+		return
+	}
+
+	if err := mentions.markRead(c.user.id, timestamp); err != nil {
+		D("Unable to mark mentions read for", c.user.nick, err)
+	}
+}
+
+// SendMentions delivers the mentions the user received while offline, they
+// keep being delivered on every connect until the client marks them read
+func (c *Connection) SendMentions() {
+	if !mentionsenabled || c.user == nil {
+		return
+	}
+
+	if m := mentions.unread(c.user.id); len(m) > 0 {
+		c.Emit("MENTIONS", m)
+	}
+}
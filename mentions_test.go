@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestMentionedUserids(t *testing.T) {
+	usertools.addUser(&User{id: Userid(10), nick: "Alice"}, true)
+	usertools.addUser(&User{id: Userid(11), nick: "bob_"}, true)
+
+	uids := getMentionedUserids("@alice, have you seen bob_? alice!!", Userid(12))
+	if len(uids) != 2 || uids[0] != 10 || uids[1] != 11 {
+		t.Error("expected alice and bob_ to be mentioned once each, got", uids)
+	}
+
+	uids = getMentionedUserids("I am alice", Userid(10))
+	if len(uids) != 0 {
+		t.Error("mentioning yourself should not count, got", uids)
+	}
+}
+
+func TestSendMentions(t *testing.T) {
+	setupTestRedis(t)
+
+	user := &User{id: Userid(13), nick: "mentioned"}
+	c := newBotConnection(user, "127.0.0.1")
+
+	c.SendMentions()
+	if len(c.send) != 0 {
+		t.Error("expected nothing to be sent without mentions")
+	}
+
+	mentions.store(user.id, []byte(`{"timestamp":1000,"data":"hi mentioned"}`))
+	c.SendMentions()
+	if len(c.send) != 1 {
+		t.Fatal("expected the mentions to be sent")
+	}
+	if m := <-c.send; m.event != "MENTIONS" || len(m.data.([]json.RawMessage)) != 1 {
+		t.Error("expected the stored mention, got", m.event, m.data)
+	}
+
+	defer func(enabled bool) { mentionsenabled = enabled }(mentionsenabled)
+	mentions.store(user.id, []byte(`{"timestamp":2000,"data":"later"}`))
+	c.OnMentionsRead(&EventDataIn{Data: "1000"})
+	c.SendMentions()
+	if m := <-c.send; len(m.data.([]json.RawMessage)) != 1 || !strings.Contains(string(m.data.([]json.RawMessage)[0]), "later") {
+		t.Error("expected only the mention after the read marker, got", m.data)
+	}
+
+	c.OnMentionsRead(&EventDataIn{Data: "2000"})
+	c.OnMentionsRead(&EventDataIn{Data: "500"})
+	c.SendMentions()
+	if len(c.send) != 0 {
+		t.Error("expected nothing to be sent once everything is read")
+	}
+	if c.OnMentions(); len((<-c.blocksend).data.([]json.RawMessage)) != 2 {
+		t.Error("expected MENTIONS to still list the read mentions")
+	}
+
+	c.OnMentionsRead(&EventDataIn{Data: "nope"})
+	if m := <-c.blocksend; m.event != "ERR" || m.data.(GenericError).Error() != "protocolerror" {
+		t.Error("expected a protocolerror for an invalid timestamp, got", m.event, m.data)
+	}
+
+	mentionsenabled = false
+	c.SendMentions()
+	if len(c.send) != 0 {
+		t.Error("expected nothing to be sent with mentions disabled")
+	}
+}
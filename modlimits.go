@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	conf "github.com/msbranco/goconfig"
+)
+
+// modLimit is what a role may do when moderating, a user with several roles
+// gets the most permissive combination of them
+type modLimit struct {
+	maxmute   time.Duration // 0 means up to MAXMUTEDURATION
+	maxban    time.Duration // 0 means no limit
+	permanent bool          // whether permanent bans are allowed
+	ipban     bool          // whether ip bans are allowed
+	perminute float64       // how many actions per minute, 0 means no limit
+	targets   []string      // the roles the targets may have, nil for any
+}
+
+// the limits of the roles not listed here
+var defaultmodlimit = modLimit{
+	maxmute:   MAXMUTEDURATION,
+	permanent: true,
+	ipban:     true,
+}
+
+// modlimits is replaced as a whole under the rolelock when the config is
+// reloaded, never modified
+var modlimits = map[string]*modLimit{}
+
+func getModLimits() map[string]*modLimit {
+	rolelock.RLock()
+	defer rolelock.RUnlock()
+	return modlimits
+}
+
+// the errors of the moderation actions going over the limits
+const (
+	MODLIMITDURATION  = "modlimitduration"
+	MODLIMITPERMANENT = "modlimitpermanent"
+	MODLIMITIPBAN     = "modlimitipban"
+	MODLIMITRATE      = "modlimitrate"
+	MODLIMITTARGET    = "modlimittarget"
+)
+
+// modAction is a moderation action about to happen, checked against the
+// limits of the role of the moderator
+type modAction struct {
+	action    string
+	targetuid Userid // 0 if there is no single target
+	duration  time.Duration
+	isban     bool
+	permanent bool
+	ipban     bool
+}
+
+type ModLimits struct {
+	buckets map[Userid]*tokenBucket
+	sync.Mutex
+}
+
+var modlimiter = ModLimits{
+	buckets: make(map[Userid]*tokenBucket),
+}
+
+// readModLimitConfig expects the roles to be read already, every option is
+// prefixed by the role it is for
+func readModLimitConfig(c *conf.ConfigFile) {
+	newlimits := make(map[string]*modLimit)
+	for role := range getRoles() {
+		l := defaultmodlimit
+		found := false
+		if v, err := c.GetInt64("modlimits", role+"maxmute"); err == nil {
+			l.maxmute = time.Duration(v)
+			found = true
+		}
+		if v, err := c.GetInt64("modlimits", role+"maxban"); err == nil {
+			l.maxban = time.Duration(v)
+			found = true
+		}
+		if v, err := c.GetBool("modlimits", role+"permanent"); err == nil {
+			l.permanent = v
+			found = true
+		}
+		if v, err := c.GetBool("modlimits", role+"ipban"); err == nil {
+			l.ipban = v
+			found = true
+		}
+		if v, err := c.GetFloat("modlimits", role+"perminute"); err == nil {
+			l.perminute = v
+			found = true
+		}
+		if v, err := c.GetString("modlimits", role+"targets"); err == nil && len(strings.TrimSpace(v)) != 0 {
+			l.targets = splitConfigList(strings.ToLower(v))
+			found = true
+		}
+		if found {
+			newlimits[role] = &l
+		}
+	}
+
+	rolelock.Lock()
+	modlimits = newlimits
+	rolelock.Unlock()
+}
+
+// getModLimit combines the limits of the roles of the user
+func getModLimit(u *User) *modLimit {
+	var ret *modLimit
+	if u.roles != nil {
+		limits := getModLimits()
+		for _, feature := range u.roles.features {
+			l, ok := limits[feature]
+			if !ok {
+				continue
+			}
+			if ret == nil {
+				c := *l
+				ret = &c
+				continue
+			}
+
+			ret.maxmute = maxLimit(ret.maxmute, l.maxmute)
+			ret.maxban = maxLimit(ret.maxban, l.maxban)
+			ret.permanent = ret.permanent || l.permanent
+			ret.ipban = ret.ipban || l.ipban
+			if ret.perminute != 0 && (l.perminute == 0 || l.perminute > ret.perminute) {
+				ret.perminute = l.perminute
+			}
+			if ret.targets != nil && l.targets != nil {
+				ret.targets = append(append([]string{}, ret.targets...), l.targets...)
+			} else {
+				ret.targets = nil
+			}
+		}
+	}
+
+	if ret == nil {
+		c := defaultmodlimit
+		ret = &c
+	}
+	return ret
+}
+
+// maxLimit returns the more permissive limit, where 0 means no limit
+func maxLimit(a, b time.Duration) time.Duration {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// getMaxMute returns how long the user may mute for, never longer than
+// MAXMUTEDURATION
+func (l *modLimit) getMaxMute() time.Duration {
+	if l.maxmute == 0 || l.maxmute > MAXMUTEDURATION {
+		return MAXMUTEDURATION
+	}
+	return l.maxmute
+}
+
+// canTarget checks if every role of the target is one the limit allows
+func (l *modLimit) canTarget(target *roleSet) bool {
+	if l.targets == nil || target == nil {
+		return true
+	}
+
+	r := getRoles()
+outer:
+	for _, feature := range target.features {
+		if _, ok := r[feature]; !ok {
+			continue
+		}
+		for _, t := range l.targets {
+			if t == feature {
+				continue outer
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func getTargetRoles(uid Userid) *roleSet {
+	if u := namescache.get(uid); u != nil {
+		u.RLock()
+		defer u.RUnlock()
+		return u.roles
+	}
+	return usertools.getRoleSet(db.getUserFeatures(uid))
+}
+
+// check returns the violation if the user may not do the action, the rate
+// limit is only taken from when everything else is allowed
+func (ml *ModLimits) check(u *User, a *modAction, now time.Time) string {
+	l := getModLimit(u)
+
+	maxduration := l.getMaxMute()
+	if a.isban {
+		maxduration = l.maxban
+	}
+	switch {
+	case a.permanent && !l.permanent:
+		return MODLIMITPERMANENT
+	case !a.permanent && maxduration > 0 && a.duration > maxduration:
+		return MODLIMITDURATION
+	case a.ipban && !l.ipban:
+		return MODLIMITIPBAN
+	}
+
+	if a.targetuid != 0 && l.targets != nil && !l.canTarget(getTargetRoles(a.targetuid)) {
+		return MODLIMITTARGET
+	}
+
+	if l.perminute > 0 {
+		ml.Lock()
+		tb, ok := ml.buckets[u.id]
+		if !ok {
+			tb = &tokenBucket{}
+			ml.buckets[u.id] = tb
+		}
+		ml.Unlock()
+
+		if wait := tb.take(&bucketConfig{l.perminute, l.perminute / 60}, now); wait > 0 {
+			return MODLIMITRATE
+		}
+	}
+	return ""
+}
+
+func (c *Connection) checkBanLimits(action string, uid Userid, ban *BanIn) bool {
+	return c.checkModLimits(&modAction{
+		action:    action,
+		targetuid: uid,
+		duration:  time.Duration(ban.Duration),
+		isban:     true,
+		permanent: ban.Ispermanent,
+		ipban:     ban.BanIP,
+	})
+}
+
+// checkModLimits tells the user and audits it if the action goes over the
+// limits, returns whether the action can go ahead
+func (c *Connection) checkModLimits(a *modAction) bool {
+	violation := modlimiter.check(c.user, a, time.Now())
+	if len(violation) == 0 {
+		return true
+	}
+
+	detail := fmt.Sprintf("duration=%ds permanent=%v ip=%v", a.duration/time.Second, a.permanent, a.ipban)
+	P("Moderation limit", violation, "hit by", c.user.nick, c.user.id, "for", a.action, "on", a.targetuid, detail)
+	db.insertModAudit(&dbModAudit{
+		uid:       c.user.id,
+		targetuid: a.targetuid,
+		action:    a.action,
+		violation: violation,
+		detail:    detail,
+		timestamp: time.Now().UTC(),
+	})
+
+	c.SendError(violation)
+	return false
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestModLimits(t *testing.T) {
+	defer func() { modlimits = map[string]*modLimit{} }()
+	modlimits = map[string]*modLimit{
+		"moderator": {
+			maxmute:   time.Hour,
+			maxban:    24 * time.Hour,
+			perminute: 2,
+			targets:   []string{"subscriber"},
+		},
+		"admin": {
+			maxmute:   0,
+			maxban:    time.Hour,
+			permanent: true,
+		},
+	}
+
+	ml := &ModLimits{buckets: make(map[Userid]*tokenBucket)}
+	now := time.Now()
+	mod := &User{id: Userid(50), nick: "mod"}
+	mod.setFeatures([]string{"moderator"})
+
+	tests := []struct {
+		a         *modAction
+		violation string
+	}{
+		{&modAction{action: "MUTE", duration: 2 * time.Hour}, MODLIMITDURATION},
+		{&modAction{action: "BAN", isban: true, permanent: true}, MODLIMITPERMANENT},
+		{&modAction{action: "BAN", isban: true, duration: time.Hour, ipban: true}, MODLIMITIPBAN},
+		{&modAction{action: "BAN", isban: true, duration: time.Hour}, ""},
+		{&modAction{action: "MUTE", duration: time.Minute}, ""},
+		{&modAction{action: "MUTE", duration: time.Minute}, MODLIMITRATE},
+	}
+	for i, test := range tests {
+		if v := ml.check(mod, test.a, now); v != test.violation {
+			t.Error(i, "expected", test.violation, "got", v)
+		}
+	}
+
+	// the most permissive of the roles wins
+	both := &User{id: Userid(51), nick: "both"}
+	both.setFeatures([]string{"moderator", "admin"})
+	l := getModLimit(both)
+	if l.maxmute != 0 || l.maxban != 24*time.Hour || !l.permanent || l.perminute != 0 || l.targets != nil {
+		t.Errorf("unexpected combined limit %+v", l)
+	}
+
+	if l := getModLimit(&User{}); l.maxmute != defaultmodlimit.maxmute {
+		t.Error("expected users without limits to get the default ones")
+	}
+
+	limit := getModLimit(mod)
+	sub := usertools.getRoleSet([]string{"subscriber", "flair1"})
+	vip := usertools.getRoleSet([]string{"subscriber", "vip"})
+	if !limit.canTarget(sub) || limit.canTarget(vip) {
+		t.Error("expected moderators to only be able to target subscribers")
+	}
+
+	// no mute is longer than the ceiling, even without a limit
+	admin := &User{id: Userid(52), nick: "admin"}
+	admin.setFeatures([]string{"admin"})
+	if v := ml.check(admin, &modAction{action: "MUTE", duration: MAXMUTEDURATION + time.Second}, now); v != MODLIMITDURATION {
+		t.Error("expected the mute over the ceiling to be rejected, got", v)
+	}
+	if v := ml.check(admin, &modAction{action: "MUTE", duration: MAXMUTEDURATION}, now); v != "" {
+		t.Error("expected the mute up to the ceiling to be allowed, got", v)
+	}
+}
+
+func TestInsertModAudit(t *testing.T) {
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal("unable to create the database mock", err)
+	}
+	defer conn.Close()
+	defer func(min, max time.Duration) { AUDITRETRYMIN, AUDITRETRYMAX = min, max }(AUDITRETRYMIN, AUDITRETRYMAX)
+	AUDITRETRYMIN, AUDITRETRYMAX = time.Millisecond, 2*time.Millisecond
+
+	// nothing inserts yet, queueing must still never block
+	d := &database{db: conn, audits: newAuditQueue()}
+	queued := make(chan struct{})
+	go func() {
+		for i := 1; i <= 20; i++ {
+			d.insertModAudit(&dbModAudit{uid: Userid(i), action: "MUTE"})
+		}
+		close(queued)
+	}()
+	select {
+	case <-queued:
+	case <-time.After(time.Second):
+		t.Fatal("expected queueing to never block")
+	}
+
+	// the failing entry is retried until it goes through, in order
+	for i := 0; i < 5; i++ {
+		mock.ExpectExec("INSERT INTO modaudit").WithArgs(Userid(1), sqlmock.AnyArg(), "MUTE", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnError(sqlmock.ErrCancelled)
+	}
+	for i := 1; i <= 20; i++ {
+		mock.ExpectExec("INSERT INTO modaudit").WithArgs(Userid(i), sqlmock.AnyArg(), "MUTE", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(int64(i), 1))
+	}
+	go d.runInsertAudit()
+	defer close(d.audits.wake)
+
+	deadline := time.Now().Add(time.Second)
+	for mock.ExpectationsWereMet() != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error("expected every entry to be inserted, the failed one again", err)
+	}
+}
@@ -28,6 +28,59 @@ func (m *Mutes) muteUserid(uid Userid, duration int64) {
 	state.save()
 }
 
+// muteChange is a mute that can be undone
+type muteChange struct {
+	nick     string
+	expires  time.Time // what the mute was set to
+	previous time.Time // what it was before, zero if the user was not muted
+}
+
+// extendMutes mutes every user at once until the time, except the ones
+// already muted for longer, returns the changes made
+func (m *Mutes) extendMutes(uids map[Userid]string, expires time.Time) map[Userid]muteChange {
+	state.Lock()
+	defer state.Unlock()
+
+	changes := make(map[Userid]muteChange)
+	for uid, nick := range uids {
+		previous, ok := state.mutes[uid]
+		if ok && !previous.Before(expires) {
+			continue
+		}
+		if !ok || isExpiredUTC(previous) {
+			previous = time.Time{}
+		}
+
+		state.mutes[uid] = expires
+		changes[uid] = muteChange{nick, expires, previous}
+	}
+	state.save()
+	return changes
+}
+
+// undoMutes puts back the mutes from before the changes, the mutes changed
+// again since are left alone, returns the nicks of the users affected
+func (m *Mutes) undoMutes(changes map[Userid]muteChange) []string {
+	state.Lock()
+	defer state.Unlock()
+
+	nicks := make([]string, 0, len(changes))
+	for uid, c := range changes {
+		if current, ok := state.mutes[uid]; !ok || !current.Equal(c.expires) {
+			continue
+		}
+
+		if c.previous.IsZero() || isExpiredUTC(c.previous) {
+			delete(state.mutes, uid)
+		} else {
+			state.mutes[uid] = c.previous
+		}
+		nicks = append(nicks, c.nick)
+	}
+	state.save()
+	return nicks
+}
+
 func (m *Mutes) unmuteUserid(uid Userid) {
 	state.Lock()
 	defer state.Unlock()
@@ -6,6 +6,7 @@ import (
 )
 
 func TestMuteTimes(t *testing.T) {
+	setupTestState(t)
 	timeinfuture := time.Date(time.Now().Year()+1, time.September, 10, 23, 0, 0, 0, time.UTC)
 	timeinpast := time.Date(time.Now().Year()-1, time.September, 10, 23, 0, 0, 0, time.UTC)
 	uid := Userid(1)
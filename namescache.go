@@ -2,15 +2,35 @@
 package main
 
 import (
+	"expvar"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// how often the connected users are written to redis (if they changed) and
+// how often connection count changes are broadcast at most
+const (
+	NAMESCACHEINTERVAL      = time.Second
+	CONNECTIONCOUNTINTERVAL = 5 * time.Second
+)
+
+// users offline for longer than this are evicted from the namescache, their
+// anti-spam state is kept in the spamstates for SPAMSTATETTL
+var NAMESEVICTAFTER = 30 * time.Minute
+
 // ffjson: skip
 type namesCache struct {
 	users           map[Userid]*User
+	online          map[Userid]*User     // users with at least one connection
+	offline         map[Userid]time.Time // when users without connections disconnected
 	marshallednames []byte
+	marshaltime     time.Time
+	marshalledcount uint32
+	namesdirty      bool // the list of online users changed since the last marshal
+	cachedirty      bool // the names changed since they were last written to redis
 	usercount       uint32
+	lastusercount   uint32 // the connection count last broadcast
 	ircnames        [][]string
 	sync.RWMutex
 }
@@ -26,45 +46,150 @@ type NamesOut struct {
 	Connections uint32            `json:"connectioncount"`
 }
 
+// ffjson: skip
+type ConnectionCountOut struct {
+	Connections uint32 `json:"connectioncount"`
+}
+
 var namescache = namesCache{
-	users:   make(map[Userid]*User),
-	RWMutex: sync.RWMutex{},
+	users:      make(map[Userid]*User),
+	online:     make(map[Userid]*User),
+	offline:    make(map[Userid]time.Time),
+	namesdirty: true,
+	RWMutex:    sync.RWMutex{},
+}
+
+func init() {
+	expvar.Publish("namescacheUsers", expvar.Func(func() interface{} {
+		namescache.RLock()
+		defer namescache.RUnlock()
+		return len(namescache.users)
+	}))
+	expvar.Publish("namescacheOnline", expvar.Func(func() interface{} {
+		namescache.RLock()
+		defer namescache.RUnlock()
+		return len(namescache.online)
+	}))
 }
 
 func initNamesCache() {
+	go namescache.run()
+}
+
+func (nc *namesCache) run() {
+	t := time.NewTicker(NAMESCACHEINTERVAL)
+	e := time.NewTicker(time.Minute)
+	var lastcount time.Time
+	for {
+		select {
+		case now := <-t.C:
+			nc.flush()
+			if now.Sub(lastcount) >= CONNECTIONCOUNTINTERVAL {
+				lastcount = now
+				nc.broadcastConnectionCount()
+			}
+		case now := <-e.C:
+			nc.evict(now)
+			spamstates.clean(now)
+		}
+	}
+}
+
+// evict forgets the users that have been offline for too long, their
+// anti-spam state is moved to the spamstates so it survives a reconnect
+func (nc *namesCache) evict(now time.Time) {
+	nc.Lock()
+	defer nc.Unlock()
+
+	for uid, since := range nc.offline {
+		if now.Sub(since) < NAMESEVICTAFTER {
+			continue
+		}
+
+		if u, ok := nc.users[uid]; ok && atomic.LoadInt32(&u.connections) <= 0 {
+			spamstates.save(u)
+			delete(nc.users, uid)
+		}
+		delete(nc.offline, uid)
+	}
+}
+
+// flush writes the names to redis if they changed since the last write
+func (nc *namesCache) flush() {
+	nc.Lock()
+	if !nc.cachedirty {
+		nc.Unlock()
+		return
+	}
+	nc.cachedirty = false
+	nc.marshalIfNeeded(true)
+	names := nc.marshallednames
+	nc.Unlock()
+
+	cacheConnectedUsers(names)
+}
+
+// broadcastConnectionCount sends the lightweight CONNECTIONCOUNT event
+// instead of the full names whenever only the connection count changed
+func (nc *namesCache) broadcastConnectionCount() {
+	nc.Lock()
+	count := nc.usercount
+	changed := count != nc.lastusercount
+	nc.lastusercount = count
+	nc.Unlock()
+
+	if !changed {
+		return
+	}
+
+	data, _ := Marshal(&ConnectionCountOut{count})
+	hub.broadcast <- &message{
+		event: "CONNECTIONCOUNT",
+		data:  data,
+	}
 }
 
 func (nc *namesCache) getIrcNames() [][]string {
-	nc.RLock()
-	defer nc.RUnlock()
+	nc.Lock()
+	defer nc.Unlock()
+	nc.marshalIfNeeded(false)
 	return nc.ircnames
 }
 
+// marshalIfNeeded regenerates the names if the users or the connection
+// count changed, at most once every NAMESCACHEINTERVAL unless forced, the
+// previous names are served in between, expects the lock to be held
+func (nc *namesCache) marshalIfNeeded(force bool) {
+	if !nc.namesdirty && nc.usercount == nc.marshalledcount {
+		return
+	}
+	if !force && nc.marshallednames != nil && time.Since(nc.marshaltime) < NAMESCACHEINTERVAL {
+		return
+	}
+	nc.marshalNames(nc.namesdirty)
+}
+
 func (nc *namesCache) marshalNames(updateircnames bool) {
-	users := make([]*SimplifiedUser, 0, len(nc.users))
+	users := make([]*SimplifiedUser, 0, len(nc.online))
 	var allnames []string
 	if updateircnames {
-		allnames = make([]string, 0, len(nc.users))
+		allnames = make([]string, 0, len(nc.online))
 	}
-	for _, u := range nc.users {
+	for _, u := range nc.online {
 		u.RLock()
-		n := atomic.LoadInt32(&u.connections)
-		if n <= 0 {
-			continue
-		}
 		users = append(users, u.simplified)
 		if updateircnames {
 			prefix := ""
 			switch {
-			case u.featureGet(ISADMIN):
+			case u.hasFeature("admin"):
 				prefix = "~" // +q
-			case u.featureGet(ISBOT):
+			case u.hasFeature("bot"):
 				prefix = "&" // +a
-			case u.featureGet(ISMODERATOR):
+			case u.hasFeature("moderator"):
 				prefix = "@" // +o
-			case u.featureGet(ISVIP):
+			case u.hasFeature("vip"):
 				prefix = "%" // +h
-			case u.featureGet(ISSUBSCRIBER):
+			case u.hasFeature("subscriber"):
 				prefix = "+" // +v
 			}
 			allnames = append(allnames, prefix+u.nick)
@@ -92,17 +217,20 @@ func (nc *namesCache) marshalNames(updateircnames bool) {
 		Connections: nc.usercount,
 	}
 	nc.marshallednames, _ = n.MarshalJSON()
+	nc.marshalledcount = nc.usercount
+	nc.marshaltime = time.Now()
+	nc.namesdirty = false
 
-	cacheConnectedUsers(nc.marshallednames)
-
-	for _, u := range nc.users {
+	for _, u := range nc.online {
 		u.RUnlock()
 	}
 }
 
+// getNames returns the full NAMES payload, only marshalled when needed
 func (nc *namesCache) getNames() []byte {
-	nc.RLock()
-	defer nc.RUnlock()
+	nc.Lock()
+	defer nc.Unlock()
+	nc.marshalIfNeeded(false)
 	return nc.marshallednames
 }
 
@@ -118,11 +246,15 @@ func (nc *namesCache) add(user *User) *User {
 	defer nc.Unlock()
 
 	nc.usercount++
-	var updateircnames bool
+	nc.cachedirty = true
+	delete(nc.offline, user.id)
 	if u, ok := nc.users[user.id]; ok {
-		atomic.AddInt32(&u.connections, 1)
+		if atomic.AddInt32(&u.connections, 1) == 1 {
+			nc.online[u.id] = u
+			nc.namesdirty = true
+		}
 	} else {
-		updateircnames = true
+		spamstates.restore(user)
 		atomic.AddInt32(&user.connections, 1)
 		su := &SimplifiedUser{
 			Nick:     user.nick,
@@ -130,51 +262,94 @@ func (nc *namesCache) add(user *User) *User {
 		}
 		user.simplified = su
 		nc.users[user.id] = user
+		nc.online[user.id] = user
+		nc.namesdirty = true
 	}
-	nc.marshalNames(updateircnames)
 	return nc.users[user.id]
 }
 
+// attach returns the one user struct for the user without counting it as
+// connected, for users acting through the bot api
+func (nc *namesCache) attach(user *User) *User {
+	nc.Lock()
+	defer nc.Unlock()
+
+	if u, ok := nc.users[user.id]; ok {
+		if atomic.LoadInt32(&u.connections) <= 0 {
+			nc.offline[u.id] = time.Now()
+		}
+		return u
+	}
+
+	spamstates.restore(user)
+	user.simplified = &SimplifiedUser{
+		Nick:     user.nick,
+		Features: user.simplified.Features,
+	}
+	nc.users[user.id] = user
+	nc.offline[user.id] = time.Now()
+	return user
+}
+
 func (nc *namesCache) disconnect(user *User) {
 	nc.Lock()
 	defer nc.Unlock()
-	var updateircnames bool
 
+	nc.usercount--
+	nc.cachedirty = true
 	if user != nil {
-		nc.usercount--
 		if u, ok := nc.users[user.id]; ok {
 			conncount := atomic.AddInt32(&u.connections, -1)
 			if conncount <= 0 {
-				// we do not delete the users so that the lastmessage is preserved for
-				// anti-spam purposes, sadly this means memory usage can only go up
-				updateircnames = true
+				// the user is kept around for a while so that the anti-spam state is
+				// preserved, see evict
+				delete(nc.online, u.id)
+				nc.offline[u.id] = time.Now()
+				nc.namesdirty = true
 			}
 		}
-
-	} else {
-		nc.usercount--
 	}
-	nc.marshalNames(updateircnames)
 }
 
 func (nc *namesCache) refresh(user *User) {
-	nc.RLock()
-	defer nc.RUnlock()
+	nc.Lock()
+	defer nc.Unlock()
 
 	if u, ok := nc.users[user.id]; ok {
 		u.Lock()
 		u.simplified.Nick = user.nick
 		u.simplified.Features = user.simplified.Features
 		u.nick = user.nick
-		u.features = user.features
+		u.roles = user.roles
+		u.Unlock()
+		if _, ok := nc.online[u.id]; ok {
+			nc.namesdirty = true
+			nc.cachedirty = true
+		}
+	}
+}
+
+// refreshRoles gives every user the role set of its features again, after
+// the roles changed
+func (nc *namesCache) refreshRoles() {
+	nc.Lock()
+	defer nc.Unlock()
+
+	for _, u := range nc.users {
+		u.Lock()
+		if u.roles != nil {
+			u.roles = usertools.getRoleSet(u.roles.features)
+			u.simplified.Features = &u.roles.features
+		}
 		u.Unlock()
-		nc.marshalNames(true)
 	}
+	nc.namesdirty = true
+	nc.cachedirty = true
 }
 
 func (nc *namesCache) addConnection() {
 	nc.Lock()
 	defer nc.Unlock()
 	nc.usercount++
-	nc.marshalNames(false)
+	nc.cachedirty = true
 }
@@ -1,10 +1,71 @@
 package main
 
 import (
+	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
+func TestNamescacheIncremental(t *testing.T) {
+	u := &User{}
+	u.id = Userid(2)
+	u.nick = "someone"
+	u.setFeatures([]string{"subscriber"})
+	u.assembleSimplifiedUser()
+
+	nc := &namesCache{
+		users:   make(map[Userid]*User),
+		online:  make(map[Userid]*User),
+		offline: make(map[Userid]time.Time),
+		RWMutex: sync.RWMutex{},
+	}
+
+	nc.add(u)
+	nc.add(u)
+	nc.addConnection()
+	if names := string(nc.getNames()); !strings.Contains(names, `"someone"`) || !strings.Contains(names, `"connectioncount":3`) {
+		t.Errorf("Names should contain the user and 3 connections, was %s", names)
+	}
+
+	nc.disconnect(u)
+	if _, ok := nc.online[u.id]; !ok || nc.namesdirty {
+		t.Error("User with a connection left should still be online without the names changing")
+	}
+
+	nc.disconnect(u)
+	if _, ok := nc.online[u.id]; ok || !nc.namesdirty {
+		t.Error("User without connections should not be online anymore")
+	}
+	// the names are regenerated at most once every NAMESCACHEINTERVAL
+	if names := string(nc.getNames()); !strings.Contains(names, `"someone"`) || !nc.namesdirty {
+		t.Errorf("Names should not be regenerated before the interval passed, was %s", names)
+	}
+	nc.marshaltime = time.Now().Add(-NAMESCACHEINTERVAL)
+	if names := string(nc.getNames()); strings.Contains(names, `"someone"`) || nc.namesdirty {
+		t.Errorf("Names should not contain the user anymore, was %s", names)
+	}
+	if _, ok := nc.users[u.id]; !ok {
+		t.Error("User should be kept around after disconnecting")
+	}
+
+	// the throttle state has to survive the eviction of the user
+	u.throttle.penalize(&bucketConfig{4, 1}, 10, time.Now())
+	nc.evict(time.Now().Add(NAMESEVICTAFTER))
+	if _, ok := nc.users[u.id]; ok {
+		t.Error("User should have been evicted after being offline for long enough")
+	}
+
+	nu := &User{}
+	nu.id = u.id
+	nu.nick = u.nick
+	nu.assembleSimplifiedUser()
+	nc.add(nu)
+	if nu.throttle.tokens > -3 {
+		t.Errorf("Reconnecting user should have the throttle state restored, tokens: %v", nu.throttle.tokens)
+	}
+}
+
 func TestNamescacheRefresh(t *testing.T) {
 	uid := Userid(1)
 
@@ -16,6 +77,7 @@ func TestNamescacheRefresh(t *testing.T) {
 
 	nc := &namesCache{
 		users:   make(map[Userid]*User),
+		online:  make(map[Userid]*User),
 		RWMutex: sync.RWMutex{},
 	}
 
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	conf "github.com/msbranco/goconfig"
+)
+
+var (
+	NUKEWINDOW      = 2 * time.Minute // how far back a nuke can look at most
+	NUKEMAXMESSAGES = 2000            // how many recent messages are kept at most
+	NUKEACTIVE      = 5 * time.Minute // how long a nuke keeps muting new matching messages
+)
+
+func readNukeConfig(c *conf.ConfigFile) {
+	if v, err := c.GetInt64("nuke", "window"); err == nil {
+		NUKEWINDOW = time.Duration(v)
+	}
+	if v, err := c.GetInt64("nuke", "maxmessages"); err == nil && v > 0 {
+		NUKEMAXMESSAGES = int(v)
+	}
+	if v, err := c.GetInt64("nuke", "active"); err == nil {
+		NUKEACTIVE = time.Duration(v)
+	}
+}
+
+type NukeIn struct {
+	Data     string `json:"data"`     // the phrase
+	Duration int64  `json:"duration"` // of the mutes
+	Window   int64  `json:"window"`   // how far back to look, at most NUKEWINDOW
+}
+
+type NukeOut struct {
+	*SimplifiedUser
+	Timestamp int64    `json:"timestamp"`
+	Data      string   `json:"data"`
+	Duration  int64    `json:"duration,omitempty"`
+	Count     int      `json:"count"`
+	Nicks     []string `json:"nicks"` // the users muted or unmuted
+}
+
+type recentMessage struct {
+	uid       Userid
+	nick      string
+	msg       string // lowercased
+	protected bool
+	roles     *roleSet
+	timestamp time.Time
+}
+
+type nuke struct {
+	phrase   string    // lowercased
+	uid      Userid    // who nuked, exempt from it
+	limit    *modLimit // of who nuked, the users it may not target are exempt
+	duration int64
+	expires  time.Time
+	muted    map[Userid]muteChange
+}
+
+type Nukes struct {
+	recent []recentMessage
+	last   *nuke
+	sync.Mutex
+}
+
+var nukes = Nukes{
+	recent: make([]recentMessage, 0),
+}
+
+func init() {
+	registerCommand(&command{
+		name:       "NUKE",
+		help:       "mutes everybody who recently said the phrase",
+		permission: PERMMUTE,
+		bot:        true,
+		payload: func() interface{} {
+			return &NukeIn{}
+		},
+		handler: func(c *Connection, p interface{}) {
+			c.OnNuke(p.(*NukeIn))
+		},
+	})
+	registerCommand(&command{
+		name:       "AEGIS",
+		help:       "undoes the mutes of the last nuke",
+		permission: PERMMUTE,
+		bot:        true,
+		handler: func(c *Connection, _ interface{}) {
+			c.OnAegis()
+		},
+	})
+}
+
+// track remembers the message for the nukes, expects it to be broadcast already
+func (n *Nukes) track(u *User, msg string, now time.Time) {
+	n.Lock()
+	defer n.Unlock()
+
+	n.recent = append(n.recent, recentMessage{
+		uid:       u.id,
+		nick:      u.nick,
+		msg:       strings.ToLower(msg),
+		protected: u.isProtected(),
+		roles:     u.roles,
+		timestamp: now,
+	})
+
+	// the messages are in order, drop the ones too old or too many
+	drop := 0
+	if len(n.recent) > NUKEMAXMESSAGES {
+		drop = len(n.recent) - NUKEMAXMESSAGES
+	}
+	for drop < len(n.recent) && now.Sub(n.recent[drop].timestamp) > NUKEWINDOW {
+		drop++
+	}
+	if drop > 0 {
+		n.recent = append(n.recent[:0], n.recent[drop:]...)
+	}
+}
+
+// nuke mutes everybody who said the phrase in the window, except protected
+// users, the nuker and the users the nuker may not target, the users already
+// muted for longer are left alone, returns the nicks of the users muted
+func (n *Nukes) nuke(by *User, phrase string, duration int64, window time.Duration, now time.Time) []string {
+	nk := &nuke{
+		phrase:   strings.ToLower(phrase),
+		uid:      by.id,
+		limit:    getModLimit(by),
+		duration: duration,
+		expires:  now.Add(NUKEACTIVE),
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	targets := make(map[Userid]string)
+	for _, m := range n.recent {
+		if now.Sub(m.timestamp) > window || m.protected || m.uid == nk.uid || !nk.limit.canTarget(m.roles) {
+			continue
+		}
+		if strings.Contains(m.msg, nk.phrase) {
+			targets[m.uid] = m.nick
+		}
+	}
+	nk.muted = mutes.extendMutes(targets, now.UTC().Add(time.Duration(duration)))
+	n.last = nk
+
+	nicks := make([]string, 0, len(nk.muted))
+	for _, c := range nk.muted {
+		nicks = append(nicks, c.nick)
+	}
+	sort.Strings(nicks)
+	return nicks
+}
+
+// aegis puts back the mutes from before the last nuke and stops it, returns
+// the nicks of the users whose mute was undone
+func (n *Nukes) aegis() (string, []string, bool) {
+	n.Lock()
+	defer n.Unlock()
+
+	nk := n.last
+	if nk == nil {
+		return "", nil, false
+	}
+	n.last = nil
+
+	nicks := mutes.undoMutes(nk.muted)
+	sort.Strings(nicks)
+	return nk.phrase, nicks, true
+}
+
+// nukeStage mutes the users saying the phrase of a still active nuke
+func nukeStage(pm *pipelineMessage) bool {
+	u := pm.c.user
+	if u == nil || u.isProtected() {
+		return true
+	}
+
+	nukes.Lock()
+	nk := nukes.last
+	if nk == nil || time.Now().After(nk.expires) || nk.uid == u.id || !nk.limit.canTarget(u.roles) ||
+		!strings.Contains(strings.ToLower(pm.msg), nk.phrase) {
+		nukes.Unlock()
+		return true
+	}
+	duration := nk.duration
+	expires := time.Now().UTC().Add(time.Duration(duration))
+	for uid, c := range mutes.extendMutes(map[Userid]string{u.id: u.nick}, expires) {
+		nk.muted[uid] = c
+	}
+	nukes.Unlock()
+
+	pm.c.announceAutoMute(duration)
+	return false
+}
+
+func (c *Connection) OnNuke(m *NukeIn) {
+	phrase := strings.TrimSpace(m.Data)
+	if !isValidMessage(phrase) {
+		c.SendError("invalidmsg")
+		return
+	}
+
+	if m.Duration == 0 {
+		m.Duration = int64(DEFAULTMUTEDURATION)
+	}
+	if m.Duration < 0 {
+		c.SendError("protocolerror")
+		return
+	}
+	if !c.checkModLimits(&modAction{
+		action:   "NUKE",
+		duration: time.Duration(m.Duration),
+	}) {
+		return
+	}
+
+	window := time.Duration(m.Window)
+	if window <= 0 || window > NUKEWINDOW {
+		window = NUKEWINDOW
+	}
+
+	nicks := nukes.nuke(c.user, phrase, m.Duration, window, time.Now())
+	D("Nuked", len(nicks), "users for", phrase, "by", c.user.nick)
+
+	c.broadcastNuke("NUKE", phrase, m.Duration/int64(time.Second), nicks)
+}
+
+func (c *Connection) OnAegis() {
+	phrase, nicks, ok := nukes.aegis()
+	if !ok {
+		c.SendError("notfound")
+		return
+	}
+
+	D("Aegis undid the mutes of", len(nicks), "users by", c.user.nick)
+	c.broadcastNuke("AEGIS", phrase, 0, nicks)
+}
+
+func (c *Connection) broadcastNuke(event, phrase string, duration int64, nicks []string) {
+	c.rlockUserIfExists()
+	data, _ := Marshal(&NukeOut{
+		SimplifiedUser: c.user.simplified,
+		Timestamp:      unixMilliTime(),
+		Data:           phrase,
+		Duration:       duration,
+		Count:          len(nicks),
+		Nicks:          nicks,
+	})
+	c.runlockUserIfExists()
+
+	hub.broadcast <- &message{
+		event: event,
+		data:  data,
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNuke(t *testing.T) {
+	setupTestState(t)
+	n := &Nukes{recent: make([]recentMessage, 0)}
+	now := time.Now()
+
+	mod := &User{id: Userid(30), nick: "mod"}
+	admin := &User{id: Userid(31), nick: "admin"}
+	admin.setFeatures([]string{"admin"})
+	old := &User{id: Userid(32), nick: "old"}
+	bad := &User{id: Userid(33), nick: "bad"}
+
+	n.track(old, "BAD phrase", now.Add(-time.Hour))
+	n.track(bad, "this BAD PHRASE again", now)
+	n.track(admin, "bad phrase", now)
+	n.track(mod, "bad phrase", now)
+	if len(n.recent) != 3 {
+		t.Error("expected the message outside of the window to be dropped, got", len(n.recent))
+	}
+
+	if nicks := n.nuke(mod, "bad phrase", int64(time.Minute), time.Minute, now); strings.Join(nicks, ",") != "bad" {
+		t.Error("expected only the unprotected user to be nuked, got", nicks)
+	}
+	if !isMuted(bad.id) || isMuted(admin.id) || isMuted(mod.id) {
+		t.Error("expected bad to be muted")
+	}
+	if c := offences.count(bad.id, now); c != 0 {
+		t.Error("expected the nuke to not be an offence, got", c)
+	}
+
+	if _, nicks, ok := n.aegis(); !ok || strings.Join(nicks, ",") != "bad" || isMuted(bad.id) {
+		t.Error("expected aegis to undo the mute", nicks, ok)
+	}
+	if _, _, ok := n.aegis(); ok {
+		t.Error("expected nothing to undo after aegis")
+	}
+}
+
+func TestNukeKeepsExistingMutes(t *testing.T) {
+	setupTestState(t)
+	n := &Nukes{recent: make([]recentMessage, 0)}
+	now := time.Now()
+
+	longer := &User{id: Userid(34), nick: "longer"}
+	shorter := &User{id: Userid(35), nick: "shorter"}
+	remuted := &User{id: Userid(36), nick: "remuted"}
+	for _, u := range []*User{longer, shorter, remuted} {
+		n.track(u, "nuked phrase", now)
+	}
+
+	mutes.muteUserid(longer.id, int64(24*time.Hour))
+	mutes.muteUserid(shorter.id, int64(10*time.Second))
+	longexpiry, shortexpiry := getMuteExpiry(longer.id), getMuteExpiry(shorter.id)
+	defer func() {
+		for _, u := range []*User{longer, shorter, remuted} {
+			mutes.unmuteUserid(u.id)
+		}
+	}()
+
+	if nicks := n.nuke(&User{id: Userid(1)}, "nuked phrase", int64(time.Minute), time.Minute, now); strings.Join(nicks, ",") != "remuted,shorter" {
+		t.Error("expected the user muted for longer to be left alone, got", nicks)
+	}
+	if !getMuteExpiry(longer.id).Equal(longexpiry) {
+		t.Error("expected the longer mute to not be shortened")
+	}
+	if !getMuteExpiry(shorter.id).After(shortexpiry) {
+		t.Error("expected the shorter mute to be extended")
+	}
+
+	// a moderator mutes the user again after the nuke
+	mutes.muteUserid(remuted.id, int64(time.Hour))
+
+	if _, nicks, _ := n.aegis(); strings.Join(nicks, ",") != "shorter" {
+		t.Error("expected only the mute still from the nuke to be undone, got", nicks)
+	}
+	if !getMuteExpiry(shorter.id).Equal(shortexpiry) {
+		t.Error("expected the previous mute to be restored")
+	}
+	if !getMuteExpiry(longer.id).Equal(longexpiry) || !isMuted(remuted.id) {
+		t.Error("expected the other mutes to be kept")
+	}
+}
+
+func TestNukeTargets(t *testing.T) {
+	setupTestState(t)
+	defer func(old map[string]*modLimit) { modlimits = old }(modlimits)
+	modlimits = map[string]*modLimit{
+		"moderator": {targets: []string{"subscriber", "vip"}},
+	}
+	n := &Nukes{recent: make([]recentMessage, 0)}
+	now := time.Now()
+
+	mod := &User{id: Userid(38), nick: "limitedmod"}
+	mod.setFeatures([]string{"moderator"})
+	othermod := &User{id: Userid(39), nick: "othermod"}
+	othermod.setFeatures([]string{"moderator"})
+	vip := &User{id: Userid(40), nick: "vip"}
+	vip.setFeatures([]string{"vip", "flair3"})
+	for _, u := range []*User{othermod, vip} {
+		n.track(u, "nuked phrase", now)
+		defer mutes.unmuteUserid(u.id)
+	}
+
+	if nicks := n.nuke(mod, "nuked phrase", int64(time.Minute), time.Minute, now); strings.Join(nicks, ",") != "vip" || isMuted(othermod.id) {
+		t.Error("expected only the users the moderator may target to be nuked, got", nicks)
+	}
+
+	c := newBotConnection(othermod, "127.0.0.1")
+	if !nukeStage(&pipelineMessage{c: c, msg: "nuked phrase"}) || isMuted(othermod.id) {
+		t.Error("expected the active nuke to also skip the users the moderator may not target")
+	}
+}
+
+func TestNukeStage(t *testing.T) {
+	setupTestState(t)
+	drainBroadcasts()
+
+	defer func(last *nuke) {
+		nukes.Lock()
+		nukes.last = last
+		nukes.Unlock()
+	}(nukes.last)
+	nukes.Lock()
+	nukes.last = &nuke{
+		phrase:   "nuked phrase",
+		uid:      Userid(1),
+		limit:    &modLimit{},
+		duration: int64(time.Minute),
+		expires:  time.Now().Add(time.Minute),
+		muted:    make(map[Userid]muteChange),
+	}
+	nukes.Unlock()
+
+	late := &User{id: Userid(37), nick: "late"}
+	c := newBotConnection(late, "127.0.0.1")
+	if nukeStage(&pipelineMessage{c: c, msg: "Nuked Phrase again"}) {
+		t.Error("expected the message to be stopped")
+	}
+	if m := getBroadcast(t); m.event != "MUTE" || !strings.Contains(string(m.data.([]byte)), `"data":"late"`) {
+		t.Errorf("expected the mute to be broadcast, got %s %s", m.event, m.data)
+	}
+	if m := <-c.blocksend; m.event != "ERR" {
+		t.Error("expected the user to be told, got", m.event)
+	}
+
+	drainBroadcasts()
+	c.user = &User{id: Userid(1), nick: "nuker"}
+	c.user.setFeatures([]string{"moderator"})
+	c.user.assembleSimplifiedUser()
+	c.OnAegis()
+	m := getBroadcast(t)
+	if data := string(m.data.([]byte)); m.event != "AEGIS" || !strings.Contains(data, `"nicks":["late"]`) || !strings.Contains(data, `"count":1`) {
+		t.Errorf("expected the affected users to be in the aegis, got %s %s", m.event, m.data)
+	}
+	if isMuted(late.id) {
+		t.Error("expected the mute of the stage to be undone")
+	}
+}
+
+func isMuted(uid Userid) bool {
+	state.RLock()
+	defer state.RUnlock()
+	_, ok := state.mutes[uid]
+	return ok
+}
+
+func getMuteExpiry(uid Userid) time.Time {
+	state.RLock()
+	defer state.RUnlock()
+	return state.mutes[uid]
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	conf "github.com/msbranco/goconfig"
+)
+
+// the kinds of offences kept in the history of the users, only the mutes and
+// bans of the moderators are offences
+const (
+	OFFENCEMUTE = "mute"
+	OFFENCEBAN  = "ban"
+)
+
+var (
+	// the durations of the mutes without an explicit one, by how many recent
+	// offences the user has, the last one is used from then on
+	MUTELADDER = []time.Duration{
+		DEFAULTMUTEDURATION,
+		time.Hour,
+		24 * time.Hour,
+	}
+	OFFENCEDECAY = 30 * 24 * time.Hour // how long an offence counts
+)
+
+// Offence is persisted in the state file
+type Offence struct {
+	Type      string
+	Timestamp time.Time
+}
+
+// MuteExtradata is sent as the extradata of the MUTE broadcast
+type MuteExtradata struct {
+	Duration int64 `json:"duration"` // in seconds
+	Offences int   `json:"offences"` // the prior offences in the decay window
+}
+
+type Offences int
+
+var offences Offences
+
+func readOffenceConfig(c *conf.ConfigFile) {
+	if v, err := c.GetString("offences", "ladder"); err == nil {
+		ladder := make([]time.Duration, 0)
+		for _, s := range splitConfigList(v) {
+			d, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || d <= 0 {
+				F("Invalid mute ladder duration", s)
+			}
+			ladder = append(ladder, time.Duration(d))
+		}
+		if len(ladder) != 0 {
+			MUTELADDER = ladder
+		}
+	}
+	if v, err := c.GetInt64("offences", "decay"); err == nil && v > 0 {
+		OFFENCEDECAY = time.Duration(v)
+	}
+}
+
+func getMuteLadderConfig() string {
+	s := make([]string, 0, len(MUTELADDER))
+	for _, d := range MUTELADDER {
+		s = append(s, strconv.FormatInt(int64(d), 10))
+	}
+	return strings.Join(s, ", ")
+}
+
+func initOffences() {
+	go offences.run()
+}
+
+func (o *Offences) run() {
+	t := time.NewTicker(time.Hour)
+	for range t.C {
+		o.clean(time.Now().UTC())
+	}
+}
+
+// clean forgets about the offences past the decay
+func (o *Offences) clean(now time.Time) {
+	state.Lock()
+	defer state.Unlock()
+
+	for uid := range state.offences {
+		o.decay(uid, now)
+	}
+	state.save()
+}
+
+// decay expects the state lock to be held, returns what is left
+func (o *Offences) decay(uid Userid, now time.Time) []Offence {
+	history := state.offences[uid]
+	i := 0
+	for i < len(history) && now.Sub(history[i].Timestamp) > OFFENCEDECAY {
+		i++
+	}
+	if i == len(history) {
+		delete(state.offences, uid)
+		return nil
+	}
+	if i > 0 {
+		history = append(history[:0], history[i:]...)
+		state.offences[uid] = history
+	}
+	return history
+}
+
+// recordLocked expects the state lock to be held and the state to be saved
+// by the caller
+func (o *Offences) recordLocked(uid Userid, offence string, now time.Time) {
+	history := o.decay(uid, now)
+	state.offences[uid] = append(history, Offence{offence, now})
+}
+
+func (o *Offences) record(uid Userid, offence string) {
+	state.Lock()
+	defer state.Unlock()
+
+	o.recordLocked(uid, offence, time.Now().UTC())
+	state.save()
+}
+
+// count returns how many offences of the user still count, the ones decayed
+// are forgotten for good
+func (o *Offences) count(uid Userid, now time.Time) int {
+	state.Lock()
+	defer state.Unlock()
+
+	before := len(state.offences[uid])
+	history := o.decay(uid, now)
+	if len(history) != before {
+		state.save()
+	}
+	return len(history)
+}
+
+// getEscalatedMuteDuration returns the duration of the next rung of the ladder
+func getEscalatedMuteDuration(prior int) time.Duration {
+	if len(MUTELADDER) == 0 {
+		return DEFAULTMUTEDURATION
+	}
+	if prior >= len(MUTELADDER) {
+		prior = len(MUTELADDER) - 1
+	}
+	return MUTELADDER[prior]
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestOffenceEscalation(t *testing.T) {
+	uid := Userid(60)
+	now := time.Now().UTC()
+	defer func() {
+		state.Lock()
+		delete(state.offences, uid)
+		state.Unlock()
+	}()
+
+	if c := offences.count(uid, now); c != 0 || getEscalatedMuteDuration(c) != MUTELADDER[0] {
+		t.Error("expected a first offence to get the first rung, prior offences:", c)
+	}
+
+	state.Lock()
+	offences.recordLocked(uid, OFFENCEBAN, now.Add(-OFFENCEDECAY-time.Hour))
+	offences.recordLocked(uid, OFFENCEMUTE, now.Add(-time.Hour))
+	offences.recordLocked(uid, OFFENCEMUTE, now)
+	state.Unlock()
+
+	if c := offences.count(uid, now); c != 2 {
+		t.Error("expected the decayed offence to no longer count, got", c)
+	}
+	if d := getEscalatedMuteDuration(2); d != MUTELADDER[2] {
+		t.Error("expected the third rung, got", d)
+	}
+	if d := getEscalatedMuteDuration(len(MUTELADDER) + 5); d != MUTELADDER[len(MUTELADDER)-1] {
+		t.Error("expected the last rung to be used past the end of the ladder, got", d)
+	}
+
+	if c := offences.count(uid, now.Add(OFFENCEDECAY+2*time.Hour)); c != 0 {
+		t.Error("expected every offence to decay eventually, got", c)
+	}
+	state.RLock()
+	_, ok := state.offences[uid]
+	state.RUnlock()
+	if ok {
+		t.Error("expected the user to be forgotten once every offence decayed")
+	}
+}
+
+func TestMuteEscalation(t *testing.T) {
+	setupTestState(t)
+	drainBroadcasts()
+	defer func(old map[string]*modLimit) { modlimits = old }(modlimits)
+	modlimits = map[string]*modLimit{
+		"moderator": {maxmute: 30 * time.Minute},
+	}
+
+	mod := &User{id: Userid(61), nick: "escalatemod"}
+	mod.setFeatures([]string{"moderator"})
+	mod.assembleSimplifiedUser()
+	c := newBotConnection(mod, "127.0.0.1")
+	uid := Userid(62)
+	usertools.addUser(&User{id: uid, nick: "escalated"}, true)
+	defer mutes.unmuteUserid(uid)
+
+	tests := []struct {
+		duration time.Duration
+		extra    MuteExtradata
+	}{
+		{MUTELADDER[0], MuteExtradata{int64(MUTELADDER[0] / time.Second), 0}},
+		// the second rung is longer than the moderator may mute for
+		{30 * time.Minute, MuteExtradata{int64(30 * time.Minute / time.Second), 1}},
+	}
+	for i, test := range tests {
+		before := time.Now().UTC()
+		c.OnMute(&EventDataIn{Data: "escalated"})
+
+		m := getBroadcast(t)
+		out := EventDataOut{}
+		extra := MuteExtradata{}
+		if err := json.Unmarshal(m.data.([]byte), &out); m.event != "MUTE" || err != nil {
+			t.Fatalf("%d expected the mute to be broadcast, got %s %s", i, m.event, m.data)
+		}
+		if err := json.Unmarshal([]byte(out.Extradata), &extra); err != nil || extra != test.extra {
+			t.Error(i, "expected the extradata", test.extra, "got", out.Extradata)
+		}
+		if expiry := getMuteExpiry(uid); expiry.Before(before.Add(test.duration)) || expiry.After(time.Now().UTC().Add(test.duration)) {
+			t.Error(i, "expected the mute to last", test.duration, "got until", expiry)
+		}
+	}
+}
+
+func TestOffencesOnlyFromModerators(t *testing.T) {
+	setupTestState(t)
+	drainBroadcasts()
+	defer drainBroadcasts()
+
+	u := &User{id: Userid(63), nick: "automuted"}
+	u.setFeatures(nil)
+	defer mutes.unmuteUserid(u.id)
+	newBotConnection(u, "127.0.0.1").autoMute(int64(time.Minute))
+	if c := offences.count(u.id, time.Now().UTC()); c != 0 {
+		t.Error("expected the automatic mute to not be an offence, got", c)
+	}
+}
+
+func TestOffenceDecayIsSaved(t *testing.T) {
+	setupTestState(t)
+	uid := Userid(64)
+	now := time.Now().UTC()
+	defer func() {
+		state.Lock()
+		delete(state.offences, uid)
+		state.Unlock()
+	}()
+
+	state.Lock()
+	offences.recordLocked(uid, OFFENCEMUTE, now.Add(-OFFENCEDECAY-time.Hour))
+	state.save()
+	state.Unlock()
+
+	if c := offences.count(uid, now); c != 0 {
+		t.Error("expected the offence to have decayed, got", c)
+	}
+	saved := &State{mutes: make(map[Userid]time.Time), offences: make(map[Userid][]Offence)}
+	saved.load()
+	if _, ok := saved.offences[uid]; ok {
+		t.Error("expected the decay to be saved")
+	}
+}
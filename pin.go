@@ -0,0 +1,167 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// Pin is the pinned message, persisted in the state so it has to be gob
+// encodable, an empty Data means nothing is pinned
+type Pin struct {
+	Nick      string
+	Features  []string
+	Data      string
+	Timestamp int64
+	Expires   time.Time // zero if the pin never expires
+}
+
+func (p *Pin) isActive() bool {
+	return len(p.Data) != 0 && (p.Expires.IsZero() || !isExpiredUTC(p.Expires))
+}
+
+func (p *Pin) out() *EventDataOut {
+	features := p.Features
+	out := &EventDataOut{
+		SimplifiedUser: &SimplifiedUser{
+			Nick:     p.Nick,
+			Features: &features,
+		},
+		Timestamp: p.Timestamp,
+		Data:      p.Data,
+	}
+	if !p.Expires.IsZero() {
+		out.Duration = int64(time.Until(p.Expires) / time.Second)
+	}
+	return out
+}
+
+func initPin() {
+	state.RLock()
+	p := state.pin
+	state.RUnlock()
+
+	if p.isActive() {
+		schedulePinExpiry(p)
+	}
+}
+
+func getPin() (Pin, bool) {
+	state.RLock()
+	defer state.RUnlock()
+	return state.pin, state.pin.isActive()
+}
+
+func setPin(p Pin) {
+	state.Lock()
+	defer state.Unlock()
+
+	state.pin = p
+	state.save()
+}
+
+// schedulePinExpiry unpins the message once it expires, unless it was
+// replaced or unpinned in the meantime
+func schedulePinExpiry(p Pin) {
+	if p.Expires.IsZero() {
+		return
+	}
+
+	time.AfterFunc(time.Until(p.Expires), func() {
+		state.Lock()
+		if state.pin.Timestamp != p.Timestamp || state.pin.Data != p.Data {
+			state.Unlock()
+			return
+		}
+		state.pin = Pin{}
+		state.save()
+		state.Unlock()
+
+		hub.broadcastEvent("UNPIN", &EventDataOut{
+			Timestamp: unixMilliTime(),
+		})
+	})
+}
+
+// Pinned sends the pinned message to the connection, if there is one
+func (c *Connection) Pinned() {
+	p, ok := getPin()
+	if !ok {
+		return
+	}
+
+	data, _ := Marshal(p.out())
+	c.sendmarshalled <- &message{
+		event: "PIN",
+		data:  data,
+	}
+}
+
+func init() {
+	registerCommand(&command{
+		name:       "PIN",
+		help:       "pins a message, with an optional duration",
+		permission: PERMMODERATOR,
+		payload:    newEventDataIn,
+		handler: func(c *Connection, p interface{}) {
+			c.OnPin(p.(*EventDataIn))
+		},
+	})
+	registerCommand(&command{
+		name:       "UNPIN",
+		help:       "unpins the pinned message",
+		permission: PERMMODERATOR,
+		handler: func(c *Connection, _ interface{}) {
+			c.OnUnpin()
+		},
+	})
+}
+
+// newPin makes a pin by the user of the connection, copying the features so
+// that it can be marshalled without holding the lock of the user
+func (c *Connection) newPin(msg string) Pin {
+	c.rlockUserIfExists()
+	defer c.runlockUserIfExists()
+
+	return Pin{
+		Nick:      c.user.nick,
+		Features:  append([]string{}, *c.user.simplified.Features...),
+		Data:      msg,
+		Timestamp: unixMilliTime(),
+	}
+}
+
+// OnPin expects Data to be the message, Duration the optional expiry
+func (c *Connection) OnPin(m *EventDataIn) {
+	msg := strings.TrimSpace(m.Data)
+	if !isValidMessage(msg) {
+		c.SendError("invalidmsg")
+		return
+	}
+
+	if m.Duration < 0 {
+		c.SendError("protocolerror")
+		return
+	}
+
+	p := c.newPin(msg)
+	if m.Duration > 0 {
+		p.Expires = addDurationUTC(time.Duration(m.Duration))
+	}
+
+	setPin(p)
+	schedulePinExpiry(p)
+
+	hub.broadcastEvent("PIN", p.out())
+}
+
+func (c *Connection) OnUnpin() {
+	if _, ok := getPin(); !ok {
+		c.SendError("notfound")
+		return
+	}
+
+	setPin(Pin{})
+
+	p := c.newPin("")
+	hub.broadcastEvent("UNPIN", p.out())
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupTestState keeps the state the test saves out of the working directory
+func setupTestState(t *testing.T) {
+	old := statefile
+	statefile = filepath.Join(t.TempDir(), "state.dc")
+	t.Cleanup(func() { statefile = old })
+}
+
+// drainBroadcasts drops what the earlier tests broadcast, nothing runs the hub
+func drainBroadcasts() {
+	for len(hub.broadcast) > 0 {
+		<-hub.broadcast
+	}
+}
+
+func getBroadcast(t *testing.T) *message {
+	select {
+	case m := <-hub.broadcast:
+		return m
+	case <-time.After(time.Second):
+		t.Fatal("expected a broadcast")
+	}
+	return nil
+}
+
+func TestPinUnpin(t *testing.T) {
+	setupTestState(t)
+	drainBroadcasts()
+	defer setPin(Pin{})
+
+	mod := &User{id: Userid(60), nick: "pinmod"}
+	mod.setFeatures([]string{"moderator"})
+	mod.assembleSimplifiedUser()
+	c := newBotConnection(mod, "127.0.0.1")
+
+	c.OnPin(&EventDataIn{Data: "  read the rules  ", Duration: int64(time.Hour)})
+	m := getBroadcast(t)
+	if data := string(m.data.([]byte)); m.event != "PIN" || !strings.Contains(data, `"data":"read the rules"`) || !strings.Contains(data, `"nick":"pinmod"`) {
+		t.Errorf("expected the pin to be broadcast, got %s %s", m.event, m.data)
+	}
+	p, ok := getPin()
+	if !ok || p.Data != "read the rules" || p.Expires.IsZero() {
+		t.Error("expected the pin to be stored with an expiry, got", p)
+	}
+
+	c.Pinned()
+	if m := <-c.sendmarshalled; m.event != "PIN" || !strings.Contains(string(m.data.([]byte)), "read the rules") {
+		t.Errorf("expected the pin to be sent on connect, got %s %s", m.event, m.data)
+	}
+
+	c.OnPin(&EventDataIn{Data: "no", Duration: -1})
+	if m := <-c.blocksend; m.data.(GenericError).Error() != "protocolerror" {
+		t.Error("expected a negative duration to be rejected, got", m.data)
+	}
+
+	c.OnUnpin()
+	if m := getBroadcast(t); m.event != "UNPIN" || !strings.Contains(string(m.data.([]byte)), `"nick":"pinmod"`) {
+		t.Errorf("expected the unpin to be broadcast, got %s %s", m.event, m.data)
+	}
+	if _, ok := getPin(); ok {
+		t.Error("expected nothing to be pinned")
+	}
+
+	c.Pinned()
+	if len(c.sendmarshalled) != 0 {
+		t.Error("expected nothing to be sent without a pin")
+	}
+
+	c.OnUnpin()
+	if m := <-c.blocksend; m.data.(GenericError).Error() != "notfound" {
+		t.Error("expected unpinning nothing to fail, got", m.data)
+	}
+}
+
+func TestPinExpiry(t *testing.T) {
+	setupTestState(t)
+	drainBroadcasts()
+	defer setPin(Pin{})
+
+	p := Pin{Nick: "pinmod", Data: "soon gone", Timestamp: unixMilliTime(), Expires: addDurationUTC(50 * time.Millisecond)}
+	setPin(p)
+	schedulePinExpiry(p)
+
+	if m := getBroadcast(t); m.event != "UNPIN" {
+		t.Error("expected the expired pin to be unpinned, got", m.event)
+	}
+	if _, ok := getPin(); ok {
+		t.Error("expected the pin to be gone")
+	}
+}
+
+func TestPinNotInScrollback(t *testing.T) {
+	for _, event := range []string{"PIN", "UNPIN", "JOIN", "QUIT", "PURGE"} {
+		if isScrollbackEvent(event) {
+			t.Error("expected the event to not be cached", event)
+		}
+	}
+	if !isScrollbackEvent("MSG") || !isScrollbackEvent("MUTE") {
+		t.Error("expected chat messages and moderation to be cached")
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"strings"
+	"time"
+)
+
+// pipelineMessage is a message making its way through the pipeline, stages
+// can rewrite msg for the stages after them
+type pipelineMessage struct {
+	c      *Connection
+	msg    string
+	target Userid // the recipient of a private message, 0 for chat messages
+}
+
+func (pm *pipelineMessage) isPrivmsg() bool {
+	return pm.target != 0
+}
+
+// messageStage decides about a message, run returns false if the message
+// should go no further, in which case the stage is responsible for telling
+// the user why (or for holding on to the message)
+type messageStage struct {
+	name    string
+	privmsg bool // whether the stage also runs for private messages
+	run     func(pm *pipelineMessage) bool
+}
+
+type messagePipeline struct {
+	stages []*messageStage
+}
+
+var msgpipeline = &messagePipeline{}
+
+// register adds the stage before the stage named before, or at the end if
+// before is empty, meant to be called from init, panics on invalid stages
+func (p *messagePipeline) register(s *messageStage, before string) {
+	for _, st := range p.stages {
+		if st.name == s.name {
+			panic("duplicate message stage: " + s.name)
+		}
+	}
+
+	if len(before) == 0 {
+		p.stages = append(p.stages, s)
+		return
+	}
+
+	for i, st := range p.stages {
+		if st.name == before {
+			p.stages = append(p.stages[:i], append([]*messageStage{s}, p.stages[i:]...)...)
+			return
+		}
+	}
+	panic("unknown message stage: " + before)
+}
+
+// run passes the message through every stage in order, stops at the first
+// stage rejecting it
+func (p *messagePipeline) run(c *Connection, msg string, target Userid) (*pipelineMessage, bool) {
+	return p.runStages(c, msg, target, p.stages)
+}
+
+// resume passes the chat message through the stages after the named one, for
+// the messages that stage held on to, the stage has to exist
+func (p *messagePipeline) resume(c *Connection, msg string, after string) (*pipelineMessage, bool, error) {
+	for i, s := range p.stages {
+		if s.name == after {
+			pm, ok := p.runStages(c, msg, 0, p.stages[i+1:])
+			return pm, ok, nil
+		}
+	}
+	return nil, false, errors.New("unknown message stage: " + after)
+}
+
+func (p *messagePipeline) runStages(c *Connection, msg string, target Userid, stages []*messageStage) (*pipelineMessage, bool) {
+	pm := &pipelineMessage{
+		c:      c,
+		msg:    msg,
+		target: target,
+	}
+
+	for _, s := range stages {
+		if pm.isPrivmsg() && !s.privmsg {
+			continue
+		}
+		if !s.run(pm) {
+			return pm, false
+		}
+	}
+	return pm, true
+}
+
+// registerMessageStage is how custom stages get added to the pipeline
+func registerMessageStage(s *messageStage, before string) {
+	msgpipeline.register(s, before)
+}
+
+// the built-in stages, in order
+func init() {
+	registerMessageStage(&messageStage{"validate", true, validateStage}, "")
+	registerMessageStage(&messageStage{"mute", false, muteStage}, "")
+	registerMessageStage(&messageStage{"submode", false, submodeStage}, "")
+	registerMessageStage(&messageStage{"throttle", true, throttleStage}, "")
+	registerMessageStage(&messageStage{"duplicate", false, duplicateStage}, "")
+	registerMessageStage(&messageStage{"spam", false, spamStage}, "")
+	registerMessageStage(&messageStage{"links", false, linkStage}, "")
+	registerMessageStage(&messageStage{"automod", true, automodStage}, "")
+	registerMessageStage(&messageStage{"nuke", false, nukeStage}, "")
+	registerMessageStage(&messageStage{"shadowban", false, shadowbanStage}, "")
+}
+
+func validateStage(pm *pipelineMessage) bool {
+	if !isValidMessage(pm.msg) {
+		pm.c.SendError("invalidmsg")
+		return false
+	}
+	return true
+}
+
+func muteStage(pm *pipelineMessage) bool {
+	muteTimeLeft := mutes.muteTimeLeft(pm.c)
+	if muteTimeLeft > time.Duration(0) {
+		pm.c.EmitBlock("ERR", NewMutedError(muteTimeLeft))
+		return false
+	}
+	return true
+}
+
+func submodeStage(pm *pipelineMessage) bool {
+	if !hub.canUserSpeak(pm.c) {
+		pm.c.SendError("submode")
+		return false
+	}
+	return true
+}
+
+// throttleStage takes a token for every message, the bucket refills at a rate
+// depending on the role of the user, flooding or duplicates drain it faster
+func throttleStage(pm *pipelineMessage) bool {
+	u := pm.c.user
+	if u == nil {
+		return true
+	}
+
+	wait := u.throttle.take(getThrottleConfig(u), time.Now())
+	if wait > 0 {
+		pm.c.EmitBlock("ERR", NewThrottledError(wait))
+		return false
+	}
+	return true
+}
+
+func duplicateStage(pm *pipelineMessage) bool {
+	u := pm.c.user
+	if u == nil {
+		return true
+	}
+
+	// strip off /me for anti-spam purposes
+	var bmsg []byte
+	if len(pm.msg) > 4 && pm.msg[:4] == "/me " {
+		bmsg = []byte(strings.TrimSpace(pm.msg[4:]))
+	} else {
+		bmsg = []byte(pm.msg)
+	}
+
+	tsum := md5.Sum(bmsg)
+	sum := tsum[:]
+	if !u.isBot() && bytes.Equal(sum, u.lastmessage) {
+		u.throttle.penalize(getThrottleConfig(u), DUPLICATEPENALTY, time.Now())
+		pm.c.SendError("duplicate")
+		return false
+	}
+	u.lastmessage = sum
+	return true
+}
+
+func spamStage(pm *pipelineMessage) bool {
+	return pm.c.checkSpam(pm.msg)
+}
+
+func automodStage(pm *pipelineMessage) bool {
+	msg, ok := automod.check(pm.c, pm.msg, pm.isPrivmsg())
+	pm.msg = msg
+	return ok
+}
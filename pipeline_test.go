@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPipelineOrder(t *testing.T) {
+	ran := make([]string, 0)
+	stage := func(name string, privmsg bool, ok bool) *messageStage {
+		return &messageStage{name, privmsg, func(pm *pipelineMessage) bool {
+			ran = append(ran, name)
+			pm.msg = strings.ToUpper(pm.msg)
+			return ok
+		}}
+	}
+
+	p := &messagePipeline{}
+	p.register(stage("first", true, true), "")
+	p.register(stage("last", true, true), "")
+	p.register(stage("middle", false, true), "last")
+
+	pm, ok := p.run(&Connection{}, "hello", 0)
+	if !ok || pm.msg != "HELLO" || strings.Join(ran, ",") != "first,middle,last" {
+		t.Error("expected every stage to run in order, got", ran, pm.msg)
+	}
+
+	ran = ran[:0]
+	if _, ok := p.run(&Connection{}, "hello", Userid(1)); !ok || strings.Join(ran, ",") != "first,last" {
+		t.Error("expected only the privmsg stages to run for private messages, got", ran)
+	}
+
+	p.register(stage("reject", true, false), "middle")
+	ran = ran[:0]
+	if _, ok := p.run(&Connection{}, "hello", 0); ok || strings.Join(ran, ",") != "first,reject" {
+		t.Error("expected the pipeline to stop at the rejecting stage, got", ran)
+	}
+
+	ran = ran[:0]
+	if _, ok, err := p.resume(&Connection{}, "hello", "middle"); err != nil || !ok || strings.Join(ran, ",") != "last" {
+		t.Error("expected only the stages after the held one to run, got", ran, ok, err)
+	}
+	ran = ran[:0]
+	if _, ok, err := p.resume(&Connection{}, "hello", "unknown"); err == nil || ok || len(ran) != 0 {
+		t.Error("expected an unknown stage to be an error, got", ran, ok, err)
+	}
+}
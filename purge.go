@@ -0,0 +1,40 @@
+package main
+
+func init() {
+	registerCommand(&command{
+		name:       "PURGE",
+		help:       "removes the recent messages of a user",
+		permission: PERMMODERATOR,
+		bot:        true,
+		payload:    newEventDataIn,
+		handler: func(c *Connection, p interface{}) {
+			c.OnPurge(p.(*EventDataIn))
+		},
+	})
+}
+
+// purgeUser removes the messages of the user from the scrollback and tells
+// the clients to hide them too
+func (c *Connection) purgeUser(nick string, uid Userid) {
+	removed := purgeChatlog(nick)
+	D("Purged", removed, "lines of", nick, "by", c.user.nick)
+
+	out := c.getEventDataOut()
+	out.Data = nick
+	out.Targetuserid = uid
+	c.Broadcast("PURGE", out)
+}
+
+// OnPurge expects Data to be the nick
+func (c *Connection) OnPurge(m *EventDataIn) {
+	ok, uid := c.canModerateUser(m.Data)
+	if uid == 0 {
+		c.SendError("notfound")
+		return
+	} else if !ok {
+		c.SendError("nopermission")
+		return
+	}
+
+	c.purgeUser(m.Data, uid)
+}
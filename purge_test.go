@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func cacheTestLines(lines ...string) {
+	for _, line := range lines {
+		parts := strings.SplitN(line, " ", 2)
+		cacheChatEvent(&message{event: parts[0], data: []byte(parts[1])})
+	}
+}
+
+func getTestScrollback(t *testing.T) []string {
+	conn := redisGetConn()
+	defer conn.Return()
+
+	lines, err := conn.DoStrings("LRANGE", "CHAT:chatlog", 0, -1)
+	if err != nil {
+		t.Fatal("unable to read the scrollback", err)
+	}
+	return lines
+}
+
+func TestPurgeChatlog(t *testing.T) {
+	setupTestRedis(t)
+
+	cacheTestLines(
+		`MSG {"nick":"Spammer","data":"spam"}`,
+		`MSG {"nick":"other","data":"hello"}`,
+		`MSG {"nick":"Spammer","data":"spam"}`,
+		`MUTE {"nick":"mod","data":"Spammer"}`,
+		`MSG {"nick":"spammer","data":"more spam"}`,
+		`MSG {"nick":"spammer2","data":"not the same user"}`,
+		`MSG not json`,
+	)
+
+	if removed := purgeChatlog("SPAMMER"); removed != 3 {
+		t.Error("expected the three messages of the user to be removed, got", removed)
+	}
+
+	lines := getTestScrollback(t)
+	expected := []string{
+		`MSG {"nick":"other","data":"hello"}`,
+		`MUTE {"nick":"mod","data":"Spammer"}`,
+		`MSG {"nick":"spammer2","data":"not the same user"}`,
+		`MSG not json`,
+	}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected only the other lines to be kept in order, got %q", lines)
+	}
+
+	if removed := purgeChatlog("nobody"); removed != 0 {
+		t.Error("expected nothing to be removed, got", removed)
+	}
+}
+
+func TestOnPurge(t *testing.T) {
+	setupTestRedis(t)
+	mock := setupTestDatabase(t)
+	drainBroadcasts()
+
+	mod := &User{id: Userid(80), nick: "purgemod"}
+	mod.setFeatures([]string{"moderator"})
+	mod.assembleSimplifiedUser()
+	c := newBotConnection(mod, "127.0.0.1")
+
+	target := &User{id: Userid(81), nick: "purged"}
+	target.setFeatures(nil)
+	usertools.addUser(target, true)
+	admin := &User{id: Userid(82), nick: "purgeadmin"}
+	admin.setFeatures([]string{"admin"})
+	usertools.addUser(admin, true)
+
+	cacheTestLines(`MSG {"nick":"purged","data":"spam"}`, `MSG {"nick":"purgemod","data":"stop"}`)
+
+	mock.ExpectPrepare("FROM dfl_users").ExpectQuery().
+		WillReturnRows(sqlmock.NewRows([]string{"userId", "protected"}))
+	c.OnPurge(&EventDataIn{Data: "nosuchuser"})
+	if m := <-c.blocksend; m.data.(GenericError).Error() != "notfound" {
+		t.Error("expected an unknown user to not be found, got", m.data)
+	}
+	c.OnPurge(&EventDataIn{Data: "purgeadmin"})
+	if m := <-c.blocksend; m.data.(GenericError).Error() != "nopermission" {
+		t.Error("expected a protected user to not be purged, got", m.data)
+	}
+	if len(hub.broadcast) != 0 || len(getTestScrollback(t)) != 2 {
+		t.Fatal("expected nothing to be purged")
+	}
+
+	c.OnPurge(&EventDataIn{Data: "purged"})
+	m := getBroadcast(t)
+	if data := string(m.data.([]byte)); m.event != "PURGE" || !strings.Contains(data, `"data":"purged"`) || !strings.Contains(data, `"nick":"purgemod"`) {
+		t.Errorf("expected the purge to be broadcast, got %s %s", m.event, m.data)
+	}
+	if lines := getTestScrollback(t); len(lines) != 1 || !strings.Contains(lines[0], "purgemod") {
+		t.Error("expected only the message of the moderator to be left, got", lines)
+	}
+}
+
+func TestMuteWithPurge(t *testing.T) {
+	setupTestRedis(t)
+	setupTestState(t)
+	drainBroadcasts()
+
+	mod := &User{id: Userid(83), nick: "mutepurgemod"}
+	mod.setFeatures([]string{"moderator"})
+	mod.assembleSimplifiedUser()
+	c := newBotConnection(mod, "127.0.0.1")
+	usertools.addUser(&User{id: Userid(84), nick: "mutepurged"}, true)
+	defer mutes.unmuteUserid(Userid(84))
+
+	cacheTestLines(`MSG {"nick":"mutepurged","data":"spam"}`)
+
+	c.OnMute(&EventDataIn{Data: "mutepurged", Duration: int64(DEFAULTMUTEDURATION), Purge: true})
+	if m := getBroadcast(t); m.event != "MUTE" {
+		t.Error("expected the mute to be broadcast first, got", m.event)
+	}
+	if m := getBroadcast(t); m.event != "PURGE" {
+		t.Error("expected the purge to be broadcast, got", m.event)
+	}
+	if lines := getTestScrollback(t); len(lines) != 0 {
+		t.Error("expected the scrollback to be purged, got", lines)
+	}
+}
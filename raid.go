@@ -0,0 +1,281 @@
+package main
+
+import (
+	"strings"
+	"time"
+	"unicode"
+
+	conf "github.com/msbranco/goconfig"
+)
+
+// the raid detector tracks what every user says in a sliding window, if enough
+// distinct users post near-identical messages it alerts the moderators and
+// optionally protects the chat
+var (
+	raidenabled        = true
+	RAIDWINDOW         = 30 * time.Second
+	RAIDUSERS          = 10  // how many distinct users make a wave
+	RAIDMINLENGTH      = 20  // messages shorter than this (after normalization) are ignored
+	RAIDSIMILARITY     = 0.7 // shingle similarity above which messages belong to the same wave
+	RAIDALERTINTERVAL  = 2 * time.Minute
+	raidsubmode        = false            // turn on submode when a wave is detected
+	RAIDMUTEACCOUNTAGE = time.Duration(0) // mute participants whose account is younger than this, 0 disables
+	RAIDMUTEDURATION   = int64(DEFAULTMUTEDURATION)
+)
+
+func readRaidConfig(c *conf.ConfigFile) {
+	raidenabled, _ = c.GetBool("raid", "enabled")
+	raidsubmode, _ = c.GetBool("raid", "submode")
+	// the window is checked every half of it, so it cannot be too short
+	if v, err := c.GetInt64("raid", "window"); err == nil && time.Duration(v) >= time.Second {
+		RAIDWINDOW = time.Duration(v)
+	} else if err == nil {
+		D("Ignoring raid window shorter than a second:", v)
+	}
+	if v, err := c.GetInt64("raid", "users"); err == nil {
+		RAIDUSERS = int(v)
+	}
+	if v, err := c.GetInt64("raid", "minlength"); err == nil {
+		RAIDMINLENGTH = int(v)
+	}
+	if v, err := c.GetFloat("raid", "similarity"); err == nil {
+		RAIDSIMILARITY = v
+	}
+	if v, err := c.GetInt64("raid", "muteaccountage"); err == nil {
+		RAIDMUTEACCOUNTAGE = time.Duration(v)
+	}
+	if v, err := c.GetInt64("raid", "muteduration"); err == nil {
+		RAIDMUTEDURATION = v
+	}
+}
+
+type raidMessage struct {
+	uid  Userid
+	nick string
+	msg  string
+}
+
+type raidEntry struct {
+	wave      uint64
+	uid       Userid
+	timestamp time.Time
+}
+
+type raidWave struct {
+	users     map[Userid]int // how many messages of the user are in the window
+	nicks     map[Userid]string
+	sample    string
+	shingles  map[string]struct{} // of the first message of the wave
+	alerted   time.Time
+	triggered bool
+}
+
+type RaidDetector struct {
+	messages chan *raidMessage
+	window   []raidEntry
+	waves    map[uint64]*raidWave
+	waveid   uint64
+}
+
+type RaidOut struct {
+	Data      string   `json:"data"`
+	Users     int      `json:"users"`
+	Nicks     []string `json:"nicks"`
+	Muted     []string `json:"muted,omitempty"`
+	Submode   bool     `json:"submode,omitempty"`
+	Timestamp int64    `json:"timestamp"`
+}
+
+var raids = RaidDetector{
+	messages: make(chan *raidMessage, BROADCASTCHANNELSIZE),
+	waves:    make(map[uint64]*raidWave),
+}
+
+func initRaidDetector() {
+	go raids.run()
+}
+
+func (rd *RaidDetector) run() {
+	t := time.NewTicker(RAIDWINDOW / 2)
+	for {
+		select {
+		case m := <-rd.messages:
+			rd.check(m, time.Now())
+		case now := <-t.C:
+			rd.prune(now)
+		}
+	}
+}
+
+// track hands the message over to the detector, never blocks, if the
+// detector is lagging behind the message is just not considered
+func (rd *RaidDetector) track(u *User, msg string) {
+	if !raidenabled || u == nil || u.isBot() {
+		return
+	}
+
+	select {
+	case rd.messages <- &raidMessage{u.id, u.nick, msg}:
+	default:
+		D("Raid detector is lagging, dropping message of", u.nick)
+	}
+}
+
+// raidNormalize lowercases the message and keeps only the letters and digits
+// of the words, so punctuation and spacing make no difference
+func raidNormalize(msg string) string {
+	b := make([]rune, 0, len(msg))
+	for _, r := range strings.ToLower(msg) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b = append(b, r)
+		case unicode.IsSpace(r):
+			b = append(b, ' ')
+		}
+	}
+	return strings.Join(strings.Fields(string(b)), " ")
+}
+
+func (rd *RaidDetector) prune(now time.Time) {
+	i := 0
+	for ; i < len(rd.window); i++ {
+		e := rd.window[i]
+		if now.Sub(e.timestamp) <= RAIDWINDOW {
+			break
+		}
+
+		w := rd.waves[e.wave]
+		w.users[e.uid]--
+		if w.users[e.uid] <= 0 {
+			delete(w.users, e.uid)
+			delete(w.nicks, e.uid)
+		}
+		if len(w.users) == 0 {
+			delete(rd.waves, e.wave)
+		}
+	}
+	rd.window = rd.window[i:]
+}
+
+// add records the message and returns the wave it belongs to
+func (rd *RaidDetector) add(m *raidMessage, now time.Time) *raidWave {
+	rd.prune(now)
+
+	normalized := raidNormalize(m.msg)
+	if len(normalized) < RAIDMINLENGTH {
+		return nil
+	}
+
+	// the message joins the most similar wave, the same shingles the spam
+	// heuristics use, so a changed word or an added suffix does not escape it
+	sh := shingles(normalized)
+	var id uint64
+	best := 0.0
+	for wid, w := range rd.waves {
+		if s := similarity(sh, w.shingles); s >= RAIDSIMILARITY && s > best {
+			id, best = wid, s
+		}
+	}
+
+	w, ok := rd.waves[id]
+	if !ok {
+		rd.waveid++
+		id = rd.waveid
+		w = &raidWave{
+			users:    make(map[Userid]int),
+			nicks:    make(map[Userid]string),
+			sample:   m.msg,
+			shingles: sh,
+		}
+		rd.waves[id] = w
+	}
+
+	w.users[m.uid]++
+	w.nicks[m.uid] = m.nick
+	rd.window = append(rd.window, raidEntry{id, m.uid, now})
+	return w
+}
+
+func (rd *RaidDetector) check(m *raidMessage, now time.Time) {
+	w := rd.add(m, now)
+	if w == nil || len(w.users) < RAIDUSERS {
+		return
+	}
+
+	var muted []string
+	submode := false
+	if w.triggered {
+		// the wave is already known, only deal with the newcomer
+		if rd.muteParticipant(m.uid, m.nick) {
+			muted = append(muted, m.nick)
+		}
+		if now.Sub(w.alerted) < RAIDALERTINTERVAL && len(muted) == 0 {
+			return
+		}
+	} else {
+		w.triggered = true
+		for uid, nick := range w.nicks {
+			if rd.muteParticipant(uid, nick) {
+				muted = append(muted, nick)
+			}
+		}
+
+		if raidsubmode && !hub.isSubmode() {
+			submode = true
+			hub.toggleSubmode(true)
+			hub.broadcastEvent("SUBONLY", &EventDataOut{
+				Timestamp: unixMilliTime(),
+				Data:      "on",
+			})
+		}
+	}
+	w.alerted = now
+
+	nicks := make([]string, 0, len(w.nicks))
+	for _, nick := range w.nicks {
+		nicks = append(nicks, nick)
+	}
+
+	P("Raid wave detected,", len(w.users), "users posted:", w.sample)
+	hub.broadcastModerators("RAID", &RaidOut{
+		Data:      w.sample,
+		Users:     len(w.users),
+		Nicks:     nicks,
+		Muted:     muted,
+		Submode:   submode,
+		Timestamp: unixMilliTime(),
+	})
+}
+
+// the raid mutes are made by the server itself, which may only target the
+// users without a role
+var raidmodlimit = &modLimit{targets: []string{}}
+
+// muteParticipant mutes the user if its account is new enough, the users with
+// a role are exempt, a longer mute the user already has is kept
+func (rd *RaidDetector) muteParticipant(uid Userid, nick string) bool {
+	if RAIDMUTEACCOUNTAGE <= 0 {
+		return false
+	}
+
+	if !raidmodlimit.canTarget(getTargetRoles(uid)) {
+		return false
+	}
+
+	created := usertools.getAccountCreated(uid)
+	if created.IsZero() || time.Since(created) > RAIDMUTEACCOUNTAGE {
+		return false
+	}
+
+	expires := time.Now().UTC().Add(time.Duration(RAIDMUTEDURATION))
+	if len(mutes.extendMutes(map[Userid]string{uid: nick}, expires)) == 0 {
+		return false
+	}
+	hub.broadcastEvent("MUTE", &EventDataOut{
+		Timestamp:    unixMilliTime(),
+		Targetuserid: uid,
+		Data:         nick,
+		Duration:     RAIDMUTEDURATION / int64(time.Second),
+	})
+	return true
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	conf "github.com/msbranco/goconfig"
+)
+
+func TestRaidWave(t *testing.T) {
+	rd := &RaidDetector{
+		waves: make(map[uint64]*raidWave),
+	}
+	now := time.Now()
+	msg := "this chat is now under new management everyone"
+
+	var w *raidWave
+	for i := 1; i <= 3; i++ {
+		w = rd.add(&raidMessage{Userid(i), "user", msg}, now)
+	}
+	// the same user repeating itself does not count twice, neither does
+	// slightly different punctuation or casing
+	w = rd.add(&raidMessage{Userid(3), "user", "THIS chat is now under new management, everyone!!"}, now)
+	if w == nil || len(w.users) != 3 {
+		t.Fatalf("wave should have 3 distinct users, was %+v", w)
+	}
+
+	// a changed word or an added suffix still belongs to the wave
+	w = rd.add(&raidMessage{Userid(4), "user", "this chat is now under new management everybody"}, now)
+	w = rd.add(&raidMessage{Userid(5), "user", msg + " lol xd"}, now)
+	if w == nil || len(w.users) != 5 || len(rd.waves) != 1 {
+		t.Fatalf("near-identical messages should join the wave, was %+v with %d waves", w, len(rd.waves))
+	}
+	if w = rd.add(&raidMessage{Userid(6), "user", "does anybody know when the stream starts today"}, now); w == nil || len(rd.waves) != 2 {
+		t.Error("an unrelated message should start its own wave")
+	}
+
+	if w = rd.add(&raidMessage{Userid(7), "user", "short"}, now); w != nil {
+		t.Error("short messages should not be tracked")
+	}
+
+	rd.prune(now.Add(RAIDWINDOW + time.Second))
+	if len(rd.waves) != 0 || len(rd.window) != 0 {
+		t.Errorf("waves should be pruned after the window passed, %d waves %d entries left", len(rd.waves), len(rd.window))
+	}
+}
+
+func TestRaidMuteParticipant(t *testing.T) {
+	setupTestState(t)
+	drainBroadcasts()
+	defer drainBroadcasts()
+	defer func(age time.Duration) { RAIDMUTEACCOUNTAGE = age }(RAIDMUTEACCOUNTAGE)
+	RAIDMUTEACCOUNTAGE = time.Hour
+
+	rd := &RaidDetector{}
+	users := map[string]*User{}
+	for i, features := range [][]string{nil, {"flair1"}, {"vip"}, {"moderator"}} {
+		u := &User{id: Userid(100 + i), nick: "raider" + strconv.Itoa(i)}
+		u.setFeatures(features)
+		u.assembleSimplifiedUser()
+		namescache.attach(u)
+		usertools.createdlock.Lock()
+		usertools.created[u.id] = time.Now().Add(-time.Minute)
+		usertools.createdlock.Unlock()
+		users[u.nick] = u
+		defer mutes.unmuteUserid(u.id)
+	}
+
+	// a longer mute is not shortened by the raid mute
+	mutes.muteUserid(users["raider1"].id, int64(24*time.Hour))
+	longer := getMuteExpiry(users["raider1"].id)
+
+	for nick, u := range users {
+		muted := rd.muteParticipant(u.id, nick)
+		if nick == "raider1" {
+			if muted || !getMuteExpiry(u.id).Equal(longer) {
+				t.Error("expected the longer mute to be kept")
+			}
+			continue
+		}
+		if expected := nick == "raider0"; muted != expected || isMuted(u.id) != expected {
+			t.Error("expected only the users without a role to be muted", nick, muted)
+		}
+	}
+}
+
+func TestRaidWindowConfig(t *testing.T) {
+	defer func(window time.Duration, enabled, submode bool) {
+		RAIDWINDOW, raidenabled, raidsubmode = window, enabled, submode
+	}(RAIDWINDOW, raidenabled, raidsubmode)
+
+	for _, v := range []string{"0", "1"} {
+		c := conf.NewConfigFile()
+		c.AddSection("raid")
+		c.AddOption("raid", "window", v)
+		readRaidConfig(c)
+		if RAIDWINDOW < time.Second {
+			t.Error("expected a window too short to tick to be ignored, got", RAIDWINDOW)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	conf "github.com/msbranco/goconfig"
+)
+
+// bucketConfig describes a token bucket: it holds at most burst tokens and
+// refills at rate tokens per second, every message costs one token
+// a burst of 0 means there is no limit at all
+type bucketConfig struct {
+	burst float64
+	rate  float64
+}
+
+// the roles the throttle is configured for, checked in this order
+const (
+	ROLEBOT        = "bot"
+	ROLEMODERATOR  = "moderator"
+	ROLEVIP        = "vip"
+	ROLESUBSCRIBER = "subscriber"
+	ROLEUSER       = "user"
+	ROLEANON       = "anon"
+)
+
+var (
+	throttleconfig = map[string]*bucketConfig{
+		ROLEANON:       {2, 0.5},
+		ROLEUSER:       {4, 1.5},
+		ROLESUBSCRIBER: {5, 2},
+		ROLEVIP:        {6, 2.5},
+		ROLEMODERATOR:  {10, 5},
+		ROLEBOT:        {0, 0},
+	}
+	// how many tokens a duplicate message or a message scored as spam costs
+	// on top of the token the message itself cost
+	DUPLICATEPENALTY = 1.0
+	SPAMPENALTY      = 3.0
+)
+
+// the longest a user is ever told to wait
+const MAXTHROTTLEWAIT = time.Minute
+
+type bucketState struct {
+	tokens  float64
+	last    time.Time
+	started bool
+}
+
+type tokenBucket struct {
+	bucketState
+	sync.Mutex
+}
+
+func readThrottleConfig(c *conf.ConfigFile) {
+	for role, bc := range throttleconfig {
+		if v, err := c.GetFloat("throttle", role+"burst"); err == nil {
+			bc.burst = v
+		}
+		if v, err := c.GetFloat("throttle", role+"rate"); err == nil {
+			bc.rate = v
+		}
+	}
+	if v, err := c.GetFloat("throttle", "duplicatepenalty"); err == nil {
+		DUPLICATEPENALTY = v
+	}
+	if v, err := c.GetFloat("throttle", "spampenalty"); err == nil {
+		SPAMPENALTY = v
+	}
+}
+
+func addThrottleConfigDefaults(nc *conf.ConfigFile) {
+	nc.AddSection("throttle")
+	for _, role := range []string{ROLEANON, ROLEUSER, ROLESUBSCRIBER, ROLEVIP, ROLEMODERATOR, ROLEBOT} {
+		bc := throttleconfig[role]
+		nc.AddOption("throttle", role+"burst", fmt.Sprintf("%g", bc.burst))
+		nc.AddOption("throttle", role+"rate", fmt.Sprintf("%g", bc.rate))
+	}
+	nc.AddOption("throttle", "duplicatepenalty", fmt.Sprintf("%g", DUPLICATEPENALTY))
+	nc.AddOption("throttle", "spampenalty", fmt.Sprintf("%g", SPAMPENALTY))
+}
+
+func getThrottleRole(u *User) string {
+	switch {
+	case u == nil:
+		return ROLEANON
+	case u.isBot():
+		return ROLEBOT
+	case u.isModerator():
+		return ROLEMODERATOR
+	case u.hasFeature("vip"):
+		return ROLEVIP
+	case u.isSubscriber():
+		return ROLESUBSCRIBER
+	}
+	return ROLEUSER
+}
+
+func getThrottleConfig(u *User) *bucketConfig {
+	return throttleconfig[getThrottleRole(u)]
+}
+
+func (tb *tokenBucket) getState() bucketState {
+	tb.Lock()
+	defer tb.Unlock()
+	return tb.bucketState
+}
+
+func (tb *tokenBucket) setState(s bucketState) {
+	tb.Lock()
+	defer tb.Unlock()
+	tb.bucketState = s
+}
+
+// refill expects the lock to be held
+func (tb *tokenBucket) refill(bc *bucketConfig, now time.Time) {
+	if !tb.started {
+		tb.tokens = bc.burst
+		tb.last = now
+		tb.started = true
+		return
+	}
+
+	tb.tokens += now.Sub(tb.last).Seconds() * bc.rate
+	if tb.tokens > bc.burst {
+		tb.tokens = bc.burst
+	}
+	tb.last = now
+}
+
+// take tries to take a token out of the bucket, if there are none left it
+// returns how long until the next one is available
+func (tb *tokenBucket) take(bc *bucketConfig, now time.Time) time.Duration {
+	if bc.burst <= 0 {
+		return 0
+	}
+
+	tb.Lock()
+	defer tb.Unlock()
+
+	tb.refill(bc, now)
+	if tb.tokens >= 1 {
+		tb.tokens--
+		return 0
+	}
+
+	if bc.rate <= 0 {
+		// never refills, should not happen with a sane config
+		return MAXTHROTTLEWAIT
+	}
+	wait := time.Duration((1 - tb.tokens) / bc.rate * float64(time.Second))
+	if wait > MAXTHROTTLEWAIT {
+		wait = MAXTHROTTLEWAIT
+	}
+	return wait
+}
+
+// penalize takes the given amount of tokens out of the bucket, the bucket can
+// go into debt up to its burst size, which is the maximum penalty
+func (tb *tokenBucket) penalize(bc *bucketConfig, tokens float64, now time.Time) {
+	if bc.burst <= 0 {
+		return
+	}
+
+	tb.Lock()
+	defer tb.Unlock()
+
+	tb.refill(bc, now)
+	tb.tokens -= tokens
+	if tb.tokens < -bc.burst {
+		tb.tokens = -bc.burst
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	bc := &bucketConfig{burst: 3, rate: 1}
+	tb := &tokenBucket{}
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if wait := tb.take(bc, now); wait != 0 {
+			t.Fatalf("message %d should fit in the burst, had to wait %v", i, wait)
+		}
+	}
+
+	wait := tb.take(bc, now)
+	if wait <= 0 || wait > time.Second {
+		t.Error("empty bucket should make the user wait at most a second, was", wait)
+	}
+
+	now = now.Add(time.Second)
+	if wait := tb.take(bc, now); wait != 0 {
+		t.Error("bucket should have refilled a token after a second, had to wait", wait)
+	}
+
+	// the penalty is capped, no matter how many times it is applied
+	for i := 0; i < 100; i++ {
+		tb.penalize(bc, 1, now)
+	}
+	wait = tb.take(bc, now)
+	if wait != 4*time.Second {
+		t.Error("maximum penalty should be the burst size worth of refill, was", wait)
+	}
+
+	if wait := tb.take(&bucketConfig{}, now); wait != 0 {
+		t.Error("a bucket without a burst size should never throttle, had to wait", wait)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	conf "github.com/msbranco/goconfig"
+)
+
+// the permissions a command can require, PERMANYONE and PERMUSER are implied,
+// everything else has to be granted by the role of one of the features of the
+// user
+const (
+	PERMANYONE         = "anyone"
+	PERMUSER           = "user"
+	PERMSUBSCRIBER     = "subscriber" // can speak in submode
+	PERMMODERATOR      = "moderator"  // can use the moderator commands
+	PERMADMIN          = "admin"
+	PERMMUTE           = "mute"
+	PERMBAN            = "ban"
+	PERMBROADCAST      = "broadcast"
+	PERMSUBONLY        = "subonly"
+	PERMBYPASSTHROTTLE = "bypass-throttle" // exempt from ratelimiting and anti-spam
+	PERMPROTECTED      = "protected"       // cannot be moderated
+	PERMBOT            = "bot"             // can use the bot api
+)
+
+var knownpermissions = map[string]bool{
+	PERMSUBSCRIBER:     true,
+	PERMMODERATOR:      true,
+	PERMADMIN:          true,
+	PERMMUTE:           true,
+	PERMBAN:            true,
+	PERMBROADCAST:      true,
+	PERMSUBONLY:        true,
+	PERMBYPASSTHROTTLE: true,
+	PERMPROTECTED:      true,
+	PERMBOT:            true,
+}
+
+// defaultroles maps the features to the permissions they grant, features
+// without a role (like the flairs) grant nothing and are only passed on to the
+// clients, can be overridden and extended in the [roles] section of the config
+var defaultroles = map[string][]string{
+	"protected":  {PERMPROTECTED},
+	"subscriber": {PERMSUBSCRIBER},
+	"vip":        {PERMSUBSCRIBER},
+	"moderator":  {PERMSUBSCRIBER, PERMMODERATOR, PERMMUTE, PERMBAN, PERMSUBONLY},
+	"admin":      {PERMSUBSCRIBER, PERMMODERATOR, PERMMUTE, PERMBAN, PERMSUBONLY, PERMBROADCAST, PERMADMIN, PERMPROTECTED},
+	"bot":        {PERMSUBSCRIBER, PERMMODERATOR, PERMMUTE, PERMBAN, PERMSUBONLY, PERMBYPASSTHROTTLE, PERMBOT},
+}
+
+// roles are the defaultroles with the config applied, never modified, only
+// replaced as a whole under the rolelock when the config is reloaded
+var (
+	roles    = defaultroles
+	rolelock sync.RWMutex
+)
+
+func getRoles() map[string][]string {
+	rolelock.RLock()
+	defer rolelock.RUnlock()
+	return roles
+}
+
+// the order the features are sent to the clients in, the ones not listed come
+// after, sorted by name
+var featureorder = []string{"protected", "subscriber", "vip", "moderator", "admin", "bot"}
+
+func readRoleConfig(c *conf.ConfigFile) {
+	newroles := make(map[string][]string, len(defaultroles))
+	for feature, perms := range defaultroles {
+		newroles[feature] = perms
+	}
+
+	options, _ := c.GetOptions("roles")
+	for _, feature := range options {
+		v, err := c.GetString("roles", feature)
+		if err != nil {
+			continue
+		}
+
+		perms := splitConfigList(strings.ToLower(v))
+		for _, perm := range perms {
+			if !knownpermissions[perm] {
+				F("Unknown permission for role", feature, perm)
+			}
+		}
+		newroles[strings.ToLower(feature)] = perms
+	}
+	usertools.setRoles(newroles)
+}
+
+// reloadRoleConfig reads the roles and the moderation limits from the config
+// file again, the users keep their features but get the new permissions
+func reloadRoleConfig(file string) {
+	c, err := conf.ReadConfigFile(file)
+	if err != nil {
+		D("Unable to reload the roles from", file, err)
+		return
+	}
+
+	readRoleConfig(c)
+	readModLimitConfig(c)
+	namescache.refreshRoles()
+	P("Reloaded the roles from", file)
+}
+
+func addRoleConfigDefaults(nc *conf.ConfigFile) {
+	nc.AddSection("roles")
+	for _, feature := range featureorder {
+		nc.AddOption("roles", feature, strings.Join(defaultroles[feature], ", "))
+	}
+}
+
+// getProtectedFeatures returns the features that make a user protected
+func getProtectedFeatures() []string {
+	features := make([]string, 0)
+	for feature, perms := range getRoles() {
+		for _, perm := range perms {
+			if perm == PERMPROTECTED {
+				features = append(features, feature)
+				break
+			}
+		}
+	}
+	sort.Strings(features)
+	return features
+}
+
+// roleSet is what a combination of features amounts to, shared by every user
+// with the same features
+type roleSet struct {
+	features    []string
+	permissions map[string]bool
+}
+
+func isKnownFeature(feature string) bool {
+	if _, ok := getRoles()[feature]; ok {
+		return true
+	}
+	return strings.HasPrefix(feature, "flair") && len(feature) > len("flair")
+}
+
+func getFeatureRank(feature string) int {
+	for i, f := range featureorder {
+		if f == feature {
+			return i
+		}
+	}
+	return len(featureorder)
+}
+
+// sortFeatures sorts the features in place, flairN before flairNN
+func sortFeatures(features []string) {
+	sort.Slice(features, func(i, j int) bool {
+		a, b := features[i], features[j]
+		if ra, rb := getFeatureRank(a), getFeatureRank(b); ra != rb {
+			return ra < rb
+		}
+		if len(a) != len(b) {
+			return len(a) < len(b)
+		}
+		return a < b
+	})
+}
+
+// getRoleSet returns the role set of the features, unknown features are ignored
+func (ut *userTools) getRoleSet(features []string) *roleSet {
+	f := make([]string, 0, len(features))
+	seen := make(map[string]bool)
+	for _, feature := range features {
+		if seen[feature] {
+			continue
+		}
+		seen[feature] = true
+		if !isKnownFeature(feature) {
+			D("Ignoring unknown feature:", feature)
+			continue
+		}
+		f = append(f, feature)
+	}
+	sortFeatures(f)
+	key := strings.Join(f, ",")
+
+	ut.featurelock.RLock()
+	rs, ok := ut.features[key]
+	ut.featurelock.RUnlock()
+	if ok {
+		return rs
+	}
+
+	// the set is built under the lock so that a reload cannot happen halfway
+	ut.featurelock.Lock()
+	defer ut.featurelock.Unlock()
+	// somebody else could have gotten here first, keep sharing the same one
+	if existing, ok := ut.features[key]; ok {
+		return existing
+	}
+
+	rs = &roleSet{
+		features:    f,
+		permissions: make(map[string]bool),
+	}
+	r := getRoles()
+	for _, feature := range f {
+		for _, perm := range r[feature] {
+			rs.permissions[perm] = true
+		}
+	}
+	ut.features[key] = rs
+	return rs
+}
+
+// setRoles replaces the roles and forgets every role set built from the old
+// ones
+func (ut *userTools) setRoles(newroles map[string][]string) {
+	ut.featurelock.Lock()
+	defer ut.featurelock.Unlock()
+
+	rolelock.Lock()
+	roles = newroles
+	rolelock.Unlock()
+	ut.features = make(map[string]*roleSet)
+}
+
+func hasPermission(u *User, perm string) bool {
+	switch perm {
+	case PERMANYONE:
+		return true
+	case PERMUSER:
+		return u != nil
+	}
+	return u != nil && u.hasPermission(perm)
+}
@@ -0,0 +1,5 @@
+-- the type of the ban, ban or shadow, the rows from before it existed are
+-- ordinary bans, works whether the column was added already or not
+ALTER TABLE bans ADD COLUMN IF NOT EXISTS type VARCHAR(16) NULL;
+UPDATE bans SET type = 'ban' WHERE type IS NULL OR type = '';
+ALTER TABLE bans MODIFY COLUMN type VARCHAR(16) NOT NULL DEFAULT 'ban';
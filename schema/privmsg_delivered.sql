@@ -0,0 +1,2 @@
+-- the private messages delivered live are not delivered again on connect
+ALTER TABLE chatprivatemessages ADD COLUMN IF NOT EXISTS isdelivered TINYINT(1) NOT NULL DEFAULT 0;
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the chat messages are indexed into the chatlog table by the hub so that
+// moderators can search them, the table is expected to look like:
+// chatlog (id PK AUTO_INCREMENT, userid, nick, message, timestamp)
+// with an index on (nick, timestamp), one on (timestamp) and a FULLTEXT index
+// on (message) for the text search
+var (
+	searchindexenabled = false
+	LOGSEARCHPAGESIZE  = 50
+	// MySQL does not speak RE2, so regexes are matched here against at most
+	// this many of the most recent lines the other filters let through
+	LOGSEARCHMAXSCAN = 10000
+)
+
+var searchIndexDropped = expvar.NewInt("searchIndexDropped")
+
+type LogSearchIn struct {
+	Nick  string `json:"nick"`
+	From  int64  `json:"from"` // unix milliseconds
+	To    int64  `json:"to"`   // unix milliseconds
+	Text  string `json:"text"`
+	Regex string `json:"regex"`
+	Page  int    `json:"page"`
+}
+
+type LogLineOut struct {
+	Nick      string `json:"nick"`
+	Data      string `json:"data"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type LogUserOut struct {
+	Nick      string `json:"nick"`
+	Count     int64  `json:"count"`
+	FirstSeen int64  `json:"firstseen"`
+	LastSeen  int64  `json:"lastseen"`
+}
+
+type LogSearchOut struct {
+	Page    int          `json:"page"`
+	More    bool         `json:"more"`
+	Results []LogLineOut `json:"results"`
+	Users   []LogUserOut `json:"users"`
+}
+
+type logSearchFilter struct {
+	nick string
+	from time.Time
+	to   time.Time
+	text string
+}
+
+var searchqueue = make(chan *message, BROADCASTCHANNELSIZE)
+
+func init() {
+	registerCommand(&command{
+		name:       "SEARCH",
+		help:       "searches the chat log by nick, time, text or regex",
+		permission: PERMMODERATOR,
+		payload: func() interface{} {
+			return &LogSearchIn{}
+		},
+		limit: querylimit,
+		handler: func(c *Connection, p interface{}) {
+			c.OnSearch(p.(*LogSearchIn))
+		},
+	})
+}
+
+func initSearch() {
+	if !searchindexenabled {
+		return
+	}
+
+	if len(adminapikey) != 0 {
+		http.HandleFunc("/admin/search", adminHandler(handleAdminSearch))
+	}
+
+	go runIndexer()
+}
+
+// indexMessage queues the broadcast chat message for the search index, called
+// from the hub so it must never block
+func indexMessage(m *message) {
+	if !searchindexenabled || m.event != "MSG" {
+		return
+	}
+
+	select {
+	case searchqueue <- m:
+	default:
+		searchIndexDropped.Add(1)
+	}
+}
+
+func runIndexer() {
+	for m := range searchqueue {
+		if l := getChatlogLine(time.Now().UTC(), m); l != nil {
+			db.insertchatlog <- l
+		}
+	}
+}
+
+// getChatlogLine returns the line to index for the chat message, nil if it
+// is not one
+func getChatlogLine(now time.Time, m *message) *dbChatlogLine {
+	data, ok := m.data.([]byte)
+	if !ok {
+		return nil
+	}
+
+	out := &EventDataOut{}
+	if err := json.Unmarshal(data, out); err != nil || out.SimplifiedUser == nil {
+		return nil
+	}
+
+	l := &dbChatlogLine{
+		uid:       usertools.getUseridForCachedNick(out.Nick),
+		nick:      out.Nick,
+		message:   out.Data,
+		timestamp: now,
+	}
+	if out.Timestamp > 0 {
+		l.timestamp = msToTime(out.Timestamp)
+	}
+	return l
+}
+
+func msToTime(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC()
+}
+
+func timeToMs(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func searchLog(in *LogSearchIn) (*LogSearchOut, error) {
+	if !searchindexenabled {
+		return nil, GenericError{"notfound"}
+	}
+
+	f := &logSearchFilter{
+		nick: strings.TrimSpace(in.Nick),
+		text: strings.TrimSpace(in.Text),
+	}
+	if in.From > 0 {
+		f.from = msToTime(in.From)
+	}
+	if in.To > 0 {
+		f.to = msToTime(in.To)
+	}
+	if in.Page < 0 {
+		return nil, GenericError{"protocolerror"}
+	}
+
+	// one more than a page, to know if there are more
+	offset, limit := in.Page*LOGSEARCHPAGESIZE, LOGSEARCHPAGESIZE+1
+	skip := 0
+	var re *regexp.Regexp
+	if len(in.Regex) != 0 {
+		var err error
+		if re, err = regexp.Compile(in.Regex); err != nil {
+			return nil, GenericError{"protocolerror"}
+		}
+		// the paging happens here, on the lines that matched
+		offset, limit, skip = 0, LOGSEARCHMAXSCAN, offset
+	}
+
+	out := &LogSearchOut{
+		Page:    in.Page,
+		Results: make([]LogLineOut, 0, LOGSEARCHPAGESIZE),
+		Users:   make([]LogUserOut, 0),
+	}
+	nicks := make([]string, 0)
+	seen := make(map[string]bool)
+	err := db.searchChatlog(f, offset, limit, func(nick, message string, timestamp time.Time) {
+		if re != nil {
+			if !re.MatchString(message) {
+				return
+			}
+			if skip > 0 {
+				skip--
+				return
+			}
+		}
+		if len(out.Results) == LOGSEARCHPAGESIZE {
+			out.More = true
+			return
+		}
+		out.Results = append(out.Results, LogLineOut{nick, message, timeToMs(timestamp)})
+		if key := strings.ToLower(nick); !seen[key] {
+			seen[key] = true
+			nicks = append(nicks, nick)
+		}
+	})
+	if err != nil {
+		return nil, GenericError{"searchfailed"}
+	}
+
+	if len(f.nick) != 0 && !seen[strings.ToLower(f.nick)] {
+		nicks = append(nicks, f.nick)
+	}
+	err = db.getChatlogUserStats(nicks, func(nick string, count int64, first, last time.Time) {
+		out.Users = append(out.Users, LogUserOut{nick, count, timeToMs(first), timeToMs(last)})
+	})
+	if err != nil {
+		return nil, GenericError{"searchfailed"}
+	}
+
+	return out, nil
+}
+
+func (c *Connection) OnSearch(in *LogSearchIn) {
+	out, err := searchLog(in)
+	if err != nil {
+		c.SendError(err.Error())
+		return
+	}
+
+	c.EmitBlock("SEARCHRESULTS", out)
+}
+
+// handleAdminSearch takes the fields of LogSearchIn as query parameters
+func handleAdminSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeApiError(w, http.StatusMethodNotAllowed, "protocolerror")
+		return
+	}
+
+	q := r.URL.Query()
+	in := &LogSearchIn{
+		Nick:  q.Get("nick"),
+		Text:  q.Get("text"),
+		Regex: q.Get("regex"),
+	}
+	for name, v := range map[string]*int64{"from": &in.From, "to": &in.To} {
+		if s := q.Get(name); len(s) != 0 {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				writeApiError(w, http.StatusBadRequest, "protocolerror")
+				return
+			}
+			*v = n
+		}
+	}
+	if s := q.Get("page"); len(s) != 0 {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			writeApiError(w, http.StatusBadRequest, "protocolerror")
+			return
+		}
+		in.Page = n
+	}
+
+	out, err := searchLog(in)
+	if err != nil {
+		status := http.StatusBadRequest
+		if err.Error() == "searchfailed" {
+			status = http.StatusInternalServerError
+		}
+		writeApiError(w, status, err.Error())
+		return
+	}
+	writeApiResponse(w, http.StatusOK, out)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func setupTestSearch(t *testing.T, pagesize int) sqlmock.Sqlmock {
+	mock := setupTestDatabase(t)
+
+	oldenabled, oldsize := searchindexenabled, LOGSEARCHPAGESIZE
+	searchindexenabled, LOGSEARCHPAGESIZE = true, pagesize
+	t.Cleanup(func() { searchindexenabled, LOGSEARCHPAGESIZE = oldenabled, oldsize })
+	return mock
+}
+
+func TestSearchValidation(t *testing.T) {
+	old := searchindexenabled
+	searchindexenabled = true
+	defer func() { searchindexenabled = old }()
+
+	if _, err := searchLog(&LogSearchIn{Regex: "(unclosed"}); err == nil || err.Error() != "protocolerror" {
+		t.Error("expected an invalid regex to be rejected, got", err)
+	}
+	if _, err := searchLog(&LogSearchIn{Page: -1}); err == nil || err.Error() != "protocolerror" {
+		t.Error("expected a negative page to be rejected, got", err)
+	}
+
+	if s := getFulltextPhrase(`say "+hi -there"`); s != `"say  +hi -there "` {
+		t.Error("expected the text to be searched as a phrase, got", s)
+	}
+}
+
+func TestSearchLogQuery(t *testing.T) {
+	mock := setupTestSearch(t, 2)
+
+	from, to := time.Unix(1000, 0).UTC(), time.Unix(2000, 0).UTC()
+	first, last := time.Unix(100, 0).UTC(), time.Unix(1900, 0).UTC()
+	mock.ExpectQuery(`FROM chatlog\s+WHERE nick = \? AND timestamp >= \? AND timestamp <= \? AND MATCH \(message\) AGAINST \(\? IN BOOLEAN MODE\)\s+ORDER BY timestamp DESC, id DESC\s+LIMIT \? OFFSET \?`).
+		WithArgs("Bob", from, to, `"some text"`, 3, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"nick", "message", "timestamp"}).
+			AddRow("Bob", "some text 3", last).
+			AddRow("Bob", "some text 2", from).
+			AddRow("Bob", "some text 1", from))
+	mock.ExpectQuery(`WHERE nick IN \(\?\)\s+GROUP BY nick`).
+		WithArgs("Bob").
+		WillReturnRows(sqlmock.NewRows([]string{"nick", "count", "first", "last"}).
+			AddRow("Bob", 42, first, last))
+
+	out, err := searchLog(&LogSearchIn{Nick: " Bob ", From: 1000000, To: 2000000, Text: " some text ", Page: 1})
+	if err != nil {
+		t.Fatal("expected the search to succeed, got", err)
+	}
+	if out.Page != 1 || !out.More || len(out.Results) != 2 || out.Results[0].Data != "some text 3" || out.Results[0].Timestamp != 1900000 {
+		t.Error("expected the second page with more after it, got", out)
+	}
+	if len(out.Users) != 1 || out.Users[0].Count != 42 || out.Users[0].FirstSeen != 100000 || out.Users[0].LastSeen != 1900000 {
+		t.Error("expected the stats of the user, got", out.Users)
+	}
+}
+
+func TestSearchLogRegex(t *testing.T) {
+	mock := setupTestSearch(t, 2)
+
+	now := time.Now().UTC()
+	// \d is RE2 and not what MySQL understands, so it has to be matched here
+	mock.ExpectQuery(`FROM chatlog\s+ORDER BY timestamp DESC, id DESC\s+LIMIT \? OFFSET \?`).
+		WithArgs(LOGSEARCHMAXSCAN, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"nick", "message", "timestamp"}).
+			AddRow("alice", "code 1", now).
+			AddRow("bob", "no code", now).
+			AddRow("alice", "code 2", now).
+			AddRow("carol", "code 3", now).
+			AddRow("bob", "code 4", now).
+			AddRow("bob", "code 5", now))
+	mock.ExpectQuery(`WHERE nick IN \(\?, \?\)`).
+		WithArgs("carol", "bob").
+		WillReturnRows(sqlmock.NewRows([]string{"nick", "count", "first", "last"}).
+			AddRow("bob", 3, now, now).
+			AddRow("carol", 1, now, now))
+
+	out, err := searchLog(&LogSearchIn{Regex: `^code \d$`, Page: 1})
+	if err != nil {
+		t.Fatal("expected the search to succeed, got", err)
+	}
+	if !out.More || len(out.Results) != 2 || out.Results[0].Data != "code 3" || out.Results[1].Data != "code 4" {
+		t.Error("expected the second page of the matching lines, got", out.Results)
+	}
+	if len(out.Users) != 2 {
+		t.Error("expected the stats of the users on the page, got", out.Users)
+	}
+}
+
+func TestSearchLogUserWithoutResults(t *testing.T) {
+	mock := setupTestSearch(t, 2)
+
+	mock.ExpectQuery(`FROM chatlog\s+WHERE nick = \?`).
+		WithArgs("nobody", 3, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"nick", "message", "timestamp"}))
+	mock.ExpectQuery(`WHERE nick IN \(\?\)`).
+		WithArgs("nobody").
+		WillReturnRows(sqlmock.NewRows([]string{"nick", "count", "first", "last"}))
+
+	out, err := searchLog(&LogSearchIn{Nick: "nobody"})
+	if err != nil || out.More || len(out.Results) != 0 || len(out.Users) != 0 {
+		t.Error("expected an empty result, got", out, err)
+	}
+}
+
+func TestSearchLogFailed(t *testing.T) {
+	mock := setupTestSearch(t, 2)
+
+	mock.ExpectQuery(`FROM chatlog`).WillReturnError(sqlmock.ErrCancelled)
+	if _, err := searchLog(&LogSearchIn{}); err == nil || err.Error() != "searchfailed" {
+		t.Error("expected the failed query to be reported, got", err)
+	}
+}
+
+func TestIndexMessage(t *testing.T) {
+	old := searchindexenabled
+	searchindexenabled = true
+	defer func() { searchindexenabled = old }()
+	defer func() {
+		for len(searchqueue) > 0 {
+			<-searchqueue
+		}
+	}()
+
+	usertools.addUser(&User{id: Userid(70), nick: "indexed"}, true)
+	indexMessage(&message{event: "JOIN", data: []byte(`{"nick":"indexed"}`)})
+	indexMessage(&message{event: "MSG", data: []byte(`{"nick":"indexed","timestamp":1000,"data":"hello"}`)})
+	if len(searchqueue) != 1 {
+		t.Fatal("expected only the chat message to be queued, got", len(searchqueue))
+	}
+
+	l := getChatlogLine(time.Now(), <-searchqueue)
+	if l == nil || l.uid != 70 || l.nick != "indexed" || l.message != "hello" || !l.timestamp.Equal(time.Unix(1, 0)) {
+		t.Error("expected the line to be indexed, got", l)
+	}
+	if l := getChatlogLine(time.Now(), &message{event: "MSG", data: []byte(`{"data":"nobody"}`)}); l != nil {
+		t.Error("expected a message without a user to be skipped, got", l)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+type BanInfoOut struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+	By     string `json:"by,omitempty"`
+	IP     string `json:"ip,omitempty"`
+	Start  int64  `json:"start"`
+	End    int64  `json:"end,omitempty"` // omitted for permanent bans
+}
+
+type BanInfoResultOut struct {
+	Nick string       `json:"nick"`
+	Bans []BanInfoOut `json:"bans"`
+}
+
+func init() {
+	registerCommand(&command{
+		name:       "SHADOWBAN",
+		help:       "bans a user without the user noticing",
+		permission: PERMBAN,
+		bot:        true,
+		payload: func() interface{} {
+			return &BanIn{}
+		},
+		handler: func(c *Connection, p interface{}) {
+			c.OnShadowban(p.(*BanIn))
+		},
+	})
+	registerCommand(&command{
+		name:       "BANINFO",
+		help:       "shows the active bans of a user",
+		permission: PERMMODERATOR,
+		payload:    newEventDataIn,
+		limit:      querylimit,
+		handler: func(c *Connection, p interface{}) {
+			c.OnBanInfo(p.(*EventDataIn))
+		},
+	})
+}
+
+// shadowbanStage echoes the messages of shadowbanned users only back to the
+// user and to the moderators, flagged as SHADOWMSG, they are never broadcast
+func shadowbanStage(pm *pipelineMessage) bool {
+	c := pm.c
+	if c.user == nil || !bans.isUseridShadowbanned(c.user.id) {
+		return true
+	}
+
+	out := c.getEventDataOut()
+	out.Data = pm.msg
+	c.rlockUserIfExists()
+	data, _ := Marshal(out)
+	c.runlockUserIfExists()
+
+	hub.sendToUser(c.user.id, &message{
+		event: "MSG",
+		data:  data,
+	})
+	hub.modbroadcast <- &message{
+		event: "SHADOWMSG",
+		data:  data,
+	}
+	return false
+}
+
+func (c *Connection) OnShadowban(ban *BanIn) {
+	ok, uid := c.canModerateUser(ban.Nick)
+	if uid == 0 {
+		c.SendError("notfound")
+		return
+	} else if !ok {
+		c.SendError("nopermission")
+		return
+	}
+
+	// an ip ban cannot be hidden from the user, it would also keep out the
+	// connections that are supposed to see their own messages
+	if ban.BanIP {
+		c.SendError("shadowbanip")
+		return
+	}
+
+	reason := strings.TrimSpace(ban.Reason)
+	if utf8.RuneCountInString(reason) == 0 || !utf8.ValidString(reason) {
+		c.SendError("needbanreason")
+		return
+	}
+
+	if ban.Duration == 0 {
+		ban.Duration = int64(DEFAULTBANDURATION)
+	}
+	if !c.checkBanLimits("SHADOWBAN", uid, ban) {
+		return
+	}
+
+	bans.shadowbanUser(c.user.id, uid, ban)
+	offences.record(uid, OFFENCEBAN)
+
+	// only the moderators are told, that is the whole point
+	out := c.getEventDataOut()
+	out.Data = ban.Nick
+	if !ban.Ispermanent {
+		out.Duration = ban.Duration / int64(time.Second)
+	}
+	hub.broadcastModerators("SHADOWBAN", out)
+}
+
+func getBanInfo(nick string) (*BanInfoResultOut, error) {
+	uid, _ := usertools.getUseridForNick(nick)
+	if uid == 0 {
+		return nil, GenericError{"notfound"}
+	}
+
+	out := &BanInfoResultOut{
+		Nick: nick,
+		Bans: make([]BanInfoOut, 0),
+	}
+	err := db.getActiveBans(uid, func(bantype string, ip sql.NullString, reason string, start time.Time, end mysql.NullTime, by sql.NullString) {
+		b := BanInfoOut{
+			Type:   bantype,
+			Reason: reason,
+			By:     by.String,
+			IP:     ip.String,
+			Start:  timeToMs(start),
+		}
+		if end.Valid {
+			b.End = timeToMs(end.Time)
+		}
+		out.Bans = append(out.Bans, b)
+	})
+	if err != nil {
+		return nil, GenericError{"baninfofailed"}
+	}
+	return out, nil
+}
+
+// OnBanInfo expects Data to be the nick
+func (c *Connection) OnBanInfo(m *EventDataIn) {
+	out, err := getBanInfo(strings.TrimSpace(m.Data))
+	if err != nil {
+		c.SendError(err.Error())
+		return
+	}
+
+	c.EmitBlock("BANINFO", out)
+}
+
+func handleAdminBans(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeApiError(w, http.StatusMethodNotAllowed, "protocolerror")
+		return
+	}
+
+	out, err := getBanInfo(strings.TrimSpace(r.URL.Query().Get("nick")))
+	if err != nil {
+		status := http.StatusNotFound
+		if err.Error() == "baninfofailed" {
+			status = http.StatusInternalServerError
+		}
+		writeApiError(w, status, err.Error())
+		return
+	}
+	writeApiResponse(w, http.StatusOK, out)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestShadowbanRejectsIP(t *testing.T) {
+	mod := &User{id: Userid(90), nick: "shadowmod"}
+	mod.setFeatures([]string{"moderator"})
+	mod.assembleSimplifiedUser()
+	c := newBotConnection(mod, "127.0.0.1")
+	usertools.addUser(&User{id: Userid(91), nick: "shadowed"}, true)
+
+	c.OnShadowban(&BanIn{Nick: "shadowed", BanIP: true, Reason: "spam"})
+	if m := <-c.blocksend; m.event != "ERR" || m.data.(GenericError).Error() != "shadowbanip" {
+		t.Error("expected the ip shadowban to be rejected, got", m.event, m.data)
+	}
+	if bans.isUseridShadowbanned(Userid(91)) {
+		t.Error("expected the user to not be shadowbanned")
+	}
+}
+
+func TestBanInfo(t *testing.T) {
+	mock := setupTestDatabase(t)
+	usertools.addUser(&User{id: Userid(92), nick: "baninfo"}, true)
+
+	start, end := time.Unix(1000, 0).UTC(), time.Unix(2000, 0).UTC()
+	mock.ExpectQuery("FROM bans").WithArgs(Userid(92)).
+		WillReturnRows(sqlmock.NewRows([]string{"type", "ipaddress", "reason", "starttimestamp", "endtimestamp", "username"}).
+			AddRow(BANTYPESHADOW, nil, "spam", start, end, "shadowmod").
+			AddRow(nil, "10.0.0.1", "evading", start, nil, nil))
+
+	out, err := getBanInfo("baninfo")
+	if err != nil || len(out.Bans) != 2 {
+		t.Fatal("expected both bans, got", out, err)
+	}
+	if b := out.Bans[0]; b.Type != BANTYPESHADOW || b.By != "shadowmod" || b.IP != "" || b.Start != 1000000 || b.End != 2000000 {
+		t.Error("expected the shadowban, got", b)
+	}
+	if b := out.Bans[1]; b.Type != BANTYPEBAN || b.IP != "10.0.0.1" || b.By != "" || b.End != 0 {
+		t.Error("expected the permanent ip ban without a type to be a ban, got", b)
+	}
+}
+
+func TestBanInfoFailed(t *testing.T) {
+	mock := setupTestDatabase(t)
+	usertools.addUser(&User{id: Userid(93), nick: "baninfofail"}, true)
+
+	mock.ExpectQuery("FROM bans").WillReturnError(sqlmock.ErrCancelled)
+	if _, err := getBanInfo("baninfofail"); err == nil || err.Error() != "baninfofailed" {
+		t.Error("expected the failed lookup to be reported, got", err)
+	}
+
+	mock.ExpectQuery("FROM bans").WillReturnError(sqlmock.ErrCancelled)
+	w := httptest.NewRecorder()
+	handleAdminBans(w, httptest.NewRequest("GET", "/admin/bans?nick=baninfofail", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Error("expected the failed lookup to be a server error, got", w.Code)
+	}
+}
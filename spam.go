@@ -0,0 +1,256 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	conf "github.com/msbranco/goconfig"
+)
+
+// the thresholds of the spam detector, every heuristic adds one to the score
+// of the message once its threshold is reached
+var (
+	spamenabled       = true
+	SPAMHISTORYTIME   = 5 * time.Minute // messages older than this are forgotten
+	SPAMHISTORY       = 5               // how many of the last messages of the user to compare against
+	SPAMSIMILARITY    = 0.8             // shingle similarity above which a message counts as a near-duplicate
+	SPAMCAPSRATIO     = 0.7             // ratio of uppercase letters
+	SPAMCAPSMINLEN    = 12              // caps are only checked above this many letters
+	SPAMREPETITION    = 10              // number of times the same character repeats in a row
+	SPAMBURSTLENGTH   = 1200            // number of characters sent in SPAMBURSTWINDOW
+	SPAMBURSTWINDOW   = 10 * time.Second
+	SPAMMENTIONS      = 4   // number of distinct nicks in a message
+	SPAMTHROTTLESCORE = 1.0 // at or above this score the message is rejected and the user throttled
+	SPAMMUTESCORE     = 3.0 // at or above this score the user is muted
+	SPAMMUTEDURATION  = int64(DEFAULTMUTEDURATION)
+)
+
+func readSpamConfig(c *conf.ConfigFile) {
+	spamenabled, _ = c.GetBool("spam", "enabled")
+	if v, err := c.GetInt64("spam", "history"); err == nil {
+		SPAMHISTORY = int(v)
+	}
+	if v, err := c.GetInt64("spam", "historytime"); err == nil {
+		SPAMHISTORYTIME = time.Duration(v)
+	}
+	if v, err := c.GetFloat("spam", "similarity"); err == nil {
+		SPAMSIMILARITY = v
+	}
+	if v, err := c.GetFloat("spam", "capsratio"); err == nil {
+		SPAMCAPSRATIO = v
+	}
+	if v, err := c.GetInt64("spam", "repetition"); err == nil {
+		SPAMREPETITION = int(v)
+	}
+	if v, err := c.GetInt64("spam", "burstlength"); err == nil {
+		SPAMBURSTLENGTH = int(v)
+	}
+	if v, err := c.GetInt64("spam", "burstwindow"); err == nil {
+		SPAMBURSTWINDOW = time.Duration(v)
+	}
+	if v, err := c.GetInt64("spam", "mentions"); err == nil {
+		SPAMMENTIONS = int(v)
+	}
+	if v, err := c.GetFloat("spam", "throttlescore"); err == nil {
+		SPAMTHROTTLESCORE = v
+	}
+	if v, err := c.GetFloat("spam", "mutescore"); err == nil {
+		SPAMMUTESCORE = v
+	}
+	if v, err := c.GetInt64("spam", "muteduration"); err == nil {
+		SPAMMUTEDURATION = v
+	}
+}
+
+type spamEntry struct {
+	text      string
+	length    int
+	timestamp time.Time
+}
+
+// spamHistory is the last messages of the user, shared by every connection of
+// the user so it has a lock of its own
+type spamHistory struct {
+	entries []spamEntry
+	sync.Mutex
+}
+
+// add scores the message against the history and then adds it to it
+func (h *spamHistory) add(msg string, now time.Time) float64 {
+	h.Lock()
+	defer h.Unlock()
+
+	score := spamScore(msg, h.entries, now)
+	h.entries = append(h.entries, spamEntry{
+		text:      spamText(msg),
+		length:    utf8.RuneCountInString(msg),
+		timestamp: now,
+	})
+	if len(h.entries) > SPAMHISTORY {
+		h.entries = append([]spamEntry(nil), h.entries[len(h.entries)-SPAMHISTORY:]...)
+	}
+	return score
+}
+
+func (h *spamHistory) getEntries() []spamEntry {
+	h.Lock()
+	defer h.Unlock()
+	return append([]spamEntry(nil), h.entries...)
+}
+
+func (h *spamHistory) setEntries(entries []spamEntry) {
+	h.Lock()
+	defer h.Unlock()
+	h.entries = entries
+}
+
+// shingles splits the string into overlapping three character long pieces
+func shingles(s string) map[string]struct{} {
+	r := []rune(s)
+	ret := make(map[string]struct{}, len(r))
+	if len(r) < 3 {
+		ret[s] = struct{}{}
+		return ret
+	}
+	for i := 0; i+3 <= len(r); i++ {
+		ret[string(r[i:i+3])] = struct{}{}
+	}
+	return ret
+}
+
+// similarity is the jaccard index of the shingles of the two strings, 1 means
+// the strings are equal for all practical purposes
+func similarity(a, b map[string]struct{}) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 1
+	}
+
+	common := 0
+	for s := range a {
+		if _, ok := b[s]; ok {
+			common++
+		}
+	}
+	return float64(common) / float64(len(a)+len(b)-common)
+}
+
+// spamText is what the heuristics work on, whitespace collapsed and lowercased
+func spamText(msg string) string {
+	return strings.ToLower(strings.Join(strings.Fields(msg), " "))
+}
+
+func capsRatio(msg string) float64 {
+	var letters, upper int
+	for _, r := range msg {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		if unicode.IsUpper(r) {
+			upper++
+		}
+	}
+	if letters < SPAMCAPSMINLEN {
+		return 0
+	}
+	return float64(upper) / float64(letters)
+}
+
+func longestRepetition(msg string) int {
+	var longest, current int
+	var last rune
+	for _, r := range msg {
+		if r == last && !unicode.IsSpace(r) {
+			current++
+		} else {
+			current = 1
+		}
+		if current > longest {
+			longest = current
+		}
+		last = r
+	}
+	return longest
+}
+
+func countMentions(msg string) int {
+	seen := make(map[Userid]struct{})
+	for _, word := range strings.Fields(msg) {
+		word = strings.TrimFunc(word, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+		})
+		if uid := usertools.getUseridForCachedNick(word); uid != 0 {
+			seen[uid] = struct{}{}
+		}
+	}
+	return len(seen)
+}
+
+// spamScore scores the message against the history of the user, every
+// heuristic that triggers adds one to the score, near-duplicates add one for
+// every previous message they are similar to
+func spamScore(msg string, history []spamEntry, now time.Time) (score float64) {
+	text := spamText(msg)
+	sh := shingles(text)
+	for _, e := range history {
+		if now.Sub(e.timestamp) > SPAMHISTORYTIME {
+			continue
+		}
+		if similarity(sh, shingles(e.text)) >= SPAMSIMILARITY {
+			score++
+		}
+	}
+
+	if capsRatio(msg) >= SPAMCAPSRATIO {
+		score++
+	}
+
+	if longestRepetition(msg) >= SPAMREPETITION {
+		score++
+	}
+
+	burst := utf8.RuneCountInString(msg)
+	for _, e := range history {
+		if now.Sub(e.timestamp) <= SPAMBURSTWINDOW {
+			burst += e.length
+		}
+	}
+	if burst >= SPAMBURSTLENGTH {
+		score++
+	}
+
+	if countMentions(msg) >= SPAMMENTIONS {
+		score++
+	}
+
+	return
+}
+
+// checkSpam scores the message and punishes the user if needed, the history
+// is updated regardless so that rejected messages count towards the score too
+// the connections of the same user can call it at the same time
+func (c *Connection) checkSpam(msg string) bool {
+	if !spamenabled || c.user == nil || c.user.isBot() {
+		return true
+	}
+
+	now := time.Now()
+	score := c.user.spamhistory.add(msg, now)
+
+	switch {
+	case score >= SPAMMUTESCORE:
+		D("Muting", c.user.nick, "for spam, score:", score)
+		c.autoMute(SPAMMUTEDURATION)
+		return false
+	case score >= SPAMTHROTTLESCORE:
+		D("Throttling", c.user.nick, "for spam, score:", score)
+		c.user.throttle.penalize(getThrottleConfig(c.user), SPAMPENALTY, now)
+		c.SendError("spam")
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSpamSimilarity(t *testing.T) {
+	a := shingles(spamText("check out my channel at example"))
+	b := shingles(spamText("check out my channel at example!"))
+	if s := similarity(a, b); s < SPAMSIMILARITY {
+		t.Error("messages differing in one character should be near-duplicates, similarity was", s)
+	}
+
+	c := shingles(spamText("what a great play that was"))
+	if s := similarity(a, c); s >= SPAMSIMILARITY {
+		t.Error("different messages should not be near-duplicates, similarity was", s)
+	}
+}
+
+func TestSpamScore(t *testing.T) {
+	now := time.Now()
+	history := []spamEntry{
+		{spamText("buy cheap gold now"), 18, now.Add(-time.Second)},
+	}
+
+	if s := spamScore("what a great play that was", history, now); s != 0 {
+		t.Error("normal message should not score, score was", s)
+	}
+	if s := spamScore("buy cheap gold now!", history, now); s != 1 {
+		t.Error("near-duplicate should score one, score was", s)
+	}
+	if s := spamScore("THIS IS ALL CAPS YELLING", nil, now); s != 1 {
+		t.Error("caps should score one, score was", s)
+	}
+	if s := spamScore("wowwwwwwwwwwwww", nil, now); s != 1 {
+		t.Error("character repetition should score one, score was", s)
+	}
+	if s := spamScore(strings.Repeat("ab ", SPAMBURSTLENGTH/3+1), nil, now); s != 1 {
+		t.Error("length burst should score one, score was", s)
+	}
+
+	old := []spamEntry{
+		{spamText("buy cheap gold now"), 18, now.Add(-SPAMHISTORYTIME - time.Second)},
+	}
+	if s := spamScore("buy cheap gold now!", old, now); s != 0 {
+		t.Error("messages older than the history window should be ignored, score was", s)
+	}
+}
+
+func TestSpamHistoryConnections(t *testing.T) {
+	defer func(throttle, mute float64) { SPAMTHROTTLESCORE, SPAMMUTESCORE = throttle, mute }(SPAMTHROTTLESCORE, SPAMMUTESCORE)
+	SPAMTHROTTLESCORE, SPAMMUTESCORE = 1000, 1000
+
+	// the connections of the same user read in goroutines of their own, run
+	// with -race to see them share the history safely
+	u := &User{id: Userid(110), nick: "twotabs"}
+	u.setFeatures(nil)
+	conns := []*Connection{newBotConnection(u, "127.0.0.1"), newBotConnection(u, "127.0.0.2")}
+
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *Connection) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				if !c.checkSpam("hello there") {
+					t.Error("expected the message to go through")
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	if entries := u.spamhistory.getEntries(); len(entries) != SPAMHISTORY {
+		t.Error("expected the history to be kept at its size, got", len(entries))
+	}
+}
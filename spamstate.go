@@ -0,0 +1,81 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// SPAMSTATETTL is how long the anti-spam state of a user evicted from the
+// namescache is kept around, so that reconnecting does not reset the throttle
+var SPAMSTATETTL = 10 * time.Minute
+
+// spamState is everything anti-spam related of a user, without the rest of
+// the user struct
+type spamState struct {
+	lastmessage []byte
+	throttle    bucketState
+	dmthrottle  bucketState
+	spamhistory []spamEntry
+	expires     time.Time
+}
+
+type spamStateStore struct {
+	states map[Userid]*spamState
+	sync.Mutex
+}
+
+var spamstates = spamStateStore{
+	states: make(map[Userid]*spamState),
+}
+
+func init() {
+	expvar.Publish("spamStates", expvar.Func(func() interface{} {
+		spamstates.Lock()
+		defer spamstates.Unlock()
+		return len(spamstates.states)
+	}))
+}
+
+// save stores the state of the user, expects the user to have no connections
+func (ss *spamStateStore) save(u *User) {
+	s := &spamState{
+		lastmessage: u.lastmessage,
+		throttle:    u.throttle.getState(),
+		dmthrottle:  u.dmthrottle.getState(),
+		spamhistory: u.spamhistory.getEntries(),
+		expires:     time.Now().Add(SPAMSTATETTL),
+	}
+
+	ss.Lock()
+	defer ss.Unlock()
+	ss.states[u.id] = s
+}
+
+// restore moves the saved state back onto the user, if there is any
+func (ss *spamStateStore) restore(u *User) {
+	ss.Lock()
+	s, ok := ss.states[u.id]
+	delete(ss.states, u.id)
+	ss.Unlock()
+
+	if !ok || time.Now().After(s.expires) {
+		return
+	}
+
+	u.lastmessage = s.lastmessage
+	u.throttle.setState(s.throttle)
+	u.dmthrottle.setState(s.dmthrottle)
+	u.spamhistory.setEntries(s.spamhistory)
+}
+
+func (ss *spamStateStore) clean(now time.Time) {
+	ss.Lock()
+	defer ss.Unlock()
+
+	for uid, s := range ss.states {
+		if now.After(s.expires) {
+			delete(ss.states, uid)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// the shortest interval a timer can be set to
+const MINTIMERINTERVAL = time.Minute
+
+// chatlines counts the MSG events broadcast, for the minimum number of lines
+// between the runs of a timer
+var chatlines uint64
+
+// Timer is a recurring announcement, persisted in the state so it has to be
+// gob encodable
+type Timer struct {
+	Id       int64
+	Message  string
+	Interval time.Duration
+	MinLines uint64
+	Creator  string
+	LastRun  time.Time
+	lines    uint64 // the value of chatlines at the last run
+}
+
+type TimerIn struct {
+	Data     string `json:"data"`
+	Interval int64  `json:"interval"` // in seconds
+	MinLines uint64 `json:"minlines"`
+}
+
+type TimerOut struct {
+	Id       int64  `json:"id"`
+	Data     string `json:"data"`
+	Interval int64  `json:"interval"` // in seconds
+	MinLines uint64 `json:"minlines,omitempty"`
+	Creator  string `json:"creator"`
+	LastRun  int64  `json:"lastrun,omitempty"`
+}
+
+func initTimers() {
+	go runTimers()
+}
+
+func runTimers() {
+	t := time.NewTicker(time.Second)
+	for now := range t.C {
+		checkTimers(now)
+	}
+}
+
+func checkTimers(now time.Time) {
+	lines := atomic.LoadUint64(&chatlines)
+	due := make([]string, 0)
+
+	state.Lock()
+	for i := range state.timers {
+		tm := &state.timers[i]
+		if now.Sub(tm.LastRun) < tm.Interval || lines-tm.lines < tm.MinLines {
+			continue
+		}
+		tm.LastRun = now
+		tm.lines = lines
+		due = append(due, tm.Message)
+	}
+	if len(due) > 0 {
+		state.save()
+	}
+	state.Unlock()
+
+	for _, msg := range due {
+		hub.broadcastEvent("BROADCAST", &EventDataOut{
+			Timestamp: unixMilliTime(),
+			Data:      msg,
+		})
+	}
+}
+
+func (t *Timer) out() TimerOut {
+	out := TimerOut{
+		Id:       t.Id,
+		Data:     t.Message,
+		Interval: int64(t.Interval / time.Second),
+		MinLines: t.MinLines,
+		Creator:  t.Creator,
+	}
+	if !t.LastRun.IsZero() {
+		out.LastRun = t.LastRun.UnixNano() / int64(time.Millisecond)
+	}
+	return out
+}
+
+func addTimer(in *TimerIn, creator string) (TimerOut, error) {
+	msg := strings.TrimSpace(in.Data)
+	if !isValidMessage(msg) {
+		return TimerOut{}, GenericError{"invalidmsg"}
+	}
+	// the interval is in seconds, do not let it overflow a time.Duration
+	if in.Interval < int64(MINTIMERINTERVAL/time.Second) || in.Interval > math.MaxInt64/int64(time.Second) {
+		return TimerOut{}, GenericError{"protocolerror"}
+	}
+
+	state.Lock()
+	defer state.Unlock()
+
+	state.timerid++
+	t := Timer{
+		Id:       state.timerid,
+		Message:  msg,
+		Interval: time.Duration(in.Interval) * time.Second,
+		MinLines: in.MinLines,
+		Creator:  creator,
+		// do not post it right away, wait for the first interval to pass
+		LastRun: time.Now(),
+		lines:   atomic.LoadUint64(&chatlines),
+	}
+	state.timers = append(state.timers, t)
+	state.save()
+	return t.out(), nil
+}
+
+func deleteTimer(id int64) bool {
+	state.Lock()
+	defer state.Unlock()
+
+	for i, t := range state.timers {
+		if t.Id == id {
+			state.timers = append(state.timers[:i:i], state.timers[i+1:]...)
+			state.save()
+			return true
+		}
+	}
+	return false
+}
+
+func getTimers() []TimerOut {
+	state.RLock()
+	defer state.RUnlock()
+
+	out := make([]TimerOut, 0, len(state.timers))
+	for i := range state.timers {
+		out = append(out, state.timers[i].out())
+	}
+	return out
+}
+
+func init() {
+	registerCommand(&command{
+		name:       "TIMERADD",
+		help:       "adds a recurring announcement",
+		permission: PERMADMIN,
+		payload: func() interface{} {
+			return &TimerIn{}
+		},
+		handler: func(c *Connection, p interface{}) {
+			c.OnTimerAdd(p.(*TimerIn))
+		},
+	})
+	registerCommand(&command{
+		name:       "TIMERDELETE",
+		help:       "deletes a recurring announcement",
+		permission: PERMADMIN,
+		payload:    newEventDataIn,
+		handler: func(c *Connection, p interface{}) {
+			c.OnTimerDelete(p.(*EventDataIn))
+		},
+	})
+	registerCommand(&command{
+		name:       "TIMERLIST",
+		help:       "lists the recurring announcements",
+		permission: PERMADMIN,
+		handler: func(c *Connection, _ interface{}) {
+			c.OnTimerList()
+		},
+	})
+}
+
+func (c *Connection) OnTimerAdd(in *TimerIn) {
+	t, err := addTimer(in, c.user.nick)
+	if err != nil {
+		c.SendError(err.Error())
+		return
+	}
+
+	c.EmitBlock("TIMERS", []TimerOut{t})
+}
+
+// OnTimerDelete expects Data to be the timer id
+func (c *Connection) OnTimerDelete(m *EventDataIn) {
+	id, err := strconv.ParseInt(m.Data, 10, 64)
+	if err != nil {
+		c.SendError("protocolerror")
+		return
+	}
+
+	if !deleteTimer(id) {
+		c.SendError("notfound")
+		return
+	}
+
+	c.EmitBlock("TIMERS", getTimers())
+}
+
+func (c *Connection) OnTimerList() {
+	c.EmitBlock("TIMERS", getTimers())
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// setupTestTimers starts the test without timers and restores the old ones
+func setupTestTimers(t *testing.T) {
+	setupTestState(t)
+	drainBroadcasts()
+
+	state.Lock()
+	old := state.timers
+	state.timers = nil
+	state.Unlock()
+	t.Cleanup(func() {
+		state.Lock()
+		state.timers = old
+		state.Unlock()
+	})
+}
+
+func TestAddTimer(t *testing.T) {
+	setupTestTimers(t)
+
+	out, err := addTimer(&TimerIn{Data: " hello ", Interval: 90, MinLines: 5}, "admin")
+	if err != nil || out.Data != "hello" || out.Interval != 90 || out.MinLines != 5 || out.Creator != "admin" {
+		t.Error("expected the timer to be added, got", out, err)
+	}
+	if timers := getTimers(); len(timers) != 1 || timers[0].Id != out.Id || timers[0].Interval != 90 {
+		t.Error("expected the interval to be reported in seconds, got", timers)
+	}
+	state.RLock()
+	interval := state.timers[0].Interval
+	state.RUnlock()
+	if interval != 90*time.Second {
+		t.Error("expected the interval to be read in seconds, got", interval)
+	}
+
+	for _, in := range []TimerIn{
+		{Data: "too often", Interval: 59},
+		{Data: "in nanoseconds", Interval: int64(time.Hour)},
+	} {
+		if _, err := addTimer(&in, "admin"); err == nil || err.Error() != "protocolerror" {
+			t.Error("expected the interval to be rejected", in.Interval, err)
+		}
+	}
+	if _, err := addTimer(&TimerIn{Data: " ", Interval: 60}, "admin"); err == nil || err.Error() != "invalidmsg" {
+		t.Error("expected an empty message to be rejected, got", err)
+	}
+
+	if !deleteTimer(out.Id) || deleteTimer(out.Id) || len(getTimers()) != 0 {
+		t.Error("expected the timer to be deleted once")
+	}
+}
+
+func TestCheckTimers(t *testing.T) {
+	setupTestTimers(t)
+
+	now := time.Now()
+	lines := atomic.LoadUint64(&chatlines)
+	state.Lock()
+	state.timers = []Timer{
+		{Id: 1, Message: "every minute", Interval: time.Minute, LastRun: now.Add(-2 * time.Minute), lines: lines},
+		{Id: 2, Message: "after chatting", Interval: time.Minute, MinLines: 2, LastRun: now.Add(-2 * time.Minute), lines: lines},
+	}
+	state.Unlock()
+
+	checkTimers(now)
+	if m := getBroadcast(t); m.event != "BROADCAST" || !strings.Contains(string(m.data.([]byte)), "every minute") {
+		t.Errorf("expected the due timer to be broadcast, got %s %s", m.event, m.data)
+	}
+	if len(hub.broadcast) != 0 {
+		t.Error("expected the timer without enough lines to wait")
+	}
+
+	atomic.AddUint64(&chatlines, 2)
+	checkTimers(now.Add(30 * time.Second))
+	if m := getBroadcast(t); !strings.Contains(string(m.data.([]byte)), "after chatting") {
+		t.Errorf("expected the timer to run after enough lines, got %s", m.data)
+	}
+	if len(hub.broadcast) != 0 {
+		t.Error("expected the first timer to wait for its interval")
+	}
+
+	checkTimers(now.Add(time.Minute))
+	if m := getBroadcast(t); !strings.Contains(string(m.data.([]byte)), "every minute") {
+		t.Errorf("expected the timer to run again after the interval, got %s", m.data)
+	}
+}
+
+func TestAdminTimers(t *testing.T) {
+	setupTestTimers(t)
+	defer func(key string) { adminapikey = key }(adminapikey)
+	adminapikey = "secret"
+
+	handler := adminHandler(handleAdminTimers)
+	request := func(method, target, body, key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("X-Api-Key", key)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	if w := request("GET", "/admin/timers", "", "wrong"); w.Code != http.StatusForbidden {
+		t.Error("expected a wrong key to be rejected, got", w.Code)
+	}
+
+	w := request("POST", "/admin/timers", `{"data":"hello","interval":120}`, "secret")
+	out := TimerOut{}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); w.Code != http.StatusCreated || err != nil || out.Interval != 120 || out.Creator != "api" {
+		t.Fatal("expected the timer to be created, got", w.Code, w.Body.String())
+	}
+	if w := request("POST", "/admin/timers", `{"data":"hello","interval":1}`, "secret"); w.Code != http.StatusBadRequest {
+		t.Error("expected a short interval to be rejected, got", w.Code)
+	}
+	if w := request("POST", "/admin/timers", `{invalid`, "secret"); w.Code != http.StatusBadRequest {
+		t.Error("expected invalid json to be rejected, got", w.Code)
+	}
+
+	w = request("GET", "/admin/timers", "", "secret")
+	timers := []TimerOut{}
+	if err := json.Unmarshal(w.Body.Bytes(), &timers); w.Code != http.StatusOK || err != nil || len(timers) != 1 || timers[0].Interval != 120 {
+		t.Error("expected the timer to be listed, got", w.Code, w.Body.String())
+	}
+
+	id := strconv.FormatInt(out.Id, 10)
+	if w := request("DELETE", "/admin/timers?id="+id, "", "secret"); w.Code != http.StatusNoContent {
+		t.Error("expected the timer to be deleted, got", w.Code)
+	}
+	if w := request("DELETE", "/admin/timers?id="+id, "", "secret"); w.Code != http.StatusNotFound {
+		t.Error("expected the timer to be gone, got", w.Code)
+	}
+	if w := request("PUT", "/admin/timers", "", "secret"); w.Code != http.StatusMethodNotAllowed {
+		t.Error("expected an unknown method to be rejected, got", w.Code)
+	}
+}
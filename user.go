@@ -18,7 +18,9 @@ type userTools struct {
 	nicklookup  map[string]*uidprot
 	nicklock    sync.RWMutex
 	featurelock sync.RWMutex
-	features    map[uint64][]string
+	features    map[string]*roleSet
+	createdlock sync.RWMutex
+	created     map[Userid]time.Time
 }
 
 var (
@@ -26,19 +28,11 @@ var (
 		nicklookup:  make(map[string]*uidprot),
 		nicklock:    sync.RWMutex{},
 		featurelock: sync.RWMutex{},
-		features:    make(map[uint64][]string),
+		features:    make(map[string]*roleSet),
+		created:     make(map[Userid]time.Time),
 	}
 )
 
-const (
-	ISADMIN      = 1 << iota
-	ISMODERATOR  = 1 << iota
-	ISVIP        = 1 << iota
-	ISPROTECTED  = 1 << iota
-	ISSUBSCRIBER = 1 << iota
-	ISBOT        = 1 << iota
-)
-
 // ffjson: skip
 type uidprot struct {
 	id        Userid
@@ -68,6 +62,35 @@ func (ut *userTools) getUseridForNick(nick string) (Userid, bool) {
 	return d.id, d.protected
 }
 
+// getUseridForCachedNick only consults the lookup cache, never the database
+func (ut *userTools) getUseridForCachedNick(nick string) Userid {
+	ut.nicklock.RLock()
+	defer ut.nicklock.RUnlock()
+	if d, ok := ut.nicklookup[strings.ToLower(nick)]; ok {
+		return d.id
+	}
+	return 0
+}
+
+// getAccountCreated returns when the account of the user was created, the
+// zero time if it is not known
+func (ut *userTools) getAccountCreated(uid Userid) time.Time {
+	ut.createdlock.RLock()
+	t, ok := ut.created[uid]
+	ut.createdlock.RUnlock()
+	if ok {
+		return t
+	}
+
+	t = db.getUserCreated(uid)
+	if !t.IsZero() {
+		ut.createdlock.Lock()
+		ut.created[uid] = t
+		ut.createdlock.Unlock()
+	}
+	return t
+}
+
 func (ut *userTools) addUser(u *User, force bool) {
 	lowernick := strings.ToLower(u.nick)
 	if !force {
@@ -97,14 +120,16 @@ type Userid int32
 
 // ffjson: skip
 type User struct {
-	id              Userid
-	nick            string
-	features        uint64
-	lastmessage     []byte
-	lastmessagetime time.Time
-	delayscale      uint8
-	simplified      *SimplifiedUser
-	connections     int32
+	id          Userid
+	nick        string
+	roles       *roleSet
+	lastmessage []byte
+	throttle    tokenBucket
+	dmthrottle  tokenBucket
+	blocks      blockList
+	spamhistory spamHistory
+	simplified  *SimplifiedUser
+	connections int32
 	sync.RWMutex
 }
 
@@ -129,21 +154,19 @@ func userfromSession(m []byte) (u *User) {
 	}
 
 	u = &User{
-		id:              Userid(uid),
-		nick:            su.Username,
-		features:        0,
-		lastmessage:     nil,
-		lastmessagetime: time.Time{},
-		delayscale:      1,
-		simplified:      nil,
-		connections:     0,
-		RWMutex:         sync.RWMutex{},
+		id:          Userid(uid),
+		nick:        su.Username,
+		roles:       nil,
+		lastmessage: nil,
+		simplified:  nil,
+		connections: 0,
+		RWMutex:     sync.RWMutex{},
 	}
 
 	u.setFeatures(su.Features)
 
 	forceupdate := false
-	if cu := namescache.get(u.id); cu != nil && cu.features == u.features {
+	if cu := namescache.get(u.id); cu != nil && cu.roles == u.roles {
 		forceupdate = true
 	}
 
@@ -152,126 +175,73 @@ func userfromSession(m []byte) (u *User) {
 	return
 }
 
-func (u *User) featureGet(bitnum uint64) bool {
-	return ((u.features & bitnum) != 0)
-}
-
-func (u *User) featureSet(bitnum uint64) {
-	u.features |= bitnum
+// hasFeature checks if the user has the feature, only meant for how the user
+// is shown, everything else should check the permissions
+func (u *User) hasFeature(feature string) bool {
+	if u.roles == nil {
+		return false
+	}
+	for _, f := range u.roles.features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
 }
 
-func (u *User) featureCount() (c uint8) {
-	// Counting bits set, Brian Kernighan's way
-	v := u.features
-	for c = 0; v != 0; c++ {
-		v &= v - 1 // clear the least significant bit set
-	}
-	return
+func (u *User) hasPermission(perm string) bool {
+	return u.roles != nil && u.roles.permissions[perm]
 }
 
 // isModerator checks if the user can use mod commands
 func (u *User) isModerator() bool {
-	return u.featureGet(ISMODERATOR | ISADMIN | ISBOT)
+	return u.hasPermission(PERMMODERATOR)
 }
 
 // isSubscriber checks if the user can speak when the chat is in submode
 func (u *User) isSubscriber() bool {
-	return u.featureGet(ISSUBSCRIBER | ISADMIN | ISMODERATOR | ISVIP | ISBOT)
+	return u.hasPermission(PERMSUBSCRIBER)
 }
 
 // isBot checks if the user is exempt from ratelimiting
 func (u *User) isBot() bool {
-	return u.featureGet(ISBOT)
+	return u.hasPermission(PERMBYPASSTHROTTLE)
 }
 
 // isProtected checks if the user can be moderated or not
 func (u *User) isProtected() bool {
-	return u.featureGet(ISADMIN | ISPROTECTED)
+	return u.hasPermission(PERMPROTECTED)
 }
 
+// setFeatures replaces the features of the user, and so the permissions
 func (u *User) setFeatures(features []string) {
-	for _, feature := range features {
-		switch feature {
-		case "admin":
-			u.featureSet(ISADMIN)
-		case "moderator":
-			u.featureSet(ISMODERATOR)
-		case "protected":
-			u.featureSet(ISPROTECTED)
-		case "subscriber":
-			u.featureSet(ISSUBSCRIBER)
-		case "vip":
-			u.featureSet(ISVIP)
-		case "bot":
-			u.featureSet(ISBOT)
-		default:
-			if feature[:5] == "flair" {
-				flair, err := strconv.Atoi(feature[5:])
-				if err != nil {
-					D("Could not parse unknown feature:", feature, err)
-					continue
-				}
-				// six proper features, all others are just useless flairs
-				u.featureSet(1 << (5 + uint8(flair)))
-			}
-		}
-	}
+	u.roles = usertools.getRoleSet(features)
 }
 
 func (u *User) assembleSimplifiedUser() {
-	usertools.featurelock.RLock()
-	f, ok := usertools.features[u.features]
-	usertools.featurelock.RUnlock()
-
-	if !ok {
-		usertools.featurelock.Lock()
-		defer usertools.featurelock.Unlock()
-
-		numfeatures := u.featureCount()
-		f = make([]string, 0, numfeatures)
-		if u.featureGet(ISPROTECTED) {
-			f = append(f, "protected")
-		}
-		if u.featureGet(ISSUBSCRIBER) {
-			f = append(f, "subscriber")
-		}
-		if u.featureGet(ISVIP) {
-			f = append(f, "vip")
-		}
-		if u.featureGet(ISMODERATOR) {
-			f = append(f, "moderator")
-		}
-		if u.featureGet(ISADMIN) {
-			f = append(f, "admin")
-		}
-		if u.featureGet(ISBOT) {
-			f = append(f, "bot")
-		}
-
-		for i := uint8(6); i < 64; i++ {
-			if u.featureGet(1 << i) {
-				flair := fmt.Sprintf("flair%d", i-5)
-				f = append(f, flair)
-			}
-		}
-
-		usertools.features[u.features] = f
+	if u.roles == nil {
+		u.setFeatures(nil)
 	}
 
 	u.simplified = &SimplifiedUser{
 		u.nick,
-		&f,
+		&u.roles.features,
 	}
 }
 
 // ----------
-func getUserFromWebRequest(r *http.Request) (user *User, banned bool, ip string) {
-	ip = r.Header.Get("X-Real-Ip")
+// getIPFromWebRequest returns the already masked ip of the client
+func getIPFromWebRequest(r *http.Request) string {
+	ip := r.Header.Get("X-Real-Ip")
 	if ip == "" {
 		ip, _, _ = net.SplitHostPort(r.RemoteAddr)
 	}
 
-	ip = getMaskedIP(ip)
+	return getMaskedIP(ip)
+}
+
+func getUserFromWebRequest(r *http.Request) (user *User, banned bool, ip string) {
+	ip = getIPFromWebRequest(r)
 	banned = bans.isIPBanned(ip)
 	if banned {
 		return
@@ -316,5 +286,6 @@ func getUserFromWebRequest(r *http.Request) (user *User, banned bool, ip string)
 	cacheIPForUser(user.id, ip)
 	// there is only ever one single "user" struct, the namescache makes sure of that
 	user = namescache.add(user)
+	user.loadBlocks()
 	return
 }
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestUserLookup(t *testing.T) {
@@ -31,28 +36,26 @@ func TestFeatures(t *testing.T) {
 	u.id = uid
 	u.nick = nick
 
-	if u.featureGet(ISPROTECTED) {
+	if u.hasFeature("protected") {
 		t.Error("feature should not be set")
 	}
-	if u.featureGet(ISSUBSCRIBER) {
+	if u.hasFeature("subscriber") {
 		t.Error("feature should not be set")
 	}
-	if u.featureGet(ISVIP) {
+	if u.hasFeature("vip") {
 		t.Error("feature should not be set")
 	}
-	if u.featureGet(ISMODERATOR) {
+	if u.hasFeature("moderator") {
 		t.Error("feature should not be set")
 	}
-	if u.featureGet(ISADMIN) {
+	if u.hasFeature("admin") {
 		t.Error("feature should not be set")
 	}
-	if u.featureGet(ISBOT) {
+	if u.hasFeature("bot") {
 		t.Error("feature should not be set")
 	}
-	for i := uint8(6); i <= 28; i++ {
-		if u.featureGet(1 << i) {
-			t.Error("feature should not be set")
-		}
+	if u.hasFeature("flair1") {
+		t.Error("feature should not be set")
 	}
 	if u.isProtected() {
 		t.Error("should not be protected")
@@ -68,31 +71,33 @@ func TestFeatures(t *testing.T) {
 	}
 
 	//--------
-	features := []string{"admin", "moderator", "protected", "subscriber", "vip", "bot"}
+	features := []string{"flair100", "admin", "moderator", "protected", "subscriber", "vip", "bot", "flair60", "flair2", "unknown"}
 	u.setFeatures(features)
 
-	if !u.featureGet(ISPROTECTED) {
+	if !u.hasFeature("protected") {
 		t.Error("feature should be set")
 	}
-	if !u.featureGet(ISSUBSCRIBER) {
+	if !u.hasFeature("subscriber") {
 		t.Error("feature should be set")
 	}
-	if !u.featureGet(ISVIP) {
+	if !u.hasFeature("vip") {
 		t.Error("feature should be set")
 	}
-	if !u.featureGet(ISMODERATOR) {
+	if !u.hasFeature("moderator") {
 		t.Error("feature should be set")
 	}
-	if !u.featureGet(ISADMIN) {
+	if !u.hasFeature("admin") {
 		t.Error("feature should be set")
 	}
-	if !u.featureGet(ISBOT) {
+	if !u.hasFeature("bot") {
 		t.Error("feature should be set")
 	}
-	for i := uint8(6); i <= 28; i++ {
-		if u.featureGet(1 << i) {
-			t.Error("feature should not be set")
-		}
+	if u.hasFeature("flair1") || u.hasFeature("unknown") {
+		t.Error("feature should not be set")
+	}
+	expected := "protected,subscriber,vip,moderator,admin,bot,flair2,flair60,flair100"
+	if f := strings.Join(u.roles.features, ","); f != expected {
+		t.Error("expected the features in order", expected, "got", f)
 	}
 	if !u.isProtected() {
 		t.Error("should be protected")
@@ -107,3 +112,60 @@ func TestFeatures(t *testing.T) {
 		t.Error("should be moderator")
 	}
 }
+
+func TestRolePermissions(t *testing.T) {
+	u := &User{}
+	u.setFeatures([]string{"moderator", "flair3"})
+	if !u.hasPermission(PERMMUTE) || !u.hasPermission(PERMBAN) || u.hasPermission(PERMBROADCAST) {
+		t.Error("moderators should be able to mute and ban but not broadcast")
+	}
+	if u.isProtected() || u.isBot() {
+		t.Error("moderators should not be protected or exempt from ratelimiting")
+	}
+
+	other := &User{}
+	other.setFeatures([]string{"flair3", "moderator", "moderator"})
+	if other.roles != u.roles {
+		t.Error("users with the same features should share the role set")
+	}
+
+	vip := &User{id: Userid(120), nick: "vipuser"}
+	vip.setFeatures([]string{"vip", "flair3"})
+	vip.assembleSimplifiedUser()
+	namescache.attach(vip)
+	if vip.hasPermission(PERMBROADCAST) {
+		t.Error("vips should not be able to broadcast by default")
+	}
+
+	// the same features get the new permissions once the roles are reloaded
+	dir, err := ioutil.TempDir("", "roles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "settings.cfg")
+	config := "[roles]\nvip = subscriber, broadcast\n\n[modlimits]\nvipmaxmute = 60000000000\n"
+	if err := ioutil.WriteFile(file, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(limits map[string]*modLimit) {
+		usertools.setRoles(defaultroles)
+		modlimits = limits
+		namescache.refreshRoles()
+	}(modlimits)
+	reloadRoleConfig(file)
+
+	u.setFeatures([]string{"vip", "flair3"})
+	if !u.hasPermission(PERMBROADCAST) || !u.hasPermission(PERMSUBSCRIBER) {
+		t.Error("the permissions should come from the reloaded roles")
+	}
+	if !vip.hasPermission(PERMBROADCAST) {
+		t.Error("the connected users should get the reloaded roles")
+	}
+	if l := getModLimit(vip); l.maxmute != time.Minute {
+		t.Error("the moderation limits should be reloaded too, got", l.maxmute)
+	}
+	if roles["moderator"] == nil {
+		t.Error("the roles not in the config should keep their defaults")
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	conf "github.com/msbranco/goconfig"
+)
+
+var (
+	webhookurls       = []string{}
+	webhooksecret     = ""
+	webhookevents     = []string{"BAN", "MUTE", "UNBAN", "SUBONLY", "BROADCAST"}
+	webhookfailurelog = "webhookfailures.log"
+	WEBHOOKWORKERS    = 2
+	WEBHOOKRETRIES    = 5               // how many times a delivery is attempted before it is logged as failed
+	WEBHOOKTIMEOUT    = 5 * time.Second // how long a single delivery can take
+	WEBHOOKBACKOFF    = time.Second     // the wait before the first retry, doubled for every retry after that
+	WEBHOOKMAXBACKOFF = 5 * time.Minute
+	WEBHOOKRETRYWAIT  = time.Minute // how long a retry waits for room in the queue
+)
+
+var errWebhookQueueFull = errors.New("webhook: queue is full")
+
+var (
+	webhooksDelivered = expvar.NewInt("webhooksDelivered")
+	webhooksFailed    = expvar.NewInt("webhooksFailed")
+	webhooksDropped   = expvar.NewInt("webhooksDropped")
+)
+
+func readWebhookConfig(c *conf.ConfigFile) {
+	if v, err := c.GetString("webhooks", "urls"); err == nil {
+		webhookurls = splitConfigList(v)
+	}
+	if v, err := c.GetString("webhooks", "secret"); err == nil {
+		webhooksecret = v
+	}
+	if v, err := c.GetString("webhooks", "events"); err == nil {
+		webhookevents = splitConfigList(strings.ToUpper(v))
+	}
+	if v, err := c.GetString("webhooks", "failurelog"); err == nil {
+		webhookfailurelog = v
+	}
+	if v, err := c.GetInt64("webhooks", "workers"); err == nil && v > 0 {
+		WEBHOOKWORKERS = int(v)
+	}
+	if v, err := c.GetInt64("webhooks", "retries"); err == nil && v > 0 {
+		WEBHOOKRETRIES = int(v)
+	}
+	if v, err := c.GetInt64("webhooks", "timeout"); err == nil {
+		WEBHOOKTIMEOUT = time.Duration(v)
+	}
+	if v, err := c.GetInt64("webhooks", "backoff"); err == nil {
+		WEBHOOKBACKOFF = time.Duration(v)
+	}
+}
+
+// splitConfigList splits a comma separated config value, ignoring empty items
+func splitConfigList(v string) []string {
+	ret := make([]string, 0)
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); len(s) != 0 {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+type WebhookPayload struct {
+	Event     string          `json:"event"`
+	Timestamp int64           `json:"timestamp"`
+	Data      json.RawMessage `json:"data"`
+}
+
+type webhookDelivery struct {
+	url      string
+	event    string
+	body     []byte
+	attempts int
+}
+
+type webhookFailure struct {
+	Time     time.Time       `json:"time"`
+	Url      string          `json:"url"`
+	Event    string          `json:"event"`
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+type Webhooks struct {
+	urls       []string
+	secret     []byte
+	events     map[string]bool
+	client     *http.Client
+	queue      chan *webhookDelivery
+	failurelog string
+	loglock    sync.Mutex
+}
+
+// webhooks is nil when there are no urls configured
+var webhooks *Webhooks
+
+func newWebhooks(urls []string, secret string, events []string, failurelog string) *Webhooks {
+	wh := &Webhooks{
+		urls:       urls,
+		secret:     []byte(secret),
+		events:     make(map[string]bool),
+		client:     &http.Client{Timeout: WEBHOOKTIMEOUT},
+		queue:      make(chan *webhookDelivery, BROADCASTCHANNELSIZE),
+		failurelog: failurelog,
+	}
+	for _, event := range events {
+		wh.events[event] = true
+	}
+	return wh
+}
+
+func initWebhooks() {
+	if len(webhookurls) == 0 {
+		return
+	}
+
+	webhooks = newWebhooks(webhookurls, webhooksecret, webhookevents, webhookfailurelog)
+	for i := 0; i < WEBHOOKWORKERS; i++ {
+		go webhooks.run()
+	}
+}
+
+// enqueue queues the broadcast event for delivery if it is one of the
+// selected events, called from the hub so it must never block
+func (wh *Webhooks) enqueue(m *message) {
+	if wh == nil || !wh.events[m.event] {
+		return
+	}
+
+	data, ok := m.data.([]byte)
+	if !ok {
+		return
+	}
+
+	body, err := json.Marshal(&WebhookPayload{
+		Event:     m.event,
+		Timestamp: unixMilliTime(),
+		Data:      json.RawMessage(data),
+	})
+	if err != nil {
+		D("Unable to marshal webhook payload", m.event, err)
+		return
+	}
+
+	for _, url := range wh.urls {
+		wh.queueDelivery(&webhookDelivery{
+			url:   url,
+			event: m.event,
+			body:  body,
+		})
+	}
+}
+
+// queueDelivery never blocks, the delivery is logged as failed if there is
+// no room for it
+func (wh *Webhooks) queueDelivery(d *webhookDelivery) {
+	select {
+	case wh.queue <- d:
+	default:
+		wh.drop(d)
+	}
+}
+
+// queueRetry waits for room in the queue for up to WEBHOOKRETRYWAIT, so that
+// a retry survives the queue being full for a moment
+func (wh *Webhooks) queueRetry(d *webhookDelivery) {
+	t := time.NewTimer(WEBHOOKRETRYWAIT)
+	defer t.Stop()
+
+	select {
+	case wh.queue <- d:
+	case <-t.C:
+		wh.drop(d)
+	}
+}
+
+// drop logs the delivery as failed without blocking the caller
+func (wh *Webhooks) drop(d *webhookDelivery) {
+	webhooksDropped.Add(1)
+	D("Webhook queue is full, dropping", d.event, "for", d.url)
+	go wh.logFailure(d, errWebhookQueueFull)
+}
+
+func (wh *Webhooks) run() {
+	for d := range wh.queue {
+		wh.deliver(d)
+	}
+}
+
+// deliver tries to post the payload, on failure it schedules a retry with an
+// exponential backoff, until it runs out of retries and logs the failure
+func (wh *Webhooks) deliver(d *webhookDelivery) {
+	d.attempts++
+	err := wh.post(d)
+	if err == nil {
+		webhooksDelivered.Add(1)
+		return
+	}
+
+	if d.attempts >= WEBHOOKRETRIES {
+		webhooksFailed.Add(1)
+		D("Webhook delivery failed for good", d.event, d.url, err)
+		wh.logFailure(d, err)
+		return
+	}
+
+	backoff := WEBHOOKBACKOFF << uint(d.attempts-1)
+	if backoff > WEBHOOKMAXBACKOFF || backoff <= 0 {
+		backoff = WEBHOOKMAXBACKOFF
+	}
+	time.AfterFunc(backoff, func() {
+		wh.queueRetry(d)
+	})
+}
+
+// sign returns the hex encoded HMAC-SHA256 of the body with the secret
+func (wh *Webhooks) sign(body []byte) string {
+	mac := hmac.New(sha256.New, wh.secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (wh *Webhooks) post(d *webhookDelivery) error {
+	req, err := http.NewRequest("POST", d.url, bytes.NewReader(d.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Chat-Event", d.event)
+	req.Header.Set("X-Chat-Signature", "sha256="+wh.sign(d.body))
+
+	resp, err := wh.client.Do(req)
+	if resp != nil && resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook: response code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// logFailure appends the failed delivery to the failure log, one json object
+// per line, so that it can be inspected and replayed later
+func (wh *Webhooks) logFailure(d *webhookDelivery, derr error) {
+	line, err := json.Marshal(&webhookFailure{
+		Time:     time.Now().UTC(),
+		Url:      d.url,
+		Event:    d.event,
+		Attempts: d.attempts,
+		Error:    derr.Error(),
+		Payload:  json.RawMessage(d.body),
+	})
+	if err != nil {
+		D("Unable to marshal webhook failure", err)
+		return
+	}
+
+	wh.loglock.Lock()
+	defer wh.loglock.Unlock()
+
+	f, err := os.OpenFile(wh.failurelog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		D("Unable to open webhook failure log", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		D("Unable to write webhook failure log", err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookRetryAndSignature(t *testing.T) {
+	oldbackoff := WEBHOOKBACKOFF
+	WEBHOOKBACKOFF = time.Millisecond
+	defer func() { WEBHOOKBACKOFF = oldbackoff }()
+
+	var calls int32
+	done := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+		done <- r.Header.Get("X-Chat-Signature") + " " + string(body)
+	}))
+	defer srv.Close()
+
+	wh := newWebhooks([]string{srv.URL}, "secret", []string{"BAN"}, filepath.Join(os.TempDir(), "webhooktest.log"))
+	go wh.run()
+
+	wh.enqueue(&message{event: "MSG", data: []byte(`{"data":"ignored"}`)})
+	wh.enqueue(&message{event: "BAN", data: []byte(`{"data":"bob"}`)})
+
+	select {
+	case got := <-done:
+		parts := strings.SplitN(got, " ", 2)
+		if parts[0] != "sha256="+wh.sign([]byte(parts[1])) {
+			t.Error("invalid signature", got)
+		}
+		if !strings.Contains(parts[1], `"event":"BAN"`) || !strings.Contains(parts[1], `"data":{"data":"bob"}`) {
+			t.Error("unexpected payload", parts[1])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was never delivered")
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Error("expected two failed attempts and one delivery, got", n)
+	}
+}
+
+func TestWebhookFailureLog(t *testing.T) {
+	oldretries := WEBHOOKRETRIES
+	WEBHOOKRETRIES = 1
+	defer func() { WEBHOOKRETRIES = oldretries }()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logfile := filepath.Join(dir, "failures.log")
+	wh := newWebhooks([]string{srv.URL}, "", []string{"MUTE"}, logfile)
+	wh.deliver(&webhookDelivery{url: srv.URL, event: "MUTE", body: []byte(`{}`)})
+
+	data, err := ioutil.ReadFile(logfile)
+	if err != nil || !strings.Contains(string(data), `"event":"MUTE"`) || !strings.Contains(string(data), "502") {
+		t.Error("expected the failure to be logged, got", string(data), err)
+	}
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	defer func(wait time.Duration) { WEBHOOKRETRYWAIT = wait }(WEBHOOKRETRYWAIT)
+	WEBHOOKRETRYWAIT = time.Second
+
+	dir, err := ioutil.TempDir("", "webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logfile := filepath.Join(dir, "failures.log")
+	wh := newWebhooks([]string{"http://localhost"}, "", []string{"BAN"}, logfile)
+	wh.queue = make(chan *webhookDelivery, 1)
+
+	wh.queueDelivery(&webhookDelivery{url: "http://localhost", event: "BAN", body: []byte(`{"n":1}`)})
+	wh.queueDelivery(&webhookDelivery{url: "http://localhost", event: "BAN", body: []byte(`{"n":2}`)})
+
+	deadline := time.Now().Add(time.Second)
+	var data []byte
+	for time.Now().Before(deadline) {
+		if data, _ = ioutil.ReadFile(logfile); len(data) != 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(string(data), `"payload":{"n":2}`) || !strings.Contains(string(data), "queue is full") {
+		t.Error("expected the dropped delivery to be logged, got", string(data))
+	}
+
+	// a retry waits for room instead of being dropped
+	retried := make(chan struct{})
+	go func() {
+		wh.queueRetry(&webhookDelivery{url: "http://localhost", event: "BAN", body: []byte(`{"n":3}`)})
+		close(retried)
+	}()
+	if d := <-wh.queue; string(d.body) != `{"n":1}` {
+		t.Error("expected the first delivery to be queued, got", string(d.body))
+	}
+	<-retried
+	if d := <-wh.queue; string(d.body) != `{"n":3}` {
+		t.Error("expected the retry to be queued once there was room, got", string(d.body))
+	}
+}